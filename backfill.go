@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+)
+
+const backfillUsage = `usage:
+  collection-engine backfill start  [-admin url] [-source name] [-partition p] (-start n -end n | -since ts -until ts) [-rate-limit n] [-rate-limit-period secs]
+  collection-engine backfill status [-admin url] [id]
+  collection-engine backfill stop   [-admin url] id
+`
+
+// runBackfillCommand starts, inspects or stops backfill jobs through the
+// admin endpoint of a running engine, returning the process exit code.
+func runBackfillCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, backfillUsage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("backfill "+args[0], flag.ContinueOnError)
+	admin := fs.String("admin", envOrDefault("COLLECTION_ENGINE_ADMIN", "http://localhost:8081"), "admin endpoint of the running engine")
+	source := fs.String("source", "", "name of the configured source, blank for sourceApi")
+	partition := fs.String("partition", "", "partition of a partitioned source")
+	start := fs.Int("start", -1, "first cursor of the range")
+	end := fs.Int("end", -1, "cursor to stop at")
+	since := fs.String("since", "", "RFC 3339 start of the time range")
+	until := fs.String("until", "", "RFC 3339 end of the time range")
+	rateLimit := fs.Int("rate-limit", 0, "requests per period, defaults to half the live source rate limit")
+	ratePeriod := fs.Int("rate-limit-period", 0, "rate limit period in seconds, defaults to the live source period")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	base := strings.TrimSuffix(*admin, "/") + "/backfills"
+
+	var req *http.Request
+	var err error
+	switch args[0] {
+	case "start":
+		br := engine.BackfillRequest{
+			Source:              *source,
+			Partition:           *partition,
+			Since:               *since,
+			Until:               *until,
+			RateLimit:           *rateLimit,
+			RateLimitPeriodSecs: *ratePeriod,
+		}
+		if *start >= 0 {
+			br.StartCursor = start
+		}
+		if *end >= 0 {
+			br.EndCursor = end
+		}
+		body, _ := json.Marshal(&br)
+		req, err = http.NewRequest(http.MethodPost, base, bytes.NewReader(body))
+	case "status":
+		url := base
+		if fs.NArg() > 0 {
+			url = base + "/" + fs.Arg(0)
+		}
+		req, err = http.NewRequest(http.MethodGet, url, nil)
+	case "stop":
+		if fs.NArg() == 0 {
+			fmt.Fprint(os.Stderr, backfillUsage)
+			return 2
+		}
+		req, err = http.NewRequest(http.MethodDelete, base+"/"+fs.Arg(0), nil)
+	default:
+		fmt.Fprint(os.Stderr, backfillUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error creating request: %s\n", err)
+		return 1
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reaching admin endpoint %s: %s\n", *admin, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		fmt.Fprintf(os.Stderr, "backfill %s failed: %s", args[0], body)
+		return 1
+	}
+
+	var progress []engine.BackfillProgress
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		err = json.Unmarshal(body, &progress)
+	} else {
+		var p engine.BackfillProgress
+		err = json.Unmarshal(body, &p)
+		progress = append(progress, p)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error decoding admin response: %s\n", err)
+		return 1
+	}
+	printBackfills(progress)
+	return 0
+}
+
+func printBackfills(progress []engine.BackfillProgress) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSOURCE\tSTATUS\tPOSITION\tPAGES\tFETCHED\tSTARTED\tLAST ERROR")
+	for _, p := range progress {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n", p.ID, p.Source, p.Status, p.Position, p.Pages, p.Fetched, p.StartedAt.Format(time.RFC3339), p.LastError)
+	}
+	w.Flush()
+}
+
+func envOrDefault(key, def string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return def
+}
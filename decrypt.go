@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+)
+
+const decryptUsage = `usage:
+  collection-engine decrypt [-keyring path] [file ...]
+`
+
+// runDecryptCommand writes the stored message documents read from the files,
+// or stdin, one per line with their encrypted fields decrypted, returning the
+// process exit code.
+func runDecryptCommand(args []string) int {
+	fs := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	keyringPath := fs.String("keyring", os.Getenv("COLLECTION_ENGINE_KEYRING"), "keyring file the fields were encrypted with")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, decryptUsage) }
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *keyringPath == "" {
+		fmt.Fprint(os.Stderr, decryptUsage)
+		return 2
+	}
+	keyring, err := engine.LoadKeyring(*keyringPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	if fs.NArg() == 0 {
+		return decryptDocuments(keyring, "stdin", os.Stdin, out)
+	}
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error opening %s: %s\n", path, err)
+			return 1
+		}
+		code := decryptDocuments(keyring, path, f, out)
+		f.Close()
+		if code != 0 {
+			return code
+		}
+	}
+	return 0
+}
+
+// decryptDocuments decrypts the JSON documents of r, one or more documents
+// in a row or one per line.
+func decryptDocuments(keyring *engine.Keyring, name string, r io.Reader, out io.Writer) int {
+	dec := json.NewDecoder(r)
+	for {
+		var doc json.RawMessage
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading %s: %s\n", name, err)
+			return 1
+		}
+		decrypted, err := keyring.DecryptDocument(doc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error decrypting document of %s: %s\n", name, err)
+			return 1
+		}
+		fmt.Fprintf(out, "%s\n", decrypted)
+	}
+}
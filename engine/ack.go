@@ -0,0 +1,170 @@
+package engine
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// BatchStatus is the progress of a batch fetched from a source.
+type BatchStatus struct {
+	Stream string `json:"stream"`
+	Seq    uint64 `json:"seq"`
+	// Messages is the number of messages fetched in the batch.
+	Messages int `json:"messages"`
+	// Outstanding is the number of them neither stored nor dead-lettered yet.
+	Outstanding int `json:"outstanding"`
+}
+
+// batchTracker counts the outstanding messages of a batch and commits its
+// cursor once none are left and every earlier batch of its stream is done.
+type batchTracker struct {
+	stream      string
+	seq         uint64
+	size        int
+	outstanding int
+	commit      func()
+}
+
+// AckTracker links every message to the batch it was fetched in, so a
+// source's cursor is only committed past a batch once all of its messages
+// are stored or dead-lettered. Batches of a stream commit in the order they
+// were fetched. Messages are keyed by source name and ID; messages the
+// tracker was not given, such as pushed ones, are ignored.
+type AckTracker struct {
+	mu      sync.Mutex
+	seq     uint64
+	streams map[string][]*batchTracker
+	// inflight maps a message key to the batches with a copy of it outstanding, oldest first.
+	inflight  map[string][]*batchTracker
+	committed int64
+}
+
+func NewAckTracker() *AckTracker {
+	return &AckTracker{
+		streams:  make(map[string][]*batchTracker),
+		inflight: make(map[string][]*batchTracker),
+	}
+}
+
+func ackKey(m *Message) string {
+	return m.SourceName + "/" + m.ID
+}
+
+// Track starts tracking batch, fetched from stream, and calls commit once it
+// is done. A batch without messages is done at once, but still commits
+// after the batches fetched before it.
+func (t *AckTracker) Track(stream string, batch []Message, commit func()) {
+	if t == nil {
+		commit()
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seq++
+	b := &batchTracker{stream: stream, seq: t.seq, size: len(batch), outstanding: len(batch), commit: commit}
+	t.streams[stream] = append(t.streams[stream], b)
+	for i := range batch {
+		key := ackKey(&batch[i])
+		t.inflight[key] = append(t.inflight[key], b)
+	}
+	t.advance(stream)
+}
+
+// Ack marks the oldest outstanding copy of the message of p as stored or
+// dead-lettered.
+func (t *AckTracker) Ack(p Payload) {
+	m := payloadMessage(p)
+	if t == nil || m == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := ackKey(m)
+	batches := t.inflight[key]
+	if len(batches) == 0 {
+		return
+	}
+	t.done(key, batches[0], batches[1:])
+}
+
+// AckDuplicate marks the newest outstanding copy of msg as done, the one a
+// dedup service drops while the copy fetched before it goes on.
+func (t *AckTracker) AckDuplicate(msg *Message) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := ackKey(msg)
+	batches := t.inflight[key]
+	if len(batches) == 0 {
+		return
+	}
+	t.done(key, batches[len(batches)-1], batches[:len(batches)-1])
+}
+
+// done counts down b, leaving rest as the batches with key outstanding. It
+// must be called with mu held.
+func (t *AckTracker) done(key string, b *batchTracker, rest []*batchTracker) {
+	if len(rest) == 0 {
+		delete(t.inflight, key)
+	} else {
+		t.inflight[key] = rest
+	}
+	b.outstanding--
+	if b.outstanding == 0 {
+		t.advance(b.stream)
+	}
+}
+
+// advance commits the done batches at the front of stream. It must be
+// called with mu held, so the commits of a stream never overlap.
+func (t *AckTracker) advance(stream string) {
+	batches := t.streams[stream]
+	for len(batches) > 0 && batches[0].outstanding == 0 {
+		batches[0].commit()
+		batches = batches[1:]
+		atomic.AddInt64(&t.committed, 1)
+	}
+	if len(batches) == 0 {
+		delete(t.streams, stream)
+		return
+	}
+	t.streams[stream] = batches
+}
+
+// Batches returns the batches not committed yet, by stream and in the order
+// they were fetched.
+func (t *AckTracker) Batches() []BatchStatus {
+	statuses := []BatchStatus{}
+	if t == nil {
+		return statuses
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, batches := range t.streams {
+		for _, b := range batches {
+			statuses = append(statuses, BatchStatus{Stream: b.stream, Seq: b.seq, Messages: b.size, Outstanding: b.outstanding})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Stream != statuses[j].Stream {
+			return statuses[i].Stream < statuses[j].Stream
+		}
+		return statuses[i].Seq < statuses[j].Seq
+	})
+	return statuses
+}
+
+// Committed returns the number of batches committed so far.
+func (t *AckTracker) Committed() int64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&t.committed)
+}
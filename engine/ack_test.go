@@ -0,0 +1,205 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+func TestAckTrackerCommitsInOrder(t *testing.T) {
+	msgs := test_utils.GenerateMockMessages(4)
+	tracker := engine.NewAckTracker()
+	var committed []int
+	commit := func(n int) func() {
+		return func() { committed = append(committed, n) }
+	}
+
+	tracker.Track("tenant-a", msgs[:2], commit(1))
+	tracker.Track("tenant-a", msgs[2:3], commit(2))
+	tracker.Track("tenant-a", nil, commit(3))
+	tracker.Track("tenant-b", msgs[3:], commit(4))
+
+	tracker.Ack(&msgs[2])
+	tracker.Ack(&engine.ProcessedMessage{msgs[3], "2030-08-24T17:20:00Z"})
+	if len(committed) != 1 || committed[0] != 4 {
+		t.Errorf("expected only the batch of the other stream to commit, got %v", committed)
+	}
+	batches := tracker.Batches()
+	if len(batches) != 3 || batches[0].Outstanding != 2 || batches[1].Outstanding != 0 {
+		t.Errorf("expected the first batch to hold back the ones after it, got %+v", batches)
+	}
+
+	tracker.Ack(&msgs[0])
+	tracker.Ack(&msgs[1])
+	if len(committed) != 4 || committed[1] != 1 || committed[2] != 2 || committed[3] != 3 {
+		t.Errorf("expected the batches to commit in the order they were fetched, got %v", committed)
+	}
+	if tracker.Committed() != 4 || len(tracker.Batches()) != 0 {
+		t.Errorf("expected every batch to be committed, got %d committed and %+v", tracker.Committed(), tracker.Batches())
+	}
+}
+
+func TestAckTrackerDuplicates(t *testing.T) {
+	msgs := test_utils.GenerateMockMessages(2)
+	tracker := engine.NewAckTracker()
+	var committed []int
+	tracker.Track("tenant-a", msgs, func() { committed = append(committed, 1) })
+	tracker.Track("tenant-a", msgs[1:], func() { committed = append(committed, 2) })
+
+	// the copy fetched again is dropped while the first is still in flight
+	tracker.AckDuplicate(&msgs[1])
+	if len(committed) != 0 {
+		t.Errorf("expected nothing to commit before the first copy is stored, got %v", committed)
+	}
+	tracker.Ack(&msgs[0])
+	tracker.Ack(&msgs[1])
+	if len(committed) != 2 {
+		t.Errorf("expected both batches to commit, got %v", committed)
+	}
+	// acks of messages that are not tracked, such as pushed ones, are ignored
+	tracker.Ack(&msgs[1])
+}
+
+func TestSourceCommitsAcknowledgedPages(t *testing.T) {
+	cursorVal := 40
+	mockResp := engine.MessageResponse{
+		Results: test_utils.GenerateMockMessages(2),
+		Cursor:  &cursorVal,
+	}
+	_, ts := setupServiceAndTestServer(mockResp, 200)
+	defer ts.Close()
+
+	store, _ := engine.NewCheckpointStore(filepath.Join(t.TempDir(), "checkpoints.json"))
+	sourceCfg := cfg
+	sourceCfg.Name = "tenant-a"
+	sourceCfg.URL = ts.URL[:len(ts.URL)-len("/messages")]
+	sourceCfg.Checkpoint = store
+	sourceCfg.Acks = engine.NewAckTracker()
+
+	source, _ := engine.NewSourceService(&sourceCfg)
+	msgs := source.HandleGetMessages()
+
+	if cursor := store.Load("tenant-a"); cursor != nil {
+		t.Errorf("expected no checkpoint before the page is acknowledged, got %d", *cursor)
+	}
+	sourceCfg.Acks.Ack(&msgs[0])
+	sourceCfg.Acks.Ack(&msgs[1])
+	if cursor := store.Load("tenant-a"); cursor == nil || *cursor != cursorVal {
+		t.Errorf("expected the cursor past the page to be committed once acknowledged, got %v", cursor)
+	}
+}
+
+func TestEngineCommitsDeadLetteredPages(t *testing.T) {
+	msgs := test_utils.GenerateMockMessages(2)
+	cursorVal := 40
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/40") {
+			writeJSON(w, engine.MessageResponse{Results: []engine.Message{}, Cursor: &cursorVal})
+			return
+		}
+		writeJSON(w, engine.MessageResponse{Results: msgs, Cursor: &cursorVal})
+	}))
+	defer source.Close()
+
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var pmsg engine.ProcessedMessage
+		json.NewDecoder(req.Body).Decode(&pmsg)
+		if strings.HasPrefix(req.URL.Path, "/storage") {
+			// the second message can never be stored
+			if pmsg.ID == msgs[1].ID {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		json.NewEncoder(w).Encode(&pmsg)
+	}))
+	defer downstream.Close()
+
+	cfg := test_utils.BuildCollectionEngineConfig(1, 120, 5)
+	cfg.ProcessingApi.URL = downstream.URL + "/processing"
+	cfg.StorageApi.URL = downstream.URL + "/storage"
+	cfg.Sources = []engine.SourceConfig{
+		{Name: "tenant-a", URL: source.URL, AuthToken: "a", ClientTimeout: (5 * time.Second), RateLimit: 120, RateLimitDuration: 5},
+	}
+	cfg.CheckpointPath = filepath.Join(t.TempDir(), "checkpoints.json")
+	cfg.AckTracking = true
+
+	ce := engine.NewCollectionEngine(cfg)
+	cancel := make(chan bool)
+	ce.Run(cancel)
+	defer close(cancel)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) && ce.Acks.Committed() == 0 {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if ce.StorageService.Metrics.Dropped() != 1 {
+		t.Errorf("expected the second message to run out of retries, got %d dropped", ce.StorageService.Metrics.Dropped())
+	}
+	store, _ := engine.NewCheckpointStore(cfg.CheckpointPath)
+	if cursor := store.Load("tenant-a"); cursor == nil || *cursor != cursorVal {
+		t.Errorf("expected the page to be committed once its messages were stored or dead-lettered, got %v", cursor)
+	}
+}
+
+func TestEngineAcksResponsesWithoutSourceName(t *testing.T) {
+	msgs := test_utils.GenerateMockMessages(2)
+	cursorVal := 40
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/40") {
+			writeJSON(w, engine.MessageResponse{Results: []engine.Message{}, Cursor: &cursorVal})
+			return
+		}
+		writeJSON(w, engine.MessageResponse{Results: msgs, Cursor: &cursorVal})
+	}))
+	defer source.Close()
+
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var pmsg engine.ProcessedMessage
+		json.NewDecoder(req.Body).Decode(&pmsg)
+		if strings.HasPrefix(req.URL.Path, "/storage") {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		// the processing API knows nothing of the engine's source_name
+		json.NewEncoder(w).Encode(map[string]string{"id": pmsg.ID, "message": pmsg.Message.Message, "processing_date": "2030-08-24T17:20:00Z"})
+	}))
+	defer downstream.Close()
+
+	cfg := test_utils.BuildCollectionEngineConfig(1, 120, 5)
+	cfg.ProcessingApi.URL = downstream.URL + "/processing"
+	cfg.StorageApi.URL = downstream.URL + "/storage"
+	cfg.Sources = []engine.SourceConfig{
+		{Name: "tenant-a", URL: source.URL, AuthToken: "a", ClientTimeout: (5 * time.Second), RateLimit: 120, RateLimitDuration: 5},
+	}
+	cfg.CheckpointPath = filepath.Join(t.TempDir(), "checkpoints.json")
+	cfg.WAL = engine.WALConfig{Path: t.TempDir()}
+	cfg.AckTracking = true
+
+	ce := engine.NewCollectionEngine(cfg)
+	cancel := make(chan bool)
+	ce.Run(cancel)
+	defer close(cancel)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) && (ce.Acks.Committed() == 0 || ce.WAL.Len() > 0) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if ce.Acks.Committed() == 0 {
+		t.Errorf("expected the page to be committed once stored, got %+v outstanding", ce.Acks.Batches())
+	}
+	if ce.WAL.Len() != 0 {
+		t.Errorf("expected the stored messages to be complete in the WAL, got %d pending", ce.WAL.Len())
+	}
+}
@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdminServer exposes operational endpoints of a running engine:
+//
+//	GET    /backfills       progress of every backfill job
+//	POST   /backfills       start a backfill job from a BackfillRequest
+//	GET    /backfills/{id}  progress of one job
+//	DELETE /backfills/{id}  stop a job
+//	GET    /transport       connection pool statistics
+//	GET    /batches         polled pages not checkpointed yet, with ack tracking
+type AdminServer struct {
+	Addr   string
+	Engine *CollectionEngine
+	server *http.Server
+}
+
+func NewAdminServer(addr string, ce *CollectionEngine) *AdminServer {
+	as := &AdminServer{
+		Addr:   addr,
+		Engine: ce,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/backfills", as.handleBackfills)
+	mux.HandleFunc("/backfills/", as.handleBackfill)
+	mux.HandleFunc("/transport", as.handleTransport)
+	mux.HandleFunc("/batches", as.handleBatches)
+	as.server = &http.Server{Addr: addr, Handler: mux}
+	return as
+}
+
+func (as *AdminServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	as.server.Handler.ServeHTTP(w, req)
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (as *AdminServer) handleBackfills(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, as.Engine.Backfills())
+	case http.MethodPost:
+		var br BackfillRequest
+		if err := json.NewDecoder(req.Body).Decode(&br); err != nil {
+			http.Error(w, "could not decode backfill request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		job, err := as.Engine.StartBackfill(br)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeAdminJSON(w, http.StatusCreated, job.Progress())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (as *AdminServer) handleBackfill(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/backfills/")
+	job := as.Engine.Backfill(id)
+	if job == nil {
+		http.Error(w, "unknown backfill job '"+id+"'", http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, job.Progress())
+	case http.MethodDelete:
+		job.Stop()
+		writeAdminJSON(w, http.StatusOK, job.Progress())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (as *AdminServer) handleTransport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, as.Engine.Transport.Stats())
+}
+
+func (as *AdminServer) handleBatches(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if as.Engine.Acks == nil {
+		http.Error(w, "ack tracking is not enabled", http.StatusNotFound)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, as.Engine.Acks.Batches())
+}
+
+// Run serves the admin endpoints until cancel receives.
+func (as *AdminServer) Run(cancel <-chan bool) {
+	log.Printf("Admin server listening on %s", as.Addr)
+	go func() {
+		if err := as.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("admin server stopped serving: %s", err)
+		}
+	}()
+
+	<-cancel
+	log.Println("Admin server received cancel signal. Stopping service.")
+	ctx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+	defer stop()
+	as.server.Shutdown(ctx)
+	as.Engine.StopBackfills()
+}
@@ -0,0 +1,222 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuthStatic = "static"
+	AuthBearer = "bearer"
+	AuthBasic  = "basic"
+	AuthOAuth2 = "oauth2"
+
+	defaultAuthHeader    = "X-Auth-Token"
+	defaultRefreshBefore = (30 * time.Second)
+)
+
+// AuthConfig chooses how a client authenticates its requests.
+type AuthConfig struct {
+	// Type is one of the Auth* constants. Requests are not authenticated when blank.
+	Type string `yaml:"type"`
+	// Header and Token are the header static auth sets, Header defaults to X-Auth-Token.
+	// Token is also the bearer token.
+	Header   string `yaml:"header"`
+	Token    string `yaml:"token"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// TokenURL, ClientID, ClientSecret and Scopes configure the OAuth2 client-credentials grant.
+	TokenURL     string   `yaml:"tokenUrl"`
+	ClientID     string   `yaml:"clientId"`
+	ClientSecret string   `yaml:"clientSecret"`
+	Scopes       []string `yaml:"scopes"`
+	// RefreshBefore is how long before expiry an OAuth2 token is replaced, default 30s.
+	RefreshBefore time.Duration `yaml:"refreshBefore"`
+}
+
+// AuthProvider adds credentials to outgoing requests.
+type AuthProvider interface {
+	// Apply sets the credentials on req.
+	Apply(req *http.Request) error
+	// Invalidate drops cached credentials after the API answered 401, and
+	// reports whether a retry with fresh credentials could succeed.
+	Invalidate() bool
+}
+
+// NewAuthProvider returns the provider configured in cfg, nil when cfg.Type
+// is blank. OAuth2 tokens are requested with httpClient.
+func NewAuthProvider(cfg *AuthConfig, httpClient *http.Client) (AuthProvider, error) {
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case AuthStatic:
+		if cfg.Token == "" {
+			return nil, fmt.Errorf("Auth config: Token cannot be blank for static auth")
+		}
+		return &staticAuth{header: paramOrDefault(cfg.Header, defaultAuthHeader), value: cfg.Token}, nil
+	case AuthBearer:
+		if cfg.Token == "" {
+			return nil, fmt.Errorf("Auth config: Token cannot be blank for bearer auth")
+		}
+		return &staticAuth{header: "Authorization", value: "Bearer " + cfg.Token}, nil
+	case AuthBasic:
+		if cfg.Username == "" {
+			return nil, fmt.Errorf("Auth config: Username cannot be blank for basic auth")
+		}
+		return &basicAuth{username: cfg.Username, password: cfg.Password}, nil
+	case AuthOAuth2:
+		if cfg.TokenURL == "" || cfg.ClientID == "" || cfg.ClientSecret == "" {
+			return nil, fmt.Errorf("Auth config: TokenURL, ClientID and ClientSecret cannot be blank for oauth2 auth. TokenURL: '%v', ClientID: '%v'", cfg.TokenURL, cfg.ClientID)
+		}
+		refreshBefore := cfg.RefreshBefore
+		if refreshBefore == 0 {
+			refreshBefore = defaultRefreshBefore
+		}
+		return &oauth2Auth{
+			tokenURL:      cfg.TokenURL,
+			clientID:      cfg.ClientID,
+			clientSecret:  cfg.ClientSecret,
+			scopes:        cfg.Scopes,
+			refreshBefore: refreshBefore,
+			httpClient:    httpClient,
+		}, nil
+	}
+	return nil, fmt.Errorf("Auth config: unknown type '%s'", cfg.Type)
+}
+
+// staticAuth sets a fixed header, the X-Auth-Token of the source API or a bearer token.
+type staticAuth struct {
+	header string
+	value  string
+}
+
+func (a *staticAuth) Apply(req *http.Request) error {
+	req.Header.Set(a.header, a.value)
+	return nil
+}
+
+func (a *staticAuth) Invalidate() bool { return false }
+
+type basicAuth struct {
+	username string
+	password string
+}
+
+func (a *basicAuth) Apply(req *http.Request) error {
+	req.SetBasicAuth(a.username, a.password)
+	return nil
+}
+
+func (a *basicAuth) Invalidate() bool { return false }
+
+// oauth2Auth sends a cached client-credentials access token, requesting a
+// new one RefreshBefore its expiry or after the API rejected it.
+type oauth2Auth struct {
+	tokenURL      string
+	clientID      string
+	clientSecret  string
+	scopes        []string
+	refreshBefore time.Duration
+	httpClient    *http.Client
+	mu            sync.Mutex
+	token         string
+	expiry        time.Time
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func (a *oauth2Auth) Apply(req *http.Request) error {
+	token, err := a.accessToken()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (a *oauth2Auth) Invalidate() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.token = ""
+	return true
+}
+
+func (a *oauth2Auth) accessToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && (a.expiry.IsZero() || time.Now().Before(a.expiry.Add(-a.refreshBefore))) {
+		return a.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(a.scopes) > 0 {
+		form.Set("scope", strings.Join(a.scopes, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, a.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("error creating token request %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(a.clientID), url.QueryEscape(a.clientSecret))
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error requesting oauth2 token: %s", err)
+	}
+	defer drainAndClose(resp.Body)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned status: %v, body: %s", resp.Status, string(body))
+	}
+
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil || tr.AccessToken == "" {
+		return "", fmt.Errorf("could not decode oauth2 token response, body: %s", string(body))
+	}
+	a.token = tr.AccessToken
+	a.expiry = time.Time{}
+	if tr.ExpiresIn > 0 {
+		a.expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	return a.token, nil
+}
+
+// doWithAuth sends the request built by newReq with auth applied. If the API
+// answers 401 and auth can refresh its credentials, the request is rebuilt
+// and sent exactly once more.
+func doWithAuth(httpClient *http.Client, auth AuthProvider, newReq func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		if auth != nil {
+			if err := auth.Apply(req); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || auth == nil || attempt > 0 || !auth.Invalidate() {
+			return resp, nil
+		}
+		drainAndClose(resp.Body)
+	}
+}
@@ -0,0 +1,219 @@
+package engine_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+// tokenServer issues access tokens "token-1", "token-2", ... that expire after expiresIn seconds.
+func tokenServer(t *testing.T, expiresIn int, issued *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id, secret, _ := req.BasicAuth()
+		if id != "client" || secret != "secret" || req.FormValue("grant_type") != "client_credentials" {
+			t.Errorf("unexpected token request, client: '%s', grant_type: '%s'", id, req.FormValue("grant_type"))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.FormValue("scope") != "read write" {
+			t.Errorf("expected scopes to be joined into the scope param, got '%s'", req.FormValue("scope"))
+		}
+		n := atomic.AddInt32(issued, 1)
+		writeJSON(w, map[string]interface{}{"access_token": fmt.Sprintf("token-%d", n), "token_type": "bearer", "expires_in": expiresIn})
+	}))
+}
+
+func oauth2Config(tokenURL string) engine.AuthConfig {
+	return engine.AuthConfig{Type: engine.AuthOAuth2, TokenURL: tokenURL, ClientID: "client", ClientSecret: "secret", Scopes: []string{"read", "write"}}
+}
+
+func TestAuthProviderHeaders(t *testing.T) {
+	tests := map[string]struct {
+		cfg    engine.AuthConfig
+		header string
+		value  string
+	}{
+		"static":        {engine.AuthConfig{Type: engine.AuthStatic, Token: "abc"}, "X-Auth-Token", "abc"},
+		"static header": {engine.AuthConfig{Type: engine.AuthStatic, Header: "X-Api-Key", Token: "abc"}, "X-Api-Key", "abc"},
+		"bearer":        {engine.AuthConfig{Type: engine.AuthBearer, Token: "abc"}, "Authorization", "Bearer abc"},
+		"basic":         {engine.AuthConfig{Type: engine.AuthBasic, Username: "user", Password: "pass"}, "Authorization", "Basic dXNlcjpwYXNz"},
+	}
+	for name, tc := range tests {
+		auth, err := engine.NewAuthProvider(&tc.cfg, http.DefaultClient)
+		if err != nil {
+			t.Fatalf("Test - %s: should not return error, err: %s", name, err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		auth.Apply(req)
+		if got := req.Header.Get(tc.header); got != tc.value {
+			t.Errorf("Test - %s: expected %s header '%s', got '%s'", name, tc.header, tc.value, got)
+		}
+	}
+
+	if auth, err := engine.NewAuthProvider(&engine.AuthConfig{}, http.DefaultClient); auth != nil || err != nil {
+		t.Error("expected no provider and no error for a blank type")
+	}
+}
+
+func TestNewAuthProviderBadConfigs(t *testing.T) {
+	tests := map[string]engine.AuthConfig{
+		"unknown type":    {Type: "kerberos"},
+		"static no token": {Type: engine.AuthStatic},
+		"bearer no token": {Type: engine.AuthBearer},
+		"basic no user":   {Type: engine.AuthBasic, Password: "pass"},
+		"oauth2 no url":   {Type: engine.AuthOAuth2, ClientID: "client", ClientSecret: "secret"},
+		"oauth2 no id":    {Type: engine.AuthOAuth2, TokenURL: "test", ClientSecret: "secret"},
+	}
+	for name, cfg := range tests {
+		if _, err := engine.NewAuthProvider(&cfg, http.DefaultClient); err == nil {
+			t.Errorf("Test - %s: expected an error", name)
+		}
+	}
+}
+
+func TestOAuth2TokenCaching(t *testing.T) {
+	var issued int32
+	tokens := tokenServer(t, 3600, &issued)
+	defer tokens.Close()
+
+	var seen []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen = append(seen, req.Header.Get("Authorization"))
+		writeJSON(w, engine.ProcessedMessage{})
+	}))
+	defer api.Close()
+
+	cfg := pcfg
+	cfg.URL = api.URL
+	cfg.Auth = oauth2Config(tokens.URL)
+	ps, err := engine.NewProcessingService(&cfg)
+	if err != nil {
+		t.Fatalf("should not return error with oauth2 auth, err: %s", err)
+	}
+
+	msgs := test_utils.GenerateMockMessages(2)
+	for i := range msgs {
+		if _, err := ps.Client.PostMessage(&msgs[i]); err != nil {
+			t.Fatalf("should not return error, err: %s", err)
+		}
+	}
+
+	if issued != 1 {
+		t.Errorf("expected the token to be requested once and cached, got %d token requests", issued)
+	}
+	if len(seen) != 2 || seen[0] != "Bearer token-1" || seen[1] != "Bearer token-1" {
+		t.Errorf("expected both requests to carry the cached token, got %v", seen)
+	}
+}
+
+func TestOAuth2TokenRefreshBeforeExpiry(t *testing.T) {
+	var issued int32
+	tokens := tokenServer(t, 1, &issued)
+	defer tokens.Close()
+
+	cfg := oauth2Config(tokens.URL)
+	cfg.RefreshBefore = (900 * time.Millisecond)
+	auth, err := engine.NewAuthProvider(&cfg, http.DefaultClient)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	auth.Apply(req)
+	auth.Apply(req)
+	if issued != 1 {
+		t.Fatalf("expected the token to be reused inside its lifetime, got %d token requests", issued)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	auth.Apply(req)
+	if issued != 2 || req.Header.Get("Authorization") != "Bearer token-2" {
+		t.Errorf("expected the token to be refreshed ahead of expiry, got %d token requests and '%s'", issued, req.Header.Get("Authorization"))
+	}
+}
+
+func TestOAuth2UnauthorizedRetry(t *testing.T) {
+	t.Run("stale token is refreshed and the request retried once", func(t *testing.T) {
+		var issued, requests int32
+		tokens := tokenServer(t, 3600, &issued)
+		defer tokens.Close()
+
+		// the API has revoked the first token
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			if req.Header.Get("Authorization") != "Bearer token-2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			writeJSON(w, engine.ProcessedMessage{})
+		}))
+		defer api.Close()
+
+		cfg := pcfg
+		cfg.URL = api.URL
+		cfg.Auth = oauth2Config(tokens.URL)
+		ps, _ := engine.NewProcessingService(&cfg)
+
+		msg := test_utils.GenerateMockMessages(1)[0]
+		if _, err := ps.Client.PostMessage(&msg); err != nil {
+			t.Errorf("expected the retry with a fresh token to succeed, err: %s", err)
+		}
+		if requests != 2 || issued != 2 {
+			t.Errorf("expected 2 requests and 2 tokens, got %d requests and %d tokens", requests, issued)
+		}
+	})
+
+	t.Run("persistent 401 is returned after one retry", func(t *testing.T) {
+		var issued, requests int32
+		tokens := tokenServer(t, 3600, &issued)
+		defer tokens.Close()
+
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer api.Close()
+
+		cfg := pcfg
+		cfg.URL = api.URL
+		cfg.Auth = oauth2Config(tokens.URL)
+		ps, _ := engine.NewProcessingService(&cfg)
+
+		msg := test_utils.GenerateMockMessages(1)[0]
+		if _, err := ps.Client.PostMessage(&msg); err == nil {
+			t.Error("expected an error when the API keeps answering 401")
+		}
+		if requests != 2 {
+			t.Errorf("expected exactly one retry, got %d requests", requests)
+		}
+	})
+}
+
+func TestSourceServiceAuth(t *testing.T) {
+	var header string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header.Get("Authorization")
+		writeJSON(w, engine.MessageResponse{Results: test_utils.GenerateMockMessages(1)})
+	}))
+	defer ts.Close()
+
+	ss, err := engine.NewSourceService(&engine.SourceServiceConfig{
+		URL:               ts.URL,
+		ClientTimeout:     time.Second,
+		RateLimitDuration: time.Minute,
+		Auth:              engine.AuthConfig{Type: engine.AuthBearer, Token: "abc"},
+	})
+	if err != nil {
+		t.Fatalf("should not require an auth token when auth is configured, err: %s", err)
+	}
+	ss.HandleGetMessages()
+	if header != "Bearer abc" {
+		t.Errorf("expected the source request to carry the bearer token, got '%s'", header)
+	}
+}
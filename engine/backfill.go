@@ -0,0 +1,354 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BackfillRunning   = "running"
+	BackfillCompleted = "completed"
+	BackfillStopped   = "stopped"
+)
+
+// BackfillRequest asks for a range of a configured source to be fetched again,
+// either a cursor range or a creation time range.
+type BackfillRequest struct {
+	// Source is the name of the configured source, blank for the single sourceApi source.
+	Source      string `json:"source"`
+	StartCursor *int   `json:"startCursor,omitempty"`
+	EndCursor   *int   `json:"endCursor,omitempty"`
+	Since       string `json:"since,omitempty"`
+	Until       string `json:"until,omitempty"`
+	// Partition limits the backfill to one partition of a partitioned source.
+	Partition string `json:"partition,omitempty"`
+	// RateLimit defaults to half the rate limit of the live source.
+	RateLimit           int `json:"rateLimit,omitempty"`
+	RateLimitPeriodSecs int `json:"rateLimitPeriodSecs,omitempty"`
+}
+
+// BackfillProgress reports how far a backfill job has got.
+type BackfillProgress struct {
+	ID         string     `json:"id"`
+	Source     string     `json:"source"`
+	Status     string     `json:"status"`
+	Position   string     `json:"position"`
+	Pages      int64      `json:"pages"`
+	Fetched    int64      `json:"fetched"`
+	LastError  string     `json:"lastError,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// BackfillJob runs a second SourceService over a bounded range of a source,
+// feeding the same downstream as the live source.
+type BackfillJob struct {
+	ID       string
+	Request  BackfillRequest
+	Source   *SourceService
+	mu       sync.Mutex
+	status   string
+	position string
+	lastErr  string
+	pages    int64
+	started  time.Time
+	finished *time.Time
+	// offsets is set when the cursor range counts messages, so its last page can be trimmed.
+	offsets bool
+	stop    chan bool
+	done    chan struct{}
+}
+
+// NewBackfillJob builds a job over req for the source described by sc.
+func NewBackfillJob(id string, sc *SourceConfig, req BackfillRequest) (*BackfillJob, error) {
+	return newBackfillJob(id, sc, req, nil, nil)
+}
+
+// newBackfillJob builds the job with its client in the pool of transport,
+// quarantining the results that fail the source schema.
+func newBackfillJob(id string, sc *SourceConfig, req BackfillRequest, transport *Transport, quarantine *Quarantine) (*BackfillJob, error) {
+	if sc.Mode == SourceModeStream {
+		return nil, fmt.Errorf("Backfill: source '%s' is a stream source and cannot be backfilled", sc.Name)
+	}
+
+	cursorRange := req.StartCursor != nil || req.EndCursor != nil
+	timeRange := req.Since != "" || req.Until != ""
+	if cursorRange == timeRange {
+		return nil, fmt.Errorf("Backfill: set either startCursor and endCursor or since and until")
+	}
+
+	sourceCfg := buildSourceConfig(sc)
+	sourceCfg.Partition = req.Partition
+	sourceCfg.PartitionParam = sc.PartitionParam
+	sourceCfg.Transport = transport
+	sourceCfg.Quarantine = quarantine
+	sourceCfg.RequestsLimit = req.RateLimit
+	if sourceCfg.RequestsLimit == 0 {
+		sourceCfg.RequestsLimit = sc.RateLimit / 2
+		if sourceCfg.RequestsLimit == 0 {
+			sourceCfg.RequestsLimit = 1
+		}
+	}
+	if req.RateLimitPeriodSecs > 0 {
+		sourceCfg.RateLimitDuration = time.Duration(req.RateLimitPeriodSecs) * time.Second
+	}
+
+	var start string
+	offsets := false
+	if cursorRange {
+		if req.StartCursor == nil || req.EndCursor == nil || *req.EndCursor <= *req.StartCursor {
+			return nil, fmt.Errorf("Backfill: endCursor must be greater than startCursor")
+		}
+		strategy := sc.Pagination.Strategy
+		if strategy != "" && strategy != PaginationPathCursor && strategy != PaginationOffset {
+			return nil, fmt.Errorf("Backfill: cursor ranges need the %s or %s pagination strategy, source '%s' uses %s", PaginationPathCursor, PaginationOffset, sc.Name, strategy)
+		}
+		start = strconv.Itoa(*req.StartCursor)
+		offsets = strategy == PaginationOffset
+	} else {
+		since, errSince := time.Parse(time.RFC3339Nano, req.Since)
+		until, errUntil := time.Parse(time.RFC3339Nano, req.Until)
+		if errSince != nil || errUntil != nil || !until.After(since) {
+			return nil, fmt.Errorf("Backfill: since and until must be RFC 3339 timestamps with until after since")
+		}
+		// time ranges are walked with since windows whatever the live source uses
+		sourceCfg.Pagination.Strategy = PaginationSince
+		start = req.Since
+	}
+
+	source, err := NewSourceService(sourceCfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := source.Client.Paginator.Seek(start); err != nil {
+		return nil, err
+	}
+
+	return &BackfillJob{
+		ID:       id,
+		Request:  req,
+		Source:   source,
+		status:   BackfillRunning,
+		position: start,
+		offsets:  offsets,
+		stop:     make(chan bool),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// bound drops the messages of the page fetched from position from that are
+// past the end of the range, and reports whether the range is exhausted.
+// Offsets count messages, so an offset range ends at endCursor exactly. A
+// path cursor does not say where in its page the range ends, so such a range
+// ends with the whole page that reaches endCursor.
+func (j *BackfillJob) bound(from string, msgs []Message) ([]Message, bool) {
+	if len(msgs) == 0 {
+		// caught up with the live head of the source
+		return nil, true
+	}
+
+	if j.Request.EndCursor != nil {
+		end := *j.Request.EndCursor
+		position := j.Source.Client.Paginator.Position()
+		if position == "" {
+			return msgs, true
+		}
+		cursor, err := strconv.Atoi(position)
+		if err != nil || cursor < end {
+			return msgs, err != nil
+		}
+		if start, err := strconv.Atoi(from); j.offsets && err == nil && end-start < len(msgs) {
+			if end <= start {
+				return nil, true
+			}
+			msgs = msgs[:end-start]
+		}
+		return msgs, true
+	}
+
+	inRange := msgs[:0:0]
+	for _, msg := range msgs {
+		if !laterTimestamp(msg.CreationDate, j.Request.Until) {
+			inRange = append(inRange, msg)
+		}
+	}
+	return inRange, len(inRange) < len(msgs)
+}
+
+// Run fetches the range until it is exhausted or Stop is called, then closes
+// the job's Messages channel.
+func (j *BackfillJob) Run() {
+	j.mu.Lock()
+	j.started = time.Now()
+	j.mu.Unlock()
+	log.Printf("backfill '%s' of source '%s' started from '%s'", j.ID, j.Request.Source, j.position)
+
+	defer close(j.done)
+	defer close(j.Source.Messages)
+	defer j.Source.Ticker.Stop()
+
+	poll := time.NewTimer(0)
+	defer poll.Stop()
+	for {
+		select {
+		case <-j.Source.Ticker.C:
+			j.Source.Client.RequestsCount = 0
+		case <-j.stop:
+			j.finish(BackfillStopped)
+			return
+		case <-poll.C:
+			from := j.Source.Client.Paginator.Position()
+			msgs, err := j.Source.Client.getMessages()
+			if err != nil {
+				log.Printf("backfill '%s': %s", j.ID, err)
+				j.mu.Lock()
+				j.lastErr = err.Error()
+				j.mu.Unlock()
+				poll.Reset(errWaitTime)
+				continue
+			}
+
+			batch, done := j.bound(from, msgs)
+			for i := range batch {
+				batch[i].SourceName = j.Source.Name
+			}
+			position := j.Source.Client.Paginator.Position()
+			atomic.AddInt64(&j.pages, 1)
+			atomic.AddInt64(&j.Source.fetched, int64(len(batch)))
+			j.mu.Lock()
+			j.position = position
+			j.mu.Unlock()
+			log.Printf("backfill '%s' fetched %d messages, position '%s'", j.ID, j.Source.Fetched(), position)
+
+			if len(batch) > 0 {
+				select {
+				case j.Source.Messages <- batch:
+				case <-j.stop:
+					j.finish(BackfillStopped)
+					return
+				}
+			}
+			if done {
+				j.finish(BackfillCompleted)
+				return
+			}
+			poll.Reset(0)
+		}
+	}
+}
+
+func (j *BackfillJob) finish(status string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.status = status
+	j.finished = &now
+	log.Printf("backfill '%s' %s after %d messages", j.ID, status, j.Source.Fetched())
+}
+
+// Stop ends the job and waits for it to finish.
+func (j *BackfillJob) Stop() {
+	select {
+	case j.stop <- true:
+	case <-j.done:
+	}
+	<-j.done
+}
+
+func (j *BackfillJob) Progress() BackfillProgress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return BackfillProgress{
+		ID:         j.ID,
+		Source:     j.Request.Source,
+		Status:     j.status,
+		Position:   j.position,
+		Pages:      atomic.LoadInt64(&j.pages),
+		Fetched:    j.Source.Fetched(),
+		LastError:  j.lastErr,
+		StartedAt:  j.started,
+		FinishedAt: j.finished,
+	}
+}
+
+// StartBackfill starts a backfill job feeding the downstream of the
+// requested source.
+func (ce *CollectionEngine) StartBackfill(req BackfillRequest) (*BackfillJob, error) {
+	var sc *SourceConfig
+	for _, candidate := range buildSourceConfigs(&ce.Cfg) {
+		if candidate.Name == req.Source {
+			candidate := candidate
+			if candidate.Schema == "" {
+				candidate.Schema = ce.Cfg.Validation.SourceSchema
+			}
+			sc = &candidate
+			break
+		}
+	}
+	d := ce.routes[req.Source]
+	if sc == nil || d == nil {
+		return nil, fmt.Errorf("Backfill: unknown source '%s'", req.Source)
+	}
+
+	ce.backfillMu.Lock()
+	defer ce.backfillMu.Unlock()
+
+	job, err := newBackfillJob(fmt.Sprintf("backfill-%d", len(ce.backfills)+1), sc, req, ce.Transport, ce.Quarantine)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Attach(job.Source.Messages); err != nil {
+		job.Source.Ticker.Stop()
+		return nil, err
+	}
+	ce.backfills = append(ce.backfills, job)
+	go job.Run()
+	return job, nil
+}
+
+// StopBackfill stops the backfill job with id.
+func (ce *CollectionEngine) StopBackfill(id string) (*BackfillJob, error) {
+	job := ce.Backfill(id)
+	if job == nil {
+		return nil, fmt.Errorf("Backfill: unknown job '%s'", id)
+	}
+	job.Stop()
+	return job, nil
+}
+
+// Backfill returns the backfill job with id, nil if there is none.
+func (ce *CollectionEngine) Backfill(id string) *BackfillJob {
+	ce.backfillMu.Lock()
+	defer ce.backfillMu.Unlock()
+	for _, job := range ce.backfills {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// Backfills returns the progress of every backfill job started.
+func (ce *CollectionEngine) Backfills() []BackfillProgress {
+	ce.backfillMu.Lock()
+	defer ce.backfillMu.Unlock()
+	progress := make([]BackfillProgress, 0, len(ce.backfills))
+	for _, job := range ce.backfills {
+		progress = append(progress, job.Progress())
+	}
+	return progress
+}
+
+// StopBackfills stops every running backfill job.
+func (ce *CollectionEngine) StopBackfills() {
+	ce.backfillMu.Lock()
+	jobs := append([]*BackfillJob(nil), ce.backfills...)
+	ce.backfillMu.Unlock()
+	for _, job := range jobs {
+		job.Stop()
+	}
+}
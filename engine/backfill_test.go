@@ -0,0 +1,192 @@
+package engine_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+// cursorServer serves two messages per page at /messages/{n}, with n+10 as the next cursor.
+func cursorServer(requests *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		*requests = append(*requests, req.URL.Path)
+		n, _ := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/messages/"))
+		next := n + 10
+		writeJSON(w, engine.MessageResponse{Results: test_utils.GenerateMockMessages(2), Cursor: &next})
+	}))
+}
+
+func collectBackfill(t *testing.T, job *engine.BackfillJob) [][]engine.Message {
+	var batches [][]engine.Message
+	go job.Run()
+	for {
+		select {
+		case batch, ok := <-job.Source.Messages:
+			if !ok {
+				return batches
+			}
+			batches = append(batches, batch)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("backfill did not finish, got %d batches", len(batches))
+		}
+	}
+}
+
+func TestBackfillCursorRange(t *testing.T) {
+	var requests []string
+	ts := cursorServer(&requests)
+	defer ts.Close()
+
+	start, end := 100, 130
+	sc := engine.SourceConfig{Name: "tenant-a", URL: ts.URL, AuthToken: "test", ClientTimeout: time.Second, RateLimit: 120, RateLimitDuration: 60}
+	job, err := engine.NewBackfillJob("backfill-1", &sc, engine.BackfillRequest{Source: "tenant-a", StartCursor: &start, EndCursor: &end})
+	if err != nil {
+		t.Fatalf("should not return error with a cursor range, err: %s", err)
+	}
+	if job.Source.Client.RequestsLimit != 60 {
+		t.Errorf("expected the backfill rate limit to default to half the live one, got %d", job.Source.Client.RequestsLimit)
+	}
+
+	batches := collectBackfill(t, job)
+
+	expected := []string{"/messages/100", "/messages/110", "/messages/120"}
+	if strings.Join(requests, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected requests %v, got %v", expected, requests)
+	}
+	if len(batches) != 3 || batches[0][0].SourceName != "tenant-a" {
+		t.Errorf("expected 3 batches tagged with the source name, got %d", len(batches))
+	}
+	progress := job.Progress()
+	if progress.Status != engine.BackfillCompleted || progress.Fetched != 6 || progress.Position != "130" {
+		t.Errorf("expected completed progress with 6 messages at 130, got %+v", progress)
+	}
+}
+
+func TestBackfillOffsetRangeTrimsLastPage(t *testing.T) {
+	var offsets []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		offsets = append(offsets, req.URL.Query().Get("offset"))
+		writeJSON(w, engine.MessageResponse{Results: test_utils.GenerateMockMessages(4)})
+	}))
+	defer ts.Close()
+
+	start, end := 0, 6
+	sc := engine.SourceConfig{Name: "tenant-a", URL: ts.URL, AuthToken: "test", ClientTimeout: time.Second, RateLimit: 120, RateLimitDuration: 60,
+		Pagination: engine.PaginationConfig{Strategy: engine.PaginationOffset}}
+	job, err := engine.NewBackfillJob("backfill-1", &sc, engine.BackfillRequest{Source: "tenant-a", StartCursor: &start, EndCursor: &end})
+	if err != nil {
+		t.Fatalf("should not return error with an offset range, err: %s", err)
+	}
+
+	batches := collectBackfill(t, job)
+
+	if strings.Join(offsets, ",") != "0,4" {
+		t.Errorf("expected requests at offsets 0 and 4, got %v", offsets)
+	}
+	if len(batches) != 2 || len(batches[1]) != 2 {
+		t.Errorf("expected the last page to be trimmed to the end of the range, got %d batches", len(batches))
+	}
+	if progress := job.Progress(); progress.Fetched != 6 {
+		t.Errorf("expected 6 messages fetched, got %+v", progress)
+	}
+}
+
+func TestBackfillTimeRange(t *testing.T) {
+	msgs := test_utils.GenerateMockMessages(3)
+	msgs[0].CreationDate = "2030-01-01T00:00:00Z"
+	msgs[1].CreationDate = "2030-01-02T00:00:00Z"
+	msgs[2].CreationDate = "2030-01-04T00:00:00Z"
+
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.URL.RequestURI())
+		writeJSON(w, engine.MessageResponse{Results: msgs})
+	}))
+	defer ts.Close()
+
+	sc := engine.SourceConfig{URL: ts.URL, AuthToken: "test", ClientTimeout: time.Second, RateLimitDuration: 60}
+	job, err := engine.NewBackfillJob("backfill-1", &sc, engine.BackfillRequest{Since: "2029-12-31T00:00:00Z", Until: "2030-01-03T00:00:00Z"})
+	if err != nil {
+		t.Fatalf("should not return error with a time range, err: %s", err)
+	}
+
+	batches := collectBackfill(t, job)
+
+	if len(requests) != 1 || requests[0] != "/messages?since=2029-12-31T00%3A00%3A00Z" {
+		t.Errorf("expected a single since request, got %v", requests)
+	}
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("expected the message after until to be dropped, got %v", batches)
+	}
+}
+
+func TestNewBackfillJobBadRequests(t *testing.T) {
+	start, end := 10, 5
+	sc := engine.SourceConfig{URL: "test", AuthToken: "test", ClientTimeout: time.Second, RateLimitDuration: 60}
+
+	tests := map[string]engine.BackfillRequest{
+		"no range":       {},
+		"both ranges":    {StartCursor: &start, EndCursor: &start, Since: "2030-01-01T00:00:00Z"},
+		"end before":     {StartCursor: &start, EndCursor: &end},
+		"bad timestamps": {Since: "yesterday", Until: "today"},
+	}
+	for name, req := range tests {
+		if _, err := engine.NewBackfillJob("backfill-1", &sc, req); err == nil {
+			t.Errorf("Test - %s: expected an error", name)
+		}
+	}
+}
+
+func TestAdminBackfills(t *testing.T) {
+	var requests []string
+	ts := cursorServer(&requests)
+	defer ts.Close()
+
+	cfg := test_utils.BuildCollectionEngineConfig(1, 120, 60)
+	cfg.SourceApi.URL = ts.URL
+	ce := engine.NewCollectionEngine(cfg)
+	admin := engine.NewAdminServer("127.0.0.1:0", ce)
+
+	body, _ := json.Marshal(map[string]int{"startCursor": 0, "endCursor": 1000000})
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/backfills", bytes.NewReader(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 starting a backfill, got %d: %s", w.Code, w.Body.String())
+	}
+	var started engine.BackfillProgress
+	json.Unmarshal(w.Body.Bytes(), &started)
+	if started.ID == "" || started.Status != engine.BackfillRunning {
+		t.Errorf("expected a running job, got %+v", started)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/backfills", nil))
+	var listed []engine.BackfillProgress
+	json.Unmarshal(w.Body.Bytes(), &listed)
+	if len(listed) != 1 || listed[0].ID != started.ID {
+		t.Errorf("expected the started job to be listed, got %+v", listed)
+	}
+
+	// nothing consumes the downstream, so the job is still running when stopped
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/backfills/"+started.ID, nil))
+	var stopped engine.BackfillProgress
+	json.Unmarshal(w.Body.Bytes(), &stopped)
+	if w.Code != http.StatusOK || stopped.Status != engine.BackfillStopped {
+		t.Errorf("expected the job to be stopped, got %d %+v", w.Code, stopped)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/backfills", strings.NewReader(`{"source":"missing","startCursor":0,"endCursor":10}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown source, got %d", w.Code)
+	}
+}
@@ -0,0 +1,104 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// CheckpointStore persists the last cursor of every source to a JSON file so
+// sources resume where they left off after a restart. Cursors are integers,
+// or strings for pagination strategies with other positions.
+type CheckpointStore struct {
+	mu      sync.Mutex
+	path    string
+	cursors map[string]json.RawMessage
+}
+
+func NewCheckpointStore(path string) (*CheckpointStore, error) {
+	c := &CheckpointStore{
+		path:    path,
+		cursors: make(map[string]json.RawMessage),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading checkpoint file '%s': %s", path, err)
+	}
+	if len(data) == 0 {
+		return c, nil
+	}
+
+	err = json.Unmarshal(data, &c.cursors)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding checkpoint file '%s': %s", path, err)
+	}
+	return c, nil
+}
+
+// Load returns the checkpointed cursor for name, nil if there is none.
+func (c *CheckpointStore) Load(name string) *int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var cursor *int
+	if err := json.Unmarshal(c.cursors[name], &cursor); err != nil {
+		return nil
+	}
+	return cursor
+}
+
+// LoadPosition returns the checkpointed position for name as text, blank if there is none.
+func (c *CheckpointStore) LoadPosition(name string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	position, err := cursorString(c.cursors[name])
+	if err != nil {
+		return ""
+	}
+	return position
+}
+
+// Save records cursor for name and rewrites the checkpoint file.
+func (c *CheckpointStore) Save(name string, cursor *int) error {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	return c.save(name, data)
+}
+
+// SavePosition records a text position for name and rewrites the checkpoint file.
+func (c *CheckpointStore) SavePosition(name, position string) error {
+	data, err := json.Marshal(position)
+	if err != nil {
+		return err
+	}
+	return c.save(name, data)
+}
+
+func (c *CheckpointStore) save(name string, cursor json.RawMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cursors[name] = cursor
+
+	data, err := json.Marshal(c.cursors)
+	if err != nil {
+		return err
+	}
+
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing checkpoint file '%s': %s", tmp, err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("error replacing checkpoint file '%s': %s", c.path, err)
+	}
+	return nil
+}
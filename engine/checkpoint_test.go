@@ -0,0 +1,71 @@
+package engine_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+func TestCheckpointStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+	store, err := engine.NewCheckpointStore(path)
+	if err != nil {
+		t.Fatalf("should not return error for a missing checkpoint file, err: %s", err)
+	}
+
+	if store.Load("tenant-a") != nil {
+		t.Error("unknown source should not have a cursor")
+	}
+
+	a, b := 10, 20
+	store.Save("tenant-a", &a)
+	store.Save("tenant-b", &b)
+	store.Save("tenant-b", nil)
+
+	reopened, err := engine.NewCheckpointStore(path)
+	if err != nil {
+		t.Fatalf("should not return error reopening checkpoint file, err: %s", err)
+	}
+	cursor := reopened.Load("tenant-a")
+	if cursor == nil || *cursor != a {
+		t.Errorf("expected tenant-a cursor to be %d, got %v", a, cursor)
+	}
+	if reopened.Load("tenant-b") != nil {
+		t.Error("expected tenant-b cursor to be reset to nil")
+	}
+}
+
+func TestSourceCheckpoint(t *testing.T) {
+	cursorVal := 40
+	mockResp := engine.MessageResponse{
+		Results: test_utils.GenerateMockMessages(2),
+		Cursor:  &cursorVal,
+	}
+	_, ts := setupServiceAndTestServer(mockResp, 200)
+	defer ts.Close()
+
+	store, _ := engine.NewCheckpointStore(filepath.Join(t.TempDir(), "checkpoints.json"))
+	sourceCfg := cfg
+	sourceCfg.Name = "tenant-a"
+	sourceCfg.URL = ts.URL[:len(ts.URL)-len("/messages")]
+	sourceCfg.Checkpoint = store
+
+	source, _ := engine.NewSourceService(&sourceCfg)
+	msgs := source.HandleGetMessages()
+
+	for _, msg := range msgs {
+		if msg.SourceName != "tenant-a" {
+			t.Errorf("expected messageID='%s' to be tagged with its source name, got '%s'", msg.ID, msg.SourceName)
+		}
+	}
+	if source.Fetched() != 2 {
+		t.Errorf("expected 2 fetched messages, got %d", source.Fetched())
+	}
+
+	restarted, _ := engine.NewSourceService(&sourceCfg)
+	if restarted.Client.Cursor == nil || *restarted.Client.Cursor != cursorVal {
+		t.Errorf("expected restarted source to resume from cursor %d, got %v", cursorVal, restarted.Client.Cursor)
+	}
+}
@@ -0,0 +1,119 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// endpoint describes a single downstream API call made for a message. The
+// processing, storage and pipeline step clients build one per request so
+// they all share the same request handling.
+type endpoint struct {
+	stage          string
+	method         string
+	url            string
+	expectedStatus int
+	httpClient     *http.Client
+	ledger         *AckLedger
+	auth           AuthProvider
+	signer         *RequestSigner
+	events         *CloudEventsConfig
+	// codec encodes the message and decodes the response, JSON when nil.
+	codec       Codec
+	compression *CompressionConfig
+}
+
+// send encodes msg and sends it to the endpoint, returning the response body
+// once the API answers with the expected status. If the request's idempotency
+// key was already acknowledged the recorded body is returned instead.
+func (e endpoint) send(msg Payload) ([]byte, error) {
+	codec := codecOrDefault(e.codec)
+	payload, err := codec.Marshal(msg)
+	if err != nil {
+		log.Printf("error marshalling messageID='%s' before sending to %s. Error: %s", msg.GetID(), e.stage, err)
+		return nil, err
+	}
+
+	key := IdempotencyKey(msg.GetID(), e.stage, payload)
+	if e.ledger != nil {
+		if body, ok := e.ledger.Get(key); ok {
+			log.Printf("messageID='%s' already acknowledged by %s api, skipping request", msg.GetID(), e.stage)
+			return body, nil
+		}
+	}
+
+	body, header := payload, http.Header{"Content-Type": {codec.ContentType()}}
+	if e.events.isSet() {
+		body, header, err = e.events.wrap(msg, e.stage, payload, codec.ContentType())
+		if err != nil {
+			log.Printf("error wrapping messageID='%s' in a CloudEvent before sending to %s. Error: %s", msg.GetID(), e.stage, err)
+			return nil, err
+		}
+	}
+
+	body, encoding, err := e.compression.compress(body)
+	if err != nil {
+		log.Printf("error compressing messageID='%s' before sending to %s. Error: %s", msg.GetID(), e.stage, err)
+		return nil, err
+	}
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	}
+
+	resp, err := doWithAuth(e.httpClient, e.auth, func() (*http.Request, error) {
+		req, err := http.NewRequest(e.method, e.url, bytes.NewBuffer(body))
+		if err != nil {
+			log.Printf("error creating %s message request to %s service. Error: %s", e.method, e.stage, err)
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Accept", codec.ContentType())
+		req.Header.Set(IdempotencyKeyHeader, key)
+		if e.signer != nil {
+			if err := e.signer.Sign(req, body); err != nil {
+				log.Printf("error signing %s message request to %s service. Error: %s", e.method, e.stage, err)
+				return nil, err
+			}
+		}
+		return req, nil
+	})
+	if err != nil {
+		log.Printf("error sending message to %s service. Error: %s", e.stage, err)
+		return nil, err
+	}
+	defer drainAndClose(resp.Body)
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != e.expectedStatus {
+		return nil, fmt.Errorf("received non %d response from %s api: '%s, body: %s'", e.expectedStatus, e.stage, resp.Status, string(respBody))
+	}
+
+	// APIs that speak CloudEvents may answer with one, the message is its data
+	if e.events.isSet() && isJSON(codec) && len(respBody) > 0 {
+		if isCloudEventsResponse(resp.Header) {
+			respBody, err = unwrapCloudEvents(respBody)
+		} else {
+			respBody, _, err = unwrapBinaryCloudEvent(resp.Header, respBody)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error unwrapping CloudEvent response from %s api: %s", e.stage, err)
+		}
+	}
+
+	if e.ledger != nil {
+		if err := e.ledger.Put(key, respBody); err != nil {
+			log.Printf("error recording acknowledgement for messageID='%s'. Error: %s", msg.GetID(), err)
+		}
+	}
+
+	return respBody, nil
+}
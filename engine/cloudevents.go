@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"time"
+)
+
+const (
+	CloudEventsStructured = "structured"
+	CloudEventsBinary     = "binary"
+
+	CloudEventsContentType      = "application/cloudevents+json"
+	CloudEventsBatchContentType = "application/cloudevents-batch+json"
+
+	cloudEventsSpecVersion  = "1.0"
+	cloudEventsHeaderPrefix = "Ce-"
+	defaultCloudEventSource = "collection-engine"
+)
+
+// CloudEventsConfig wraps the messages sent to an API as CloudEvents 1.0.
+// Mode is "structured", the event is the JSON body, or "binary", the
+// attributes are ce- headers and the message is the body. Disabled when blank.
+type CloudEventsConfig struct {
+	Mode string `yaml:"mode"`
+	// Type is the event type, "collection-engine.<stage>" by default.
+	Type string `yaml:"type"`
+	// Source is the event source of messages that have neither a source nor a source name.
+	Source string `yaml:"source"`
+}
+
+func (cfg *CloudEventsConfig) isSet() bool {
+	return cfg != nil && cfg.Mode != ""
+}
+
+func (cfg *CloudEventsConfig) validate() error {
+	if cfg.Mode != "" && cfg.Mode != CloudEventsStructured && cfg.Mode != CloudEventsBinary {
+		return fmt.Errorf("CloudEvents config: Mode must be '%s' or '%s'. Mode: '%v'", CloudEventsStructured, CloudEventsBinary, cfg.Mode)
+	}
+	return nil
+}
+
+// CloudEvent is a CloudEvents 1.0 event in the structured JSON format.
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+}
+
+// event returns the event for msg sent to stage, without its data. The id,
+// source and time are the message's ID, source and creation date.
+func (cfg *CloudEventsConfig) event(msg Payload, stage string) CloudEvent {
+	event := CloudEvent{
+		SpecVersion: cloudEventsSpecVersion,
+		ID:          msg.GetID(),
+		Source:      paramOrDefault(cfg.Source, defaultCloudEventSource),
+		Type:        paramOrDefault(cfg.Type, defaultCloudEventSource+"."+stage),
+	}
+	if m := payloadMessage(msg); m != nil {
+		if m.Source != "" {
+			event.Source = m.Source
+		} else if m.SourceName != "" {
+			event.Source = m.SourceName
+		}
+		if t, err := m.Timestamp(); err == nil {
+			event.Time = t.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return event
+}
+
+// wrap returns the body and headers of a request sending payload, msg
+// encoded as contentType, as an event in the configured mode.
+func (cfg *CloudEventsConfig) wrap(msg Payload, stage string, payload []byte, contentType string) ([]byte, http.Header, error) {
+	event := cfg.event(msg, stage)
+	header := make(http.Header)
+	if cfg.Mode == CloudEventsBinary {
+		header.Set(cloudEventsHeaderPrefix+"Specversion", event.SpecVersion)
+		header.Set(cloudEventsHeaderPrefix+"Id", event.ID)
+		header.Set(cloudEventsHeaderPrefix+"Source", event.Source)
+		header.Set(cloudEventsHeaderPrefix+"Type", event.Type)
+		if event.Time != "" {
+			header.Set(cloudEventsHeaderPrefix+"Time", event.Time)
+		}
+		header.Set("Content-Type", contentType)
+		return payload, header, nil
+	}
+
+	event.DataContentType = contentType
+	if contentType == "application/json" {
+		event.Data = payload
+	} else {
+		event.DataBase64 = base64.StdEncoding.EncodeToString(payload)
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, nil, err
+	}
+	header.Set("Content-Type", CloudEventsContentType)
+	return body, header, nil
+}
+
+// isCloudEventsResponse reports whether header describes a structured event or batch of them.
+func isCloudEventsResponse(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == CloudEventsContentType || mediaType == CloudEventsBatchContentType
+}
+
+// isCloudEventsBatch reports whether header describes a batch of structured events.
+func isCloudEventsBatch(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == CloudEventsBatchContentType
+}
+
+// unwrapCloudEvents replaces the structured events in doc, a single document
+// or an array of them, with their data. Documents that are not events are
+// left as they are.
+func unwrapCloudEvents(doc []byte) ([]byte, error) {
+	doc = bytes.TrimSpace(doc)
+	if len(doc) == 0 {
+		return doc, nil
+	}
+	if doc[0] != '[' {
+		return unwrapCloudEvent(doc)
+	}
+
+	var docs []json.RawMessage
+	if err := json.Unmarshal(doc, &docs); err != nil {
+		return nil, err
+	}
+	for i := range docs {
+		data, err := unwrapCloudEvent(docs[i])
+		if err != nil {
+			return nil, err
+		}
+		docs[i] = data
+	}
+	return json.Marshal(docs)
+}
+
+// unwrapCloudEvent returns the data of a structured event. The event's id,
+// source and time fill in the message's id, source and creation_date when
+// the data does not have them.
+func unwrapCloudEvent(doc []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["specversion"]; !ok {
+		return doc, nil
+	}
+
+	var event CloudEvent
+	if err := json.Unmarshal(doc, &event); err != nil {
+		return nil, fmt.Errorf("could not unmarshal CloudEvent: %s", err)
+	}
+	data := []byte(event.Data)
+	if event.DataBase64 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(event.DataBase64)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode data_base64 of CloudEvent '%s': %s", event.ID, err)
+		}
+		data = decoded
+	}
+	return withEventAttributes(data, event.ID, event.Source, event.Time)
+}
+
+// unwrapBinaryCloudEvent returns body, the data of a binary mode event, with
+// the attributes in header filled in, and whether header describes an event.
+func unwrapBinaryCloudEvent(header http.Header, body []byte) ([]byte, bool, error) {
+	if header.Get(cloudEventsHeaderPrefix+"Specversion") == "" {
+		return body, false, nil
+	}
+	data, err := withEventAttributes(body, header.Get(cloudEventsHeaderPrefix+"Id"), header.Get(cloudEventsHeaderPrefix+"Source"), header.Get(cloudEventsHeaderPrefix+"Time"))
+	return data, true, err
+}
+
+// withEventAttributes sets the id, source and creation_date of the message
+// document data from an event's attributes unless it has them already.
+func withEventAttributes(data []byte, id, source, eventTime string) ([]byte, error) {
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("data of CloudEvent '%s' is not a message: %s", id, err)
+	}
+	for key, val := range map[string]string{"id": id, "source": source, "creation_date": eventTime} {
+		if _, ok := msg[key]; ok || val == "" {
+			continue
+		}
+		msg[key], _ = json.Marshal(val)
+	}
+	return json.Marshal(msg)
+}
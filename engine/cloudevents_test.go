@@ -0,0 +1,215 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCloudEventsStructuredOutput(t *testing.T) {
+	msg := test_utils.GenerateMockMessages(1)[0]
+	msg.Source = "MessagingSystem"
+	msg.CreationDate = "2030-08-24T17:16:52.228009"
+
+	var header http.Header
+	var event engine.CloudEvent
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header
+		body, _ := io.ReadAll(req.Body)
+		json.Unmarshal(body, &event)
+
+		// answer with an event too, the processed message is its data
+		var processed engine.ProcessedMessage
+		json.Unmarshal(event.Data, &processed)
+		processed.ProcessingDate = "2030-08-24T17:20:00Z"
+		data, _ := json.Marshal(processed)
+		w.Header().Set("Content-Type", engine.CloudEventsContentType)
+		writeJSON(w, engine.CloudEvent{SpecVersion: "1.0", ID: processed.ID, Source: "processing", Type: "processed", Data: data})
+	}))
+	defer ts.Close()
+
+	cfg := pcfg
+	cfg.URL = ts.URL
+	cfg.CloudEvents = engine.CloudEventsConfig{Mode: engine.CloudEventsStructured, Type: "com.example.message"}
+	ps, err := engine.NewProcessingService(&cfg)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	processed, err := ps.Client.PostMessage(&msg)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+	if processed.ID != msg.ID || processed.ProcessingDate != "2030-08-24T17:20:00Z" {
+		t.Errorf("expected the response event to be unwrapped, got %+v", processed)
+	}
+
+	if header.Get("Content-Type") != engine.CloudEventsContentType || header.Get(engine.IdempotencyKeyHeader) == "" {
+		t.Errorf("expected a structured event, got headers %v", header)
+	}
+	expected := engine.CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              msg.ID,
+		Source:          "MessagingSystem",
+		Type:            "com.example.message",
+		Time:            "2030-08-24T17:16:52.228009Z",
+		DataContentType: "application/json",
+	}
+	data := event.Data
+	event.Data = nil
+	if !cmp.Equal(event, expected) {
+		t.Errorf("expected event %+v, got %+v", expected, event)
+	}
+	sent, _ := json.Marshal(&msg)
+	if !jsonEqual(t, data, sent) {
+		t.Errorf("expected the message as the event data, got %s", data)
+	}
+}
+
+func TestCloudEventsBinaryOutput(t *testing.T) {
+	msg := engine.ProcessedMessage{test_utils.GenerateMockMessages(1)[0], time.Now().UTC().String()}
+	msg.Source = ""
+	msg.SourceName = "tenant-a"
+	msg.CreationDate = "yesterday"
+
+	var header http.Header
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header
+		body, _ = io.ReadAll(req.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	cfg := scfg
+	cfg.URL = ts.URL
+	cfg.CloudEvents = engine.CloudEventsConfig{Mode: engine.CloudEventsBinary}
+	ss, err := engine.NewStorageService(&cfg)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+	if err := ss.Client.PostMessage(&msg); err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	for name, value := range map[string]string{
+		"Ce-Specversion": "1.0",
+		"Ce-Id":          msg.ID,
+		"Ce-Source":      "tenant-a",
+		"Ce-Type":        "collection-engine.storage",
+		"Content-Type":   "application/json",
+	} {
+		if header.Get(name) != value {
+			t.Errorf("expected header %s to be '%s', got '%s'", name, value, header.Get(name))
+		}
+	}
+	if header.Get("Ce-Time") != "" {
+		t.Errorf("expected no time for a creation date that does not parse, got '%s'", header.Get("Ce-Time"))
+	}
+	sent, _ := json.Marshal(&msg)
+	if !jsonEqual(t, body, sent) {
+		t.Errorf("expected the message as the body, got %s", body)
+	}
+}
+
+func TestCloudEventsBadMode(t *testing.T) {
+	cfg := pcfg
+	cfg.CloudEvents = engine.CloudEventsConfig{Mode: "envelope"}
+	if _, err := engine.NewProcessingService(&cfg); err == nil {
+		t.Error("expected an unknown mode to return an error")
+	}
+}
+
+func TestSourceUnwrapsCloudEvents(t *testing.T) {
+	batch := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if batch {
+			w.Header().Set("Content-Type", engine.CloudEventsBatchContentType)
+			w.Write([]byte(`[
+				{"specversion": "1.0", "id": "3", "source": "mesh", "type": "message", "data": {"message": "third"}},
+				{"specversion": "1.0", "id": "4", "source": "mesh", "type": "message", "data_base64": "eyJtZXNzYWdlIjogImZvdXJ0aCJ9"}
+			]`))
+			return
+		}
+		batch = true
+		w.Write([]byte(`{"results": [
+			{"specversion": "1.0", "id": "evt-1", "source": "mesh", "type": "message", "time": "2030-01-01T00:00:00Z",
+			 "data": {"id": "1", "message": "first", "priority": 3}},
+			{"id": "2", "message": "not an event"}
+		], "cursor": 2}`))
+	}))
+	defer ts.Close()
+
+	ss, err := engine.NewSourceService(&engine.SourceServiceConfig{
+		URL:               ts.URL,
+		AuthToken:         "test",
+		ClientTimeout:     time.Second,
+		RateLimitDuration: time.Minute,
+		RequestsLimit:     10,
+		CloudEvents:       true,
+	})
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	msgs := ss.HandleGetMessages()
+	if len(msgs) != 2 || msgs[0].ID != "1" || msgs[0].Source != "mesh" || msgs[0].CreationDate != "2030-01-01T00:00:00Z" || string(msgs[0].Extra["priority"]) != "3" {
+		t.Fatalf("expected the event data with its attributes filled in, got %+v", msgs)
+	}
+	if msgs[1].ID != "2" || msgs[1].Message != "not an event" {
+		t.Errorf("expected documents that are not events to be read as before, got %+v", msgs[1])
+	}
+
+	msgs = ss.HandleGetMessages()
+	if len(msgs) != 2 || msgs[0].ID != "3" || msgs[0].Message != "third" || msgs[1].ID != "4" || msgs[1].Message != "fourth" {
+		t.Errorf("expected a batch of events to be unwrapped, got %+v", msgs)
+	}
+}
+
+func TestWebhookUnwrapsCloudEvents(t *testing.T) {
+	cfg := webhookConfig(t)
+	cfg.CloudEvents = true
+	ws, _ := engine.NewWebhookSource(&cfg)
+	cancel := make(chan bool)
+	defer close(cancel)
+	go ws.Run(cancel)
+
+	// binary mode, the attributes are headers and the body is the message
+	binary := webhookRequest(t, map[string]string{"message": "binary"}, cfg.Secret)
+	binary.Header.Set("Ce-Specversion", "1.0")
+	binary.Header.Set("Ce-Id", "evt-1")
+	binary.Header.Set("Ce-Source", "mesh")
+	binary.Header.Set("Ce-Type", "message")
+
+	structured := webhookRequest(t, engine.CloudEvent{SpecVersion: "1.0", ID: "evt-2", Source: "mesh", Type: "message", Data: json.RawMessage(`{"message": "structured"}`)}, cfg.Secret)
+	structured.Header.Set("Content-Type", engine.CloudEventsContentType)
+
+	for _, test := range []struct {
+		req      *http.Request
+		id, body string
+	}{
+		{binary, "evt-1", "binary"},
+		{structured, "evt-2", "structured"},
+	} {
+		w := httptest.NewRecorder()
+		ws.ServeHTTP(w, test.req)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+		}
+		select {
+		case batch := <-ws.Messages:
+			if len(batch) != 1 || batch[0].ID != test.id || batch[0].Message != test.body || batch[0].Source != "mesh" {
+				t.Errorf("expected the event to be unwrapped, got %+v", batch)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the webhook batch")
+		}
+	}
+}
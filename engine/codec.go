@@ -0,0 +1,346 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	CodecJSON        = "json"
+	CodecProtobuf    = "protobuf"
+	CodecMessagePack = "msgpack"
+)
+
+// Codec encodes messages on the wire of an API. Its ContentType is sent as
+// the Content-Type of request bodies and the Accept of responses.
+type Codec interface {
+	ContentType() string
+	// Marshal encodes a *Message or *ProcessedMessage.
+	Marshal(msg Payload) ([]byte, error)
+	// Unmarshal decodes data into a *Message or *ProcessedMessage.
+	Unmarshal(data []byte, msg Payload) error
+}
+
+// NewCodec returns the codec called name, JSON when name is blank.
+func NewCodec(name string) (Codec, error) {
+	switch name {
+	case "", CodecJSON:
+		return jsonCodec{}, nil
+	case CodecProtobuf:
+		return protobufCodec{}, nil
+	case CodecMessagePack:
+		return msgpackCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown codec '%s', must be '%s', '%s' or '%s'", name, CodecJSON, CodecProtobuf, CodecMessagePack)
+}
+
+// codecOrDefault returns c, or the JSON codec when c is nil.
+func codecOrDefault(c Codec) Codec {
+	if c == nil {
+		return jsonCodec{}
+	}
+	return c
+}
+
+// isJSON reports whether c encodes JSON, which validation, CloudEvents and
+// the results and cursor fields of a source work with directly.
+func isJSON(c Codec) bool {
+	_, ok := codecOrDefault(c).(jsonCodec)
+	return ok
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (jsonCodec) Marshal(msg Payload) ([]byte, error) { return json.Marshal(msg) }
+
+func (jsonCodec) Unmarshal(data []byte, msg Payload) error { return json.Unmarshal(data, msg) }
+
+// msgpackCodec encodes the JSON document of a message as MessagePack, so the
+// unmodelled fields of a message are kept just as they are with JSON.
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return "application/msgpack" }
+
+func (msgpackCodec) Marshal(msg Payload) ([]byte, error) {
+	doc, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return jsonToMsgpack(doc)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, msg Payload) error {
+	doc, err := msgpackToJSON(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(doc, msg)
+}
+
+func jsonToMsgpack(doc []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	// sorted, so a retried message has the same body and idempotency key
+	enc.SetSortMapKeys(true)
+	if err := enc.Encode(msgpackNumbers(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// msgpackNumbers replaces the json.Numbers in v with integers where they
+// fit and floats otherwise, msgpack would encode them as strings.
+func msgpackNumbers(v interface{}) interface{} {
+	switch val := v.(type) {
+	case json.Number:
+		if n, err := val.Int64(); err == nil {
+			return n
+		}
+		f, _ := val.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range val {
+			val[key] = msgpackNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = msgpackNumbers(item)
+		}
+	}
+	return v
+}
+
+func msgpackToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := msgpack.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// protobufCodec encodes messages as the Message and ProcessedMessage of
+// proto/message.proto.
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string { return "application/x-protobuf" }
+
+func (protobufCodec) Marshal(msg Payload) ([]byte, error) {
+	switch m := msg.(type) {
+	case *Message:
+		return appendProtoMessage(nil, m), nil
+	case *ProcessedMessage:
+		b := protowire.AppendTag(nil, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendProtoMessage(nil, &m.Message))
+		if m.ProcessingDate != "" {
+			b = protowire.AppendTag(b, 2, protowire.BytesType)
+			b = protowire.AppendString(b, m.ProcessingDate)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("protobuf codec cannot encode payload of type %T", msg)
+}
+
+func (protobufCodec) Unmarshal(data []byte, msg Payload) error {
+	switch m := msg.(type) {
+	case *Message:
+		*m = Message{}
+		return unmarshalProtoMessage(data, m)
+	case *ProcessedMessage:
+		*m = ProcessedMessage{}
+		return walkProto(data, func(num protowire.Number, val []byte) error {
+			switch num {
+			case 1:
+				return unmarshalProtoMessage(val, &m.Message)
+			case 2:
+				m.ProcessingDate = string(val)
+			}
+			return nil
+		})
+	}
+	return fmt.Errorf("protobuf codec cannot decode payload of type %T", msg)
+}
+
+// protoMessageFields are the string fields of Message by field number.
+func protoMessageFields(m *Message) map[protowire.Number]*string {
+	return map[protowire.Number]*string{
+		1: &m.ID,
+		2: &m.Source,
+		3: &m.Title,
+		4: &m.CreationDate,
+		5: &m.Message,
+		7: &m.Author,
+		8: &m.SourceName,
+	}
+}
+
+const (
+	protoTagsField  protowire.Number = 6
+	protoExtraField protowire.Number = 15
+)
+
+func appendProtoMessage(b []byte, m *Message) []byte {
+	fields := protoMessageFields(m)
+	for num := protowire.Number(1); num <= 8; num++ {
+		if num == protoTagsField {
+			for _, tag := range m.Tags {
+				b = protowire.AppendTag(b, num, protowire.BytesType)
+				b = protowire.AppendString(b, tag)
+			}
+			continue
+		}
+		if val := *fields[num]; val != "" {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendString(b, val)
+		}
+	}
+	// map<string, bytes> entries, the values are the raw JSON of the field and
+	// the keys are sorted, Go randomises the iteration order of Extra.
+	keys := make([]string, 0, len(m.Extra))
+	for key := range m.Extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		val := m.Extra[key]
+		entry := protowire.AppendTag(nil, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, key)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, val)
+		b = protowire.AppendTag(b, protoExtraField, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+func unmarshalProtoMessage(data []byte, m *Message) error {
+	fields := protoMessageFields(m)
+	return walkProto(data, func(num protowire.Number, val []byte) error {
+		switch {
+		case num == protoTagsField:
+			m.Tags = append(m.Tags, string(val))
+		case num == protoExtraField:
+			var key string
+			var raw []byte
+			err := walkProto(val, func(num protowire.Number, val []byte) error {
+				if num == 1 {
+					key = string(val)
+				} else if num == 2 {
+					raw = append([]byte(nil), val...)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if !json.Valid(raw) {
+				return fmt.Errorf("extra field '%s' is not JSON", key)
+			}
+			if m.Extra == nil {
+				m.Extra = make(map[string]json.RawMessage)
+			}
+			m.Extra[key] = raw
+		case fields[num] != nil:
+			*fields[num] = string(val)
+		}
+		return nil
+	})
+}
+
+// walkProto calls field with the number and value of every length delimited
+// field of data, the only wire type the messages use. Other fields are skipped.
+func walkProto(data []byte, field func(num protowire.Number, val []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+		val, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if err := field(num, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pageJSON returns a page of source results encoded with c as the JSON page
+// the paginators and results and cursor fields work with.
+func pageJSON(c Codec, body []byte) ([]byte, error) {
+	switch codecOrDefault(c).(type) {
+	case msgpackCodec:
+		return msgpackToJSON(body)
+	case protobufCodec:
+		return protoPageJSON(body)
+	}
+	return body, nil
+}
+
+// protoPageJSON decodes a MessagePage into {"results": [...], "cursor": ...}.
+// An integer cursor is kept a number, for sources paginated by path cursor.
+func protoPageJSON(body []byte) ([]byte, error) {
+	page := struct {
+		Results []Message   `json:"results"`
+		Cursor  interface{} `json:"cursor"`
+	}{Results: []Message{}}
+	err := walkProto(body, func(num protowire.Number, val []byte) error {
+		switch num {
+		case 1:
+			var msg Message
+			if err := unmarshalProtoMessage(val, &msg); err != nil {
+				return err
+			}
+			page.Results = append(page.Results, msg)
+		case 2:
+			if n, err := strconv.Atoi(string(val)); err == nil {
+				page.Cursor = n
+			} else {
+				page.Cursor = string(val)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(page)
+}
+
+// documentJSON returns data, a msg encoded with c, as JSON.
+func documentJSON(c Codec, data []byte, msg Payload) ([]byte, error) {
+	switch codecOrDefault(c).(type) {
+	case jsonCodec:
+		return data, nil
+	case msgpackCodec:
+		return msgpackToJSON(data)
+	}
+	if err := c.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return json.Marshal(msg)
+}
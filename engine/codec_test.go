@@ -0,0 +1,184 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/google/go-cmp/cmp"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	var msg engine.Message
+	json.Unmarshal([]byte(extendedMessage), &msg)
+	msg.SourceName = "tenant-a"
+	processed := engine.ProcessedMessage{msg, "2030-08-24T17:20:00Z"}
+
+	for _, name := range []string{engine.CodecJSON, engine.CodecProtobuf, engine.CodecMessagePack} {
+		codec, err := engine.NewCodec(name)
+		if err != nil {
+			t.Fatalf("should not return error, err: %s", err)
+		}
+
+		body, err := codec.Marshal(&processed)
+		if err != nil {
+			t.Fatalf("%s: should not return error, err: %s", name, err)
+		}
+		again, _ := codec.Marshal(&processed)
+		if string(body) != string(again) {
+			t.Errorf("%s: expected the same message to encode to the same body", name)
+		}
+
+		var decoded engine.ProcessedMessage
+		if err := codec.Unmarshal(body, &decoded); err != nil {
+			t.Fatalf("%s: should not return error, err: %s", name, err)
+		}
+		want, _ := json.Marshal(&processed)
+		got, _ := json.Marshal(&decoded)
+		if !jsonEqual(t, got, want) {
+			t.Errorf("%s: expected the message to round trip, got %s", name, got)
+		}
+	}
+
+	if _, err := engine.NewCodec("xml"); err == nil {
+		t.Error("expected an unknown codec to return an error")
+	}
+}
+
+func TestProtobufCodecWireFormat(t *testing.T) {
+	codec, _ := engine.NewCodec(engine.CodecProtobuf)
+	body, _ := codec.Marshal(&engine.Message{ID: "1", Tags: []string{"a", "b"}, Extra: map[string]json.RawMessage{"priority": json.RawMessage("3")}})
+
+	// fields as numbered in proto/message.proto
+	var fields []protowire.Number
+	var values []string
+	for len(body) > 0 {
+		num, _, n := protowire.ConsumeTag(body)
+		body = body[n:]
+		val, n := protowire.ConsumeBytes(body)
+		body = body[n:]
+		fields = append(fields, num)
+		values = append(values, string(val))
+	}
+	if !cmp.Equal(fields, []protowire.Number{1, 6, 6, 15}) || values[0] != "1" || values[2] != "b" {
+		t.Errorf("expected id, two tags and an extra entry, got fields %v with %q", fields, values)
+	}
+}
+
+func TestProcessingMessagePackCodec(t *testing.T) {
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header
+		body, _ := io.ReadAll(req.Body)
+		var doc map[string]interface{}
+		if err := msgpack.Unmarshal(body, &doc); err != nil {
+			t.Errorf("expected a MessagePack body, err: %s", err)
+		}
+		doc["processing_date"] = "2030-08-24T17:20:00Z"
+		resp, _ := msgpack.Marshal(doc)
+		w.Header().Set("Content-Type", "application/msgpack")
+		w.Write(resp)
+	}))
+	defer ts.Close()
+
+	var msg engine.Message
+	json.Unmarshal([]byte(extendedMessage), &msg)
+
+	cfg := pcfg
+	cfg.URL = ts.URL
+	cfg.Codec = engine.CodecMessagePack
+	ps, err := engine.NewProcessingService(&cfg)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+	processed, err := ps.Client.PostMessage(&msg)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	if header.Get("Content-Type") != "application/msgpack" || header.Get("Accept") != "application/msgpack" {
+		t.Errorf("expected MessagePack Content-Type and Accept headers, got %v", header)
+	}
+	if processed.ID != msg.ID || processed.ProcessingDate != "2030-08-24T17:20:00Z" || string(processed.Extra["priority"]) != "3" {
+		t.Errorf("expected the MessagePack response to be decoded, got %+v", processed)
+	}
+
+	cfg.Codec = "yaml"
+	if _, err := engine.NewProcessingService(&cfg); err == nil {
+		t.Error("expected an unknown codec to return an error")
+	}
+}
+
+func TestProcessingCodecMarshalError(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+	}))
+	defer ts.Close()
+
+	// the raw JSON of an unmodelled field cannot be encoded as MessagePack
+	msg := engine.Message{ID: "1", Extra: map[string]json.RawMessage{"priority": json.RawMessage("{not json")}}
+
+	cfg := pcfg
+	cfg.URL = ts.URL
+	cfg.Codec = engine.CodecMessagePack
+	ps, err := engine.NewProcessingService(&cfg)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+	if _, err := ps.Client.PostMessage(&msg); err == nil {
+		t.Error("expected a message the codec cannot encode to return an error")
+	}
+	if requests != 0 {
+		t.Errorf("expected nothing to be sent to the processing api, got %d requests", requests)
+	}
+}
+
+func TestSourceProtobufCodec(t *testing.T) {
+	codec, _ := engine.NewCodec(engine.CodecProtobuf)
+	var accept string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		accept = req.Header.Get("Accept")
+		// a MessagePage with two results and cursor 7
+		var page []byte
+		for _, id := range []string{"1", "2"} {
+			msg, _ := codec.Marshal(&engine.Message{ID: id, Message: "body " + id})
+			page = protowire.AppendTag(page, 1, protowire.BytesType)
+			page = protowire.AppendBytes(page, msg)
+		}
+		page = protowire.AppendTag(page, 2, protowire.BytesType)
+		page = protowire.AppendString(page, "7")
+		w.Header().Set("Content-Type", codec.ContentType())
+		w.Write(page)
+	}))
+	defer ts.Close()
+
+	ss, err := engine.NewSourceService(&engine.SourceServiceConfig{
+		URL:               ts.URL,
+		AuthToken:         "test",
+		ClientTimeout:     time.Second,
+		RateLimitDuration: time.Minute,
+		RequestsLimit:     10,
+		Codec:             engine.CodecProtobuf,
+	})
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	msgs := ss.HandleGetMessages()
+	if len(msgs) != 2 || msgs[0].ID != "1" || msgs[1].Message != "body 2" {
+		t.Errorf("expected the Protobuf page to be decoded, got %+v", msgs)
+	}
+	if accept != "application/x-protobuf" {
+		t.Errorf("expected the Protobuf Accept header, got '%s'", accept)
+	}
+	if ss.Client.Cursor == nil || *ss.Client.Cursor != 7 {
+		t.Errorf("expected the integer cursor to be kept, got %v", ss.Client.Cursor)
+	}
+}
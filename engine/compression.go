@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+
+	// acceptEncoding is sent by clients that decompress responses themselves.
+	acceptEncoding = "gzip, zstd"
+
+	// defaultMaxResponseSize bounds the decompressed size of a source page.
+	defaultMaxResponseSize = 10 << 20
+)
+
+// CompressionConfig compresses request bodies of at least MinSize bytes with
+// Algorithm, "gzip" or "zstd". Disabled when Algorithm is blank.
+type CompressionConfig struct {
+	Algorithm string `yaml:"algorithm"`
+	MinSize   int    `yaml:"minSize"`
+}
+
+func (cfg *CompressionConfig) isSet() bool {
+	return cfg != nil && cfg.Algorithm != ""
+}
+
+func (cfg *CompressionConfig) validate() error {
+	if cfg.Algorithm != "" && cfg.Algorithm != CompressionGzip && cfg.Algorithm != CompressionZstd {
+		return fmt.Errorf("Compression config: Algorithm must be '%s' or '%s'. Algorithm: '%v'", CompressionGzip, CompressionZstd, cfg.Algorithm)
+	}
+	if cfg.MinSize < 0 {
+		return fmt.Errorf("Compression config: MinSize cannot be negative. MinSize: %v", cfg.MinSize)
+	}
+	return nil
+}
+
+// compress returns body compressed and its Content-Encoding, or body as it
+// is and no encoding when it is smaller than MinSize.
+func (cfg *CompressionConfig) compress(body []byte) ([]byte, string, error) {
+	if !cfg.isSet() || len(body) < cfg.MinSize {
+		return body, "", nil
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch cfg.Algorithm {
+	case CompressionGzip:
+		w = gzip.NewWriter(&buf)
+	case CompressionZstd:
+		enc, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, "", err
+		}
+		w = enc
+	default:
+		return nil, "", fmt.Errorf("unknown compression algorithm '%s'", cfg.Algorithm)
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), cfg.Algorithm, nil
+}
+
+// decompress returns body decoded according to the Content-Encoding of
+// header. Unencoded bodies are returned as they are. A body that decodes to
+// more than limit bytes, or a zstd frame with a larger window, returns an
+// error, so a small compressed response cannot exhaust the memory of the engine.
+func decompress(header http.Header, body []byte, limit int) ([]byte, error) {
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return body, nil
+	case CompressionGzip, "x-gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readLimited(r, limit)
+	case CompressionZstd:
+		r, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderMaxMemory(uint64(limit)))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readLimited(r, limit)
+	}
+	return nil, fmt.Errorf("unsupported Content-Encoding '%s'", encoding)
+}
+
+// readLimited reads r to the end, or returns an error once it has more than
+// limit bytes.
+func readLimited(r io.Reader, limit int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, fmt.Errorf("body is larger than %d bytes", limit)
+	}
+	return data, nil
+}
@@ -0,0 +1,232 @@
+package engine_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+	"github.com/klauspost/compress/zstd"
+)
+
+func decodeBody(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+	var r io.Reader = bytes.NewReader(body)
+	switch encoding {
+	case engine.CompressionGzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatalf("expected a gzip body, err: %s", err)
+		}
+		r = gz
+	case engine.CompressionZstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			t.Fatalf("expected a zstd body, err: %s", err)
+		}
+		defer dec.Close()
+		r = dec
+	}
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+	return decoded
+}
+
+func TestStorageCompression(t *testing.T) {
+	msg := engine.ProcessedMessage{test_utils.GenerateMockMessages(1)[0], time.Now().UTC().String()}
+	sent, _ := json.Marshal(&msg)
+
+	for _, test := range []struct {
+		cfg      engine.CompressionConfig
+		encoding string
+	}{
+		{engine.CompressionConfig{Algorithm: engine.CompressionGzip}, "gzip"},
+		{engine.CompressionConfig{Algorithm: engine.CompressionZstd, MinSize: 16}, "zstd"},
+		// smaller than the threshold, sent as it is
+		{engine.CompressionConfig{Algorithm: engine.CompressionZstd, MinSize: len(sent) + 1}, ""},
+		{engine.CompressionConfig{}, ""},
+	} {
+		var encoding string
+		var body []byte
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			encoding = req.Header.Get("Content-Encoding")
+			body, _ = io.ReadAll(req.Body)
+			w.WriteHeader(http.StatusCreated)
+		}))
+
+		cfg := scfg
+		cfg.URL = ts.URL
+		cfg.Compression = test.cfg
+		ss, err := engine.NewStorageService(&cfg)
+		if err != nil {
+			t.Fatalf("should not return error, err: %s", err)
+		}
+		if err := ss.Client.PostMessage(&msg); err != nil {
+			t.Fatalf("should not return error, err: %s", err)
+		}
+		ts.Close()
+
+		if encoding != test.encoding {
+			t.Errorf("expected Content-Encoding '%s', got '%s'", test.encoding, encoding)
+		}
+		if !jsonEqual(t, decodeBody(t, encoding, body), sent) {
+			t.Errorf("expected the message as the %s body, got %s", test.encoding, body)
+		}
+	}
+}
+
+func TestProcessingCompression(t *testing.T) {
+	var encoding string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		encoding = req.Header.Get("Content-Encoding")
+		body, _ := io.ReadAll(req.Body)
+		var processed engine.ProcessedMessage
+		json.Unmarshal(decodeBody(t, encoding, body), &processed)
+		processed.ProcessingDate = "2030-08-24T17:20:00Z"
+		writeJSON(w, processed)
+	}))
+	defer ts.Close()
+
+	msg := test_utils.GenerateMockMessages(1)[0]
+	cfg := pcfg
+	cfg.URL = ts.URL
+	cfg.Compression = engine.CompressionConfig{Algorithm: engine.CompressionGzip, MinSize: 64}
+	ps, err := engine.NewProcessingService(&cfg)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+	processed, err := ps.Client.PostMessage(&msg)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+	if encoding != "gzip" || processed.ID != msg.ID || processed.ProcessingDate != "2030-08-24T17:20:00Z" {
+		t.Errorf("expected a gzip request to be processed, got encoding '%s' and %+v", encoding, processed)
+	}
+}
+
+func TestCompressionBadConfig(t *testing.T) {
+	cfg := pcfg
+	cfg.Compression = engine.CompressionConfig{Algorithm: "brotli"}
+	if _, err := engine.NewProcessingService(&cfg); err == nil {
+		t.Error("expected an unknown algorithm to return an error")
+	}
+
+	storage := scfg
+	storage.Compression = engine.CompressionConfig{Algorithm: engine.CompressionGzip, MinSize: -1}
+	if _, err := engine.NewStorageService(&storage); err == nil {
+		t.Error("expected a negative minimum size to return an error")
+	}
+}
+
+func TestSourceDecompressesResponses(t *testing.T) {
+	page := []byte(`{"results": [{"id": "1", "message": "first"}], "cursor": 2}`)
+	var acceptEncoding string
+	encoding := engine.CompressionZstd
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		acceptEncoding = req.Header.Get("Accept-Encoding")
+		var buf bytes.Buffer
+		switch encoding {
+		case engine.CompressionZstd:
+			enc, _ := zstd.NewWriter(&buf)
+			enc.Write(page)
+			enc.Close()
+		case engine.CompressionGzip:
+			gz := gzip.NewWriter(&buf)
+			gz.Write(page)
+			gz.Close()
+		default:
+			buf.Write(page)
+		}
+		w.Header().Set("Content-Encoding", encoding)
+		w.Write(buf.Bytes())
+	}))
+	defer ts.Close()
+
+	ss, err := engine.NewSourceService(&engine.SourceServiceConfig{
+		URL:               ts.URL,
+		AuthToken:         "test",
+		ClientTimeout:     time.Second,
+		RateLimitDuration: time.Minute,
+		RequestsLimit:     10,
+	})
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	for _, encoding = range []string{engine.CompressionZstd, engine.CompressionGzip} {
+		msgs := ss.HandleGetMessages()
+		if len(msgs) != 1 || msgs[0].ID != "1" || msgs[0].Message != "first" {
+			t.Errorf("expected the %s page to be decompressed, got %+v", encoding, msgs)
+		}
+	}
+	if acceptEncoding != "gzip, zstd" {
+		t.Errorf("expected gzip and zstd to be accepted, got '%s'", acceptEncoding)
+	}
+
+	encoding = "br"
+	if msgs := ss.HandleGetMessages(); len(msgs) != 0 {
+		t.Errorf("expected an unsupported encoding to return no messages, got %+v", msgs)
+	}
+}
+
+func TestSourceLimitsDecompressedResponses(t *testing.T) {
+	// a page of 1 MiB compresses to a few KiB
+	page := []byte(`{"results": [{"id": "1", "message": "` + strings.Repeat("a", 1<<20) + `"}], "cursor": 2}`)
+	encoding := engine.CompressionZstd
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var buf bytes.Buffer
+		switch encoding {
+		case engine.CompressionZstd:
+			// the window of a zstd frame counts against the limit too
+			enc, _ := zstd.NewWriter(&buf, zstd.WithWindowSize(1<<20))
+			enc.Write(page)
+			enc.Close()
+		case engine.CompressionGzip:
+			gz := gzip.NewWriter(&buf)
+			gz.Write(page)
+			gz.Close()
+		}
+		w.Header().Set("Content-Encoding", encoding)
+		w.Write(buf.Bytes())
+	}))
+	defer ts.Close()
+
+	for _, size := range []int{64 << 10, 2 << 20} {
+		ss, err := engine.NewSourceService(&engine.SourceServiceConfig{
+			URL:               ts.URL,
+			AuthToken:         "test",
+			ClientTimeout:     time.Second,
+			RateLimitDuration: time.Minute,
+			RequestsLimit:     10,
+			MaxResponseSize:   size,
+		})
+		if err != nil {
+			t.Fatalf("should not return error, err: %s", err)
+		}
+
+		for _, encoding = range []string{engine.CompressionZstd, engine.CompressionGzip} {
+			msgs := ss.HandleGetMessages()
+			if size < len(page) && len(msgs) != 0 {
+				t.Errorf("expected a %s page larger than %d bytes to return no messages, got %d", encoding, size, len(msgs))
+			}
+			if size > len(page) && len(msgs) != 1 {
+				t.Errorf("expected a %s page smaller than %d bytes to be decompressed, got %d messages", encoding, size, len(msgs))
+			}
+		}
+	}
+
+	if _, err := engine.NewSourceService(&engine.SourceServiceConfig{
+		URL: ts.URL, AuthToken: "test", ClientTimeout: time.Second, RateLimitDuration: time.Minute, MaxResponseSize: -1,
+	}); err == nil {
+		t.Error("expected a negative max response size to return an error")
+	}
+}
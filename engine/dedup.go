@@ -0,0 +1,337 @@
+package engine
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DedupBackendMemory = "memory"
+	DedupBackendFile   = "file"
+)
+
+// SeenSet records message IDs for the deduplication window.
+type SeenSet interface {
+	// Seen records id and reports whether it was already recorded within the window.
+	Seen(id string) (bool, error)
+	// Done marks id stored or dead-lettered. Persistent sets only keep the
+	// IDs that are done across restarts, the others are fetched again.
+	Done(id string) error
+	Close() error
+}
+
+type seenEntry struct {
+	id     string
+	seenAt time.Time
+	done   bool
+}
+
+// MemorySeenSet is an in-memory SeenSet bounded by capacity (least recently
+// seen IDs are evicted first) and by ttl (IDs older than ttl are forgotten).
+type MemorySeenSet struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	order    *list.List
+	now      func() time.Time
+}
+
+func NewMemorySeenSet(capacity int, ttl time.Duration) *MemorySeenSet {
+	return &MemorySeenSet{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+func (m *MemorySeenSet) Seen(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.record(id, m.now()), nil
+}
+
+func (m *MemorySeenSet) Done(id string) error {
+	return nil
+}
+
+func (m *MemorySeenSet) Close() error {
+	return nil
+}
+
+func (m *MemorySeenSet) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+// record must be called with mu held.
+func (m *MemorySeenSet) record(id string, at time.Time) bool {
+	if el, ok := m.entries[id]; ok {
+		entry := el.Value.(*seenEntry)
+		if m.ttl == 0 || at.Sub(entry.seenAt) < m.ttl {
+			m.order.MoveToFront(el)
+			return true
+		}
+		// outside the window, treat as a fresh sighting
+		entry.seenAt = at
+		entry.done = false
+		m.order.MoveToFront(el)
+		return false
+	}
+
+	m.entries[id] = m.order.PushFront(&seenEntry{id: id, seenAt: at})
+	for m.capacity > 0 && m.order.Len() > m.capacity {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*seenEntry).id)
+	}
+	return false
+}
+
+// done marks the entry of id done, recording it at at if it was evicted
+// while in flight. It must be called with mu held.
+func (m *MemorySeenSet) done(id string, at time.Time) *seenEntry {
+	if _, ok := m.entries[id]; !ok {
+		m.record(id, at)
+	}
+	entry := m.entries[id].Value.(*seenEntry)
+	entry.done = true
+	return entry
+}
+
+// FileSeenSet is a SeenSet persisted to an append-only file so the window
+// survives restarts. Lookups are served from an in-memory MemorySeenSet and
+// the file is rewritten once it grows past twice the capacity. An ID is only
+// written once it is done: a message in flight when the engine stops is
+// fetched again after the restart, and must not be dropped as a duplicate.
+type FileSeenSet struct {
+	*MemorySeenSet
+	path    string
+	file    *os.File
+	appends int
+}
+
+func NewFileSeenSet(path string, capacity int, ttl time.Duration) (*FileSeenSet, error) {
+	fs := &FileSeenSet{
+		MemorySeenSet: NewMemorySeenSet(capacity, ttl),
+		path:          path,
+	}
+
+	if err := fs.load(); err != nil {
+		return nil, err
+	}
+	if err := fs.compact(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *FileSeenSet) Done(id string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	entry := fs.done(id, fs.now())
+	_, err := fmt.Fprintf(fs.file, "%d %s\n", entry.seenAt.UnixNano(), id)
+	if err != nil {
+		return fmt.Errorf("error writing messageID='%s' to dedup file '%s': %s", id, fs.path, err)
+	}
+	fs.appends++
+
+	if fs.capacity > 0 && fs.appends > 2*fs.capacity {
+		return fs.compact()
+	}
+	return nil
+}
+
+func (fs *FileSeenSet) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.file.Close()
+}
+
+func (fs *FileSeenSet) load() error {
+	f, err := os.Open(fs.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening dedup file '%s': %s", fs.path, err)
+	}
+	defer f.Close()
+
+	now := fs.now()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		ts, id, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || id == "" {
+			continue
+		}
+		nanos, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			continue
+		}
+		at := time.Unix(0, nanos)
+		if fs.ttl > 0 && now.Sub(at) >= fs.ttl {
+			continue
+		}
+		fs.record(id, at)
+		fs.done(id, at)
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the file with only the done entries currently held in memory.
+// It must be called with mu held or before the set is shared.
+func (fs *FileSeenSet) compact() error {
+	tmp := fs.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("error creating dedup file '%s': %s", tmp, err)
+	}
+
+	w := bufio.NewWriter(f)
+	for el := fs.order.Back(); el != nil; el = el.Prev() {
+		entry := el.Value.(*seenEntry)
+		if !entry.done {
+			continue
+		}
+		fmt.Fprintf(w, "%d %s\n", entry.seenAt.UnixNano(), entry.id)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing dedup file '%s': %s", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fs.path); err != nil {
+		return fmt.Errorf("error replacing dedup file '%s': %s", fs.path, err)
+	}
+
+	if fs.file != nil {
+		fs.file.Close()
+	}
+	fs.file, err = os.OpenFile(fs.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening dedup file '%s': %s", fs.path, err)
+	}
+	fs.appends = 0
+	return nil
+}
+
+type DedupService struct {
+	Seen     SeenSet
+	Input    chan []Message
+	Messages chan []Message
+	// WAL is told of every duplicate dropped when set.
+	WAL *WAL
+	// Acks is told of every duplicate dropped when set.
+	Acks *AckTracker
+	hits int64
+}
+
+type DedupServiceConfig struct {
+	Backend  string
+	Capacity int
+	Window   time.Duration
+	Path     string
+	Input    chan []Message
+	WAL      *WAL
+	Acks     *AckTracker
+}
+
+func NewDedupService(cfg *DedupServiceConfig) (*DedupService, error) {
+	if cfg.Input == nil {
+		return nil, fmt.Errorf("Dedup service config: Input channel cannot be nil")
+	}
+
+	var seen SeenSet
+	switch cfg.Backend {
+	case DedupBackendMemory, "":
+		seen = NewMemorySeenSet(cfg.Capacity, cfg.Window)
+	case DedupBackendFile:
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("Dedup service config: Path cannot be blank for the '%s' backend", DedupBackendFile)
+		}
+		fs, err := NewFileSeenSet(cfg.Path, cfg.Capacity, cfg.Window)
+		if err != nil {
+			return nil, err
+		}
+		seen = fs
+	default:
+		return nil, fmt.Errorf("Dedup service config: unknown backend '%s'", cfg.Backend)
+	}
+
+	return &DedupService{
+		Seen:     seen,
+		Input:    cfg.Input,
+		Messages: make(chan []Message),
+		WAL:      cfg.WAL,
+		Acks:     cfg.Acks,
+	}, nil
+}
+
+// Hits returns the number of duplicate messages dropped so far.
+func (ds *DedupService) Hits() int64 {
+	return atomic.LoadInt64(&ds.hits)
+}
+
+// Filter returns the messages in batch whose IDs were not seen within the window.
+// If the seen set cannot be updated the message is let through rather than dropped.
+// The messages let through are only remembered across restarts once Done.
+func (ds *DedupService) Filter(batch []Message) []Message {
+	var out []Message
+	for _, msg := range batch {
+		dup, err := ds.Seen.Seen(msg.GetID())
+		if err != nil {
+			log.Printf("dedup error for messageID='%s', passing message through. err: %s", msg.ID, err)
+		}
+		if dup {
+			hits := atomic.AddInt64(&ds.hits, 1)
+			log.Printf("dropping duplicate messageID='%s', total duplicates dropped: %d", msg.ID, hits)
+			if err := ds.WAL.Duplicate(&msg); err != nil {
+				log.Printf("error recording duplicate messageID='%s' in the WAL: %s", msg.ID, err)
+			}
+			ds.Acks.AckDuplicate(&msg)
+			continue
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+// Done records the message of p as stored or dead-lettered.
+func (ds *DedupService) Done(p Payload) {
+	if ds == nil {
+		return
+	}
+	if err := ds.Seen.Done(p.GetID()); err != nil {
+		log.Printf("error recording messageID='%s' as done in the dedup seen set: %s", p.GetID(), err)
+	}
+}
+
+func (ds *DedupService) Run() {
+	log.Println("Dedup service started.")
+	for batch := range ds.Input {
+		msgs := ds.Filter(batch)
+		if len(msgs) == 0 {
+			continue
+		}
+		ds.Messages <- msgs
+	}
+	close(ds.Messages)
+	if err := ds.Seen.Close(); err != nil {
+		log.Printf("error closing dedup seen set: %s", err)
+	}
+}
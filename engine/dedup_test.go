@@ -0,0 +1,256 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+func TestMemorySeenSet(t *testing.T) {
+	t.Run("should report IDs already seen", func(t *testing.T) {
+		s := engine.NewMemorySeenSet(10, time.Hour)
+
+		if dup, _ := s.Seen("a"); dup {
+			t.Error("first sighting should not be reported as a duplicate")
+		}
+		if dup, _ := s.Seen("a"); !dup {
+			t.Error("second sighting should be reported as a duplicate")
+		}
+	})
+
+	t.Run("should evict least recently seen IDs past capacity", func(t *testing.T) {
+		s := engine.NewMemorySeenSet(2, time.Hour)
+		s.Seen("a")
+		s.Seen("b")
+		s.Seen("a")
+		s.Seen("c")
+
+		if s.Len() != 2 {
+			t.Errorf("expected seen set to hold 2 entries, got %d", s.Len())
+		}
+		if dup, _ := s.Seen("b"); dup {
+			t.Error("'b' should have been evicted")
+		}
+		if dup, _ := s.Seen("c"); !dup {
+			t.Error("'c' should still be in the seen set")
+		}
+	})
+
+	t.Run("should forget IDs outside the window", func(t *testing.T) {
+		s := engine.NewMemorySeenSet(10, 50*time.Millisecond)
+		s.Seen("a")
+		time.Sleep(60 * time.Millisecond)
+
+		if dup, _ := s.Seen("a"); dup {
+			t.Error("ID seen outside of the window should not be a duplicate")
+		}
+	})
+}
+
+func TestFileSeenSet(t *testing.T) {
+	t.Run("should persist IDs across reopen", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "seen.log")
+		s, err := engine.NewFileSeenSet(path, 10, time.Hour)
+		if err != nil {
+			t.Fatalf("should not return error opening a new file, err: %s", err)
+		}
+		s.Seen("a")
+		s.Done("a")
+		s.Seen("b")
+		s.Done("b")
+		s.Close()
+
+		reopened, err := engine.NewFileSeenSet(path, 10, time.Hour)
+		if err != nil {
+			t.Fatalf("should not return error reopening file, err: %s", err)
+		}
+		defer reopened.Close()
+
+		if dup, _ := reopened.Seen("a"); !dup {
+			t.Error("ID recorded before reopening should be a duplicate")
+		}
+		if dup, _ := reopened.Seen("c"); dup {
+			t.Error("new ID should not be a duplicate")
+		}
+	})
+
+	t.Run("should forget IDs in flight across reopen", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "seen.log")
+		s, _ := engine.NewFileSeenSet(path, 2, time.Hour)
+		s.Seen("a")
+		s.Seen("b")
+		if dup, _ := s.Seen("a"); !dup {
+			t.Error("ID in flight should be a duplicate until the engine stops")
+		}
+		// appending past twice the capacity compacts, which must not write the ID in flight either
+		for i := 0; i < 5; i++ {
+			s.Done("b")
+		}
+		s.Close()
+
+		reopened, _ := engine.NewFileSeenSet(path, 10, time.Hour)
+		defer reopened.Close()
+		if dup, _ := reopened.Seen("b"); !dup {
+			t.Error("ID done before reopening should be a duplicate")
+		}
+		// the message was never stored, so it is fetched again after a crash
+		if dup, _ := reopened.Seen("a"); dup {
+			t.Error("ID never done should not be a duplicate after reopening")
+		}
+	})
+
+	t.Run("should compact file past capacity", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "seen.log")
+		s, _ := engine.NewFileSeenSet(path, 2, time.Hour)
+		for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+			s.Seen(id)
+			if err := s.Done(id); err != nil {
+				t.Fatalf("should not return error recording '%s', err: %s", id, err)
+			}
+		}
+		s.Close()
+
+		reopened, _ := engine.NewFileSeenSet(path, 10, time.Hour)
+		defer reopened.Close()
+		if reopened.Len() >= 6 {
+			t.Errorf("expected compacted file to hold fewer than 6 entries, got %d", reopened.Len())
+		}
+		if dup, _ := reopened.Seen("a"); dup {
+			t.Error("evicted ID should have been dropped from the file on compaction")
+		}
+	})
+}
+
+func TestNewDedupService(t *testing.T) {
+	t.Run("should return a new service", func(t *testing.T) {
+		ds, err := engine.NewDedupService(&engine.DedupServiceConfig{
+			Capacity: 10,
+			Window:   time.Hour,
+			Input:    make(chan []engine.Message),
+		})
+		if err != nil {
+			t.Errorf("new config should not return error when all fields are set. err: %s", err)
+		}
+		if ds == nil {
+			t.Error("service should not be nil")
+		}
+	})
+
+	t.Run("bad configs", func(t *testing.T) {
+		tests := map[string]engine.DedupServiceConfig{
+			"missing Input channel":     {Backend: engine.DedupBackendMemory},
+			"file backend without path": {Backend: engine.DedupBackendFile, Input: make(chan []engine.Message)},
+			"unknown backend":           {Backend: "redis", Input: make(chan []engine.Message)},
+		}
+
+		for name, badConfig := range tests {
+			badConfig := badConfig
+			_, err := engine.NewDedupService(&badConfig)
+			if err == nil {
+				t.Errorf("Test - %s: expected an error", name)
+			}
+		}
+	})
+}
+
+func TestRunDedupService(t *testing.T) {
+	input := make(chan []engine.Message)
+	ds, _ := engine.NewDedupService(&engine.DedupServiceConfig{
+		Capacity: 100,
+		Window:   time.Hour,
+		Input:    input,
+	})
+	go ds.Run()
+
+	msgs := test_utils.GenerateMockMessages(5)
+	go func() {
+		input <- msgs
+		input <- msgs[:3]
+		input <- msgs[3:]
+		close(input)
+	}()
+
+	var results []engine.Message
+	for batch := range ds.Messages {
+		results = append(results, batch...)
+	}
+
+	if len(results) != len(msgs) {
+		t.Errorf("expected %d unique messages, got %d", len(msgs), len(results))
+	}
+	if ds.Hits() != int64(len(msgs)) {
+		t.Errorf("expected %d dedup hits, got %d", len(msgs), ds.Hits())
+	}
+}
+
+func TestEngineRecordsStoredMessagesAsSeen(t *testing.T) {
+	msgs := test_utils.GenerateMockMessages(2)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, engine.MessageResponse{Results: msgs})
+	}))
+	defer source.Close()
+
+	var stored int64
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var pmsg engine.ProcessedMessage
+		json.NewDecoder(req.Body).Decode(&pmsg)
+		if strings.HasPrefix(req.URL.Path, "/storage") {
+			// the second message is never stored before the engine stops
+			if pmsg.ID == msgs[1].ID {
+				time.Sleep(time.Second)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			atomic.AddInt64(&stored, 1)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		json.NewEncoder(w).Encode(&pmsg)
+	}))
+	defer downstream.Close()
+
+	cfg := test_utils.BuildCollectionEngineConfig(2, 120, 5)
+	cfg.ProcessingApi.URL = downstream.URL + "/processing"
+	cfg.StorageApi.URL = downstream.URL + "/storage"
+	cfg.Sources = []engine.SourceConfig{
+		{Name: "tenant-a", URL: source.URL, AuthToken: "a", ClientTimeout: (5 * time.Second), RateLimit: 120, RateLimitDuration: 5},
+	}
+	cfg.Dedup.Enabled = true
+	cfg.Dedup.Backend = engine.DedupBackendFile
+	cfg.Dedup.Capacity = 10
+	cfg.Dedup.Window = time.Hour
+	cfg.Dedup.Path = filepath.Join(t.TempDir(), "seen.log")
+
+	ce := engine.NewCollectionEngine(cfg)
+	cancel := make(chan bool)
+	ce.Run(cancel)
+	defer close(cancel)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) && atomic.LoadInt64(&stored) == 0 {
+		time.Sleep(50 * time.Millisecond)
+	}
+	// the engine records the message once the storage API has answered
+	time.Sleep(100 * time.Millisecond)
+
+	// a restart only drops the message that was stored
+	seen, err := engine.NewFileSeenSet(cfg.Dedup.Path, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("should not return error reopening the seen set, err: %s", err)
+	}
+	defer seen.Close()
+	if dup, _ := seen.Seen(msgs[0].ID); !dup {
+		t.Error("expected the stored message to be recorded as seen")
+	}
+	if dup, _ := seen.Seen(msgs[1].ID); dup {
+		t.Error("expected the message still in flight not to be recorded as seen")
+	}
+}
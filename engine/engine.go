@@ -1,48 +1,190 @@
 package engine
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
+	"strconv"
+	"sync"
 	"time"
 )
 
 type Config struct {
 	DefaultClientTimeout time.Duration `yaml:"defaultClientTimeout"`
 	DefaultWorkersCount  int           `yaml:"defaultWorkersCount"`
-	SourceApi            struct {
-		URL               string        `yaml:"baseUrl"`
-		AuthToken         string        `yaml:"authToken"`
-		ClientTimeout     time.Duration `yaml:"timeout"`
-		RateLimit         int           `yaml:"rateLimit"`
-		RateLimitDuration int           `yaml:"rateLimitPeriodSecs"`
-	} `yaml:"sourceApi"`
-	ProcessingApi struct {
-		URL          string        `yaml:"baseUrl"`
-		Timeout      time.Duration `yaml:"timeout"`
-		WorkersCount int           `yaml:"workersCount"`
-	} `yaml:"processingApi"`
-	StorageApi struct {
-		URL          string        `yaml:"baseUrl"`
-		Timeout      time.Duration `yaml:"timeout"`
-		WorkersCount int           `yaml:"workersCount"`
-	} `yaml:"storageApi"`
+	SourceApi            SourceConfig  `yaml:"sourceApi"`
+	// Sources replaces SourceApi with several named sources when set.
+	Sources        []SourceConfig `yaml:"sources"`
+	CheckpointPath string         `yaml:"checkpointPath"`
+	Webhook        struct {
+		Enabled    bool   `yaml:"enabled"`
+		Name       string `yaml:"name"`
+		Addr       string `yaml:"addr"`
+		Path       string `yaml:"path"`
+		Secret     string `yaml:"secret"`
+		MaxPending int    `yaml:"maxPending"`
+		SpoolPath  string `yaml:"spoolPath"`
+		// CloudEvents unwraps pushed CloudEvents into the messages they carry.
+		CloudEvents bool `yaml:"cloudEvents"`
+	} `yaml:"webhook"`
+	ProcessingApi ApiConfig `yaml:"processingApi"`
+	StorageApi    ApiConfig `yaml:"storageApi"`
+	Dedup         struct {
+		Enabled  bool          `yaml:"enabled"`
+		Backend  string        `yaml:"backend"`
+		Capacity int           `yaml:"capacity"`
+		Window   time.Duration `yaml:"window"`
+		Path     string        `yaml:"path"`
+	} `yaml:"dedup"`
+	AckLedgerPath string `yaml:"ackLedgerPath"`
+	// AckLedgerWindow is how long acknowledged keys are kept, for as long as the file is when 0.
+	AckLedgerWindow time.Duration `yaml:"ackLedgerWindow"`
+	// Validation checks source results and processing responses against JSON
+	// Schemas, sending the payloads that fail to the quarantine file.
+	Validation struct {
+		SourceSchema     string `yaml:"sourceSchema"`
+		ProcessingSchema string `yaml:"processingSchema"`
+		QuarantinePath   string `yaml:"quarantinePath"`
+	} `yaml:"validation"`
+	// Privacy masks, hashes or encrypts message fields between processing and storage.
+	Privacy PrivacyConfig `yaml:"privacy"`
+	// WAL logs the messages in flight to disk and replays them on startup.
+	WAL WALConfig `yaml:"wal"`
+	// AckTracking holds back the checkpoint of every polled page until all of
+	// its messages are stored or dead-lettered.
+	AckTracking bool `yaml:"ackTracking"`
+	// Ordering keeps the messages with the same key in order through processing and storage.
+	Ordering OrderingConfig `yaml:"ordering"`
+	// Integrity hashes every ingested message and signs the records sent to storage.
+	Integrity IntegrityConfig `yaml:"integrity"`
+	// Stages replaces the processing and storage APIs with an ordered chain of HTTP steps when set.
+	Stages []StageConfig `yaml:"stages"`
+	// AdminAddr is where the admin endpoints, such as backfills, are served. Disabled when blank.
+	AdminAddr string `yaml:"adminAddr"`
+	// Transport tunes the connection pool shared by every HTTP client.
+	Transport TransportConfig `yaml:"transport"`
+}
+
+// ApiConfig describes a downstream API, processing or storage.
+type ApiConfig struct {
+	URL          string        `yaml:"baseUrl"`
+	Timeout      time.Duration `yaml:"timeout"`
+	WorkersCount int           `yaml:"workersCount"`
+	Auth         AuthConfig    `yaml:"auth"`
+	Signing      SigningConfig `yaml:"signing"`
+	TLS          TLSConfig     `yaml:"tls"`
+	// CloudEvents wraps every message sent to the API as a CloudEvent when its Mode is set.
+	CloudEvents CloudEventsConfig `yaml:"cloudEvents"`
+	// Codec is the wire encoding of the API, JSON by default.
+	Codec string `yaml:"codec"`
+	// Compression compresses request bodies when its Algorithm is set.
+	Compression CompressionConfig `yaml:"compression"`
+}
+
+// SourceConfig describes one named upstream source.
+type SourceConfig struct {
+	Name              string        `yaml:"name"`
+	URL               string        `yaml:"baseUrl"`
+	AuthToken         string        `yaml:"authToken"`
+	ClientTimeout     time.Duration `yaml:"timeout"`
+	RateLimit         int           `yaml:"rateLimit"`
+	RateLimitDuration int           `yaml:"rateLimitPeriodSecs"`
+	// Isolated sources get their own downstream workers instead of sharing them with the other sources.
+	Isolated bool `yaml:"isolated"`
+	// PageSize, MinPollInterval and MaxPollInterval tune how often an idle source is polled.
+	PageSize        int           `yaml:"pageSize"`
+	MinPollInterval time.Duration `yaml:"minPollInterval"`
+	MaxPollInterval time.Duration `yaml:"maxPollInterval"`
+	// Pagination chooses how pages are requested and decoded, default /messages/{cursor}.
+	Pagination PaginationConfig `yaml:"pagination"`
+	// Partitions splits the source into partitions 0..Partitions-1 fetched in
+	// parallel, each sent in the PartitionParam query parameter.
+	Partitions     int    `yaml:"partitions"`
+	PartitionParam string `yaml:"partitionParam"`
+	// Mode is "poll" to page through GET /messages or "stream" to subscribe to StreamPath.
+	Mode         string `yaml:"mode"`
+	StreamFormat string `yaml:"streamFormat"`
+	StreamPath   string `yaml:"streamPath"`
+	// Auth replaces the X-Auth-Token header with another way of authenticating when set.
+	Auth AuthConfig `yaml:"auth"`
+	TLS  TLSConfig  `yaml:"tls"`
+	// Fields maps the ID and timestamp of messages from other paths of the document.
+	Fields FieldMapping `yaml:"fields"`
+	// Schema replaces Validation.SourceSchema for this source when set.
+	Schema string `yaml:"schema"`
+	// CloudEvents unwraps results that are CloudEvents into the messages they carry.
+	CloudEvents bool `yaml:"cloudEvents"`
+	// Codec is the wire encoding of the source, JSON by default.
+	Codec string `yaml:"codec"`
+	// MaxResponseSize bounds the size in bytes of a page once decompressed, 10 MiB by default.
+	MaxResponseSize int `yaml:"maxResponseSize"`
 }
 
 type CollectionEngine struct {
-	Cfg               Config
-	ProcessingService *ProcessingService
-	RetryService      *RetryService
+	Cfg          Config
+	Sources      []*SourceService
+	Streams      []*StreamSource
+	Webhook      *WebhookSource
+	Admin        *AdminServer
+	Downstreams  []*Downstream
+	RetryService *RetryService
+	// Transport pools the connections of every client of the engine.
+	Transport *Transport
+	// Quarantine receives the payloads that fail validation.
+	Quarantine *Quarantine
+	// WAL logs the messages in flight when set.
+	WAL *WAL
+	// Acks tracks the polled pages not checkpointed yet when set.
+	Acks *AckTracker
+	// routes maps every source name to the downstream its messages flow into.
+	routes     map[string]*Downstream
+	backfillMu sync.Mutex
+	backfills  []*BackfillJob
+
+	// first source and downstream, the only ones unless Sources is configured
 	SourceService     *SourceService
+	DedupService      *DedupService
+	Pipeline          *Pipeline
+	ProcessingService *ProcessingService
+	PrivacyService    *PrivacyService
 	StorageService    *StorageService
 }
 
+// Downstream is everything messages from a source flow through: optional
+// dedup followed by either the processing, optional privacy and storage
+// services or the configured pipeline stages.
+type Downstream struct {
+	Name              string
+	Messages          chan []Message
+	DedupService      *DedupService
+	Pipeline          *Pipeline
+	ProcessingService *ProcessingService
+	PrivacyService    *PrivacyService
+	StorageService    *StorageService
+	// contentHash adds the content hash of every message as it enters the downstream.
+	contentHash bool
+	mu          sync.Mutex
+	inputs      []chan []Message
+	open        int
+	running     bool
+	closed      bool
+}
+
+// Message is a document from a source. The fields the engine works with are
+// decoded into typed fields, the rest are kept in Extra and sent on as they
+// were received.
 type Message struct {
 	ID           string   `json:"id"`
 	Source       string   `json:"source"`
 	Title        string   `json:"title"`
 	CreationDate string   `json:"creation_date"`
-	Message      string   `json:"string"`
+	Message      string   `json:"message"`
 	Tags         []string `json:"tags"`
 	Author       string   `json:"author"`
+	// SourceName is the name of the configured source the message was fetched from.
+	SourceName string `json:"source_name,omitempty"`
+	// Extra holds the fields of the document that are not modelled above.
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 func (m *Message) GetID() string {
@@ -62,14 +204,61 @@ type Payload interface {
 	GetID() string
 }
 
-func buildSourceConfig(cfg *Config) *SourceServiceConfig {
+func buildSourceConfig(sc *SourceConfig) *SourceServiceConfig {
 	return &SourceServiceConfig{
-		AuthToken:         cfg.SourceApi.AuthToken,
-		ClientTimeout:     cfg.SourceApi.ClientTimeout,
-		RateLimitDuration: (time.Duration(cfg.SourceApi.RateLimitDuration) * time.Second),
+		Name:              sc.Name,
+		AuthToken:         sc.AuthToken,
+		ClientTimeout:     sc.ClientTimeout,
+		RateLimitDuration: (time.Duration(sc.RateLimitDuration) * time.Second),
 		RetryWaitTime:     (500 * time.Millisecond),
-		RequestsLimit:     cfg.SourceApi.RateLimit,
-		URL:               cfg.SourceApi.URL,
+		RequestsLimit:     sc.RateLimit,
+		URL:               sc.URL,
+		PageSize:          sc.PageSize,
+		MinPollInterval:   sc.MinPollInterval,
+		MaxPollInterval:   sc.MaxPollInterval,
+		Pagination:        sc.Pagination,
+		Auth:              sc.Auth,
+		TLS:               sc.TLS,
+		Fields:            sc.Fields,
+		Schema:            sc.Schema,
+		CloudEvents:       sc.CloudEvents,
+		Codec:             sc.Codec,
+		MaxResponseSize:   sc.MaxResponseSize,
+	}
+}
+
+// buildSourceConfigs returns the configured sources, or the single unnamed
+// SourceApi source unless the engine only receives pushed messages.
+func buildSourceConfigs(cfg *Config) []SourceConfig {
+	if len(cfg.Sources) > 0 {
+		return cfg.Sources
+	}
+	if cfg.SourceApi.URL == "" && cfg.Webhook.Enabled {
+		return nil
+	}
+	return []SourceConfig{cfg.SourceApi}
+}
+
+func buildStreamConfig(sc *SourceConfig) *StreamSourceConfig {
+	path := sc.StreamPath
+	if path == "" {
+		path = defaultStreamPath
+	}
+	format := sc.StreamFormat
+	if format == "" {
+		format = StreamFormatSSE
+	}
+	return &StreamSourceConfig{
+		Name:              sc.Name,
+		URL:               sc.URL + path,
+		AuthToken:         sc.AuthToken,
+		Format:            format,
+		RateLimitDuration: (time.Duration(sc.RateLimitDuration) * time.Second),
+		RequestsLimit:     sc.RateLimit,
+		Auth:              sc.Auth,
+		TLS:               sc.TLS,
+		Fields:            sc.Fields,
+		CloudEvents:       sc.CloudEvents,
 	}
 }
 
@@ -78,6 +267,14 @@ func buildProcessingConfig(cfg *Config) *ProcessingServiceConfig {
 		ClientTimeout: cfg.ProcessingApi.Timeout,
 		URL:           cfg.ProcessingApi.URL,
 		WorkerCount:   cfg.ProcessingApi.WorkersCount,
+		Auth:          cfg.ProcessingApi.Auth,
+		Signing:       cfg.ProcessingApi.Signing,
+		TLS:           cfg.ProcessingApi.TLS,
+		CloudEvents:   cfg.ProcessingApi.CloudEvents,
+		Codec:         cfg.ProcessingApi.Codec,
+		Compression:   cfg.ProcessingApi.Compression,
+		Schema:        cfg.Validation.ProcessingSchema,
+		Ordering:      cfg.Ordering,
 	}
 }
 
@@ -86,62 +283,445 @@ func buildStorageConfig(cfg *Config) *StorageServiceConfig {
 		URL:           cfg.StorageApi.URL,
 		ClientTimeout: cfg.StorageApi.Timeout,
 		WorkerCount:   cfg.StorageApi.WorkersCount,
+		Auth:          cfg.StorageApi.Auth,
+		Signing:       cfg.StorageApi.Signing,
+		TLS:           cfg.StorageApi.TLS,
+		CloudEvents:   cfg.StorageApi.CloudEvents,
+		Codec:         cfg.StorageApi.Codec,
+		Compression:   cfg.StorageApi.Compression,
+		Integrity:     cfg.Integrity,
+		Ordering:      cfg.Ordering,
+	}
+}
+
+func buildDedupConfig(cfg *Config) *DedupServiceConfig {
+	return &DedupServiceConfig{
+		Backend:  cfg.Dedup.Backend,
+		Capacity: cfg.Dedup.Capacity,
+		Window:   cfg.Dedup.Window,
+		Path:     cfg.Dedup.Path,
+	}
+}
+
+func buildWebhookConfig(cfg *Config) *WebhookSourceConfig {
+	return &WebhookSourceConfig{
+		Name:        cfg.Webhook.Name,
+		Addr:        cfg.Webhook.Addr,
+		Path:        cfg.Webhook.Path,
+		Secret:      cfg.Webhook.Secret,
+		MaxPending:  cfg.Webhook.MaxPending,
+		SpoolPath:   cfg.Webhook.SpoolPath,
+		CloudEvents: cfg.Webhook.CloudEvents,
 	}
 }
 
-func buildRetryConfig(pClient *ProcessingClient, sClient *StorageClient, retries chan *Retry) *RetryConfig {
+func buildRetryConfig(retries chan *Retry) *RetryConfig {
 	return &RetryConfig{
-		ProcessingClient: pClient,
-		StorageClient:    sClient,
-		Retries:          retries,
+		Retries: retries,
 	}
 }
 
 func NewCollectionEngine(cfg *Config) *CollectionEngine {
-	sourceCfg := buildSourceConfig(cfg)
-	processingCfg := buildProcessingConfig(cfg)
-	storageCfg := buildStorageConfig(cfg)
+	// create retry queue to be passed to processing and storge services
+	retries := make(chan *Retry)
+
+	// shared by processing and storage clients, keys are scoped per stage
+	var ledger *AckLedger
+	var err error
+	if cfg.AckLedgerPath != "" {
+		ledger, err = NewAckLedger(cfg.AckLedgerPath, cfg.AckLedgerWindow)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	source, err := NewSourceService(sourceCfg)
+	// shared by every validating source and processing service
+	quarantine, err := NewQuarantine(cfg.Validation.QuarantinePath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	// create retry queue to be passed to processing and storge services
-	retries := make(chan *Retry)
+
+	// shared by every polling source and downstream, records are keyed by source name
+	if cfg.WAL.Path != "" && len(cfg.Stages) > 0 {
+		log.Fatal("WAL config: the write-ahead log only covers the processing and storage services, it cannot be used with stages")
+	}
+	if cfg.Privacy.isSet() && len(cfg.Stages) > 0 {
+		log.Fatal("Privacy config: the privacy rules are applied between the processing and storage services, they cannot be used with stages")
+	}
+	if cfg.WAL.Path != "" && cfg.Privacy.isSet() {
+		// fetched and processed messages are logged as received, before the privacy rules apply
+		log.Fatal("WAL config: the write-ahead log stores messages before the privacy rules are applied, it cannot be used with privacy")
+	}
+	wal, err := NewWAL(&cfg.WAL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := cfg.Ordering.validate(&cfg.Privacy); err != nil {
+		log.Fatal(err)
+	}
+
+	// shared by every polling source and downstream, messages are keyed by source name
+	var acks *AckTracker
+	if cfg.AckTracking {
+		acks = NewAckTracker()
+	}
+
+	var checkpoints *CheckpointStore
+	if cfg.CheckpointPath != "" {
+		checkpoints, err = NewCheckpointStore(cfg.CheckpointPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if acks == nil && wal == nil {
+			log.Printf("WARN: checkpointPath is set without ackTracking or the WAL, cursors and stream event IDs are checkpointed as soon as a page or event is fetched and the messages in flight when the engine stops are not fetched again")
+		}
+	}
+
+	retryCfg := buildRetryConfig(retries)
+	retryService, err := NewRetryService(retryCfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ce := &CollectionEngine{
+		Cfg:          *cfg,
+		RetryService: retryService,
+		Transport:    NewTransport(&cfg.Transport),
+		Quarantine:   quarantine,
+		WAL:          wal,
+		Acks:         acks,
+		routes:       make(map[string]*Downstream),
+	}
+
+	// sources that are not isolated share one downstream, created with the first of them
+	var shared *Downstream
+	var isolated []*Downstream
+	for _, sc := range buildSourceConfigs(cfg) {
+		sc := sc
+		if sc.Schema == "" {
+			sc.Schema = cfg.Validation.SourceSchema
+		}
+		var inputs []chan []Message
+		if sc.Mode == SourceModeStream {
+			streamCfg := buildStreamConfig(&sc)
+			streamCfg.Transport = ce.Transport
+			streamCfg.Checkpoint = checkpoints
+			streamCfg.WAL = wal
+			streamCfg.Acks = acks
+			stream, err := NewStreamSource(streamCfg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ce.Streams = append(ce.Streams, stream)
+			inputs = append(inputs, stream.Messages)
+		} else if sc.Partitions > 1 {
+			for _, partition := range newPartitionedSources(&sc, checkpoints, ce.Transport, quarantine, wal, acks) {
+				ce.Sources = append(ce.Sources, partition)
+				inputs = append(inputs, partition.Messages)
+			}
+		} else {
+			sourceCfg := buildSourceConfig(&sc)
+			sourceCfg.Checkpoint = checkpoints
+			sourceCfg.Transport = ce.Transport
+			sourceCfg.Quarantine = quarantine
+			sourceCfg.WAL = wal
+			sourceCfg.Acks = acks
+			source, err := NewSourceService(sourceCfg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ce.Sources = append(ce.Sources, source)
+			inputs = append(inputs, source.Messages)
+		}
+
+		var d *Downstream
+		if sc.Isolated {
+			d = newDownstream(cfg, sc.Name, retries, ledger, ce.Transport, quarantine, wal, acks)
+			isolated = append(isolated, d)
+		} else {
+			if shared == nil {
+				shared = newDownstream(cfg, "", retries, ledger, ce.Transport, quarantine, wal, acks)
+			}
+			d = shared
+		}
+		for _, input := range inputs {
+			d.Attach(input)
+		}
+		ce.routes[sc.Name] = d
+	}
+
+	// pushed messages feed the same downstream as the shared polling sources
+	if cfg.Webhook.Enabled {
+		ce.Webhook, err = NewWebhookSource(buildWebhookConfig(cfg))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if shared == nil {
+			shared = newDownstream(cfg, "", retries, ledger, ce.Transport, quarantine, wal, acks)
+		}
+		shared.Attach(ce.Webhook.Messages)
+	}
+
+	if shared != nil {
+		ce.Downstreams = append(ce.Downstreams, shared)
+	}
+	if cfg.AdminAddr != "" {
+		ce.Admin = NewAdminServer(cfg.AdminAddr, ce)
+	}
+	ce.Downstreams = append(ce.Downstreams, isolated...)
+
+	if len(ce.Sources) > 0 {
+		ce.SourceService = ce.Sources[0]
+	}
+	ce.DedupService = ce.Downstreams[0].DedupService
+	ce.Pipeline = ce.Downstreams[0].Pipeline
+	ce.ProcessingService = ce.Downstreams[0].ProcessingService
+	ce.PrivacyService = ce.Downstreams[0].PrivacyService
+	ce.StorageService = ce.Downstreams[0].StorageService
+
+	return ce
+}
+
+// newPartitionedSources returns a SourceService per partition of sc. They
+// share one rate limiter, so together they stay within the source's limit.
+func newPartitionedSources(sc *SourceConfig, checkpoints *CheckpointStore, transport *Transport, quarantine *Quarantine, wal *WAL, acks *AckTracker) []*SourceService {
+	limiter := NewRateLimiter(sc.RateLimit, time.Duration(sc.RateLimitDuration)*time.Second)
+	var partitions []*SourceService
+	for i := 0; i < sc.Partitions; i++ {
+		sourceCfg := buildSourceConfig(sc)
+		sourceCfg.Checkpoint = checkpoints
+		sourceCfg.Partition = strconv.Itoa(i)
+		sourceCfg.PartitionParam = sc.PartitionParam
+		sourceCfg.Limiter = limiter
+		sourceCfg.Transport = transport
+		sourceCfg.Quarantine = quarantine
+		sourceCfg.WAL = wal
+		sourceCfg.Acks = acks
+		source, err := NewSourceService(sourceCfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		partitions = append(partitions, source)
+	}
+	return partitions
+}
+
+// newDownstream builds the services fed by the inputs attached to it. name distinguishes the
+// downstreams of isolated sources and is blank for the shared one.
+func newDownstream(cfg *Config, name string, retries chan *Retry, ledger *AckLedger, transport *Transport, quarantine *Quarantine, wal *WAL, acks *AckTracker) *Downstream {
+	d := &Downstream{
+		Name:        name,
+		Messages:    make(chan []Message),
+		contentHash: cfg.Integrity.Enabled,
+	}
+	messages := d.Messages
+
+	// optionally drop duplicate messages between source and processing
+	if cfg.Dedup.Enabled {
+		dedupCfg := buildDedupConfig(cfg)
+		if name != "" && dedupCfg.Path != "" {
+			dedupCfg.Path = dedupCfg.Path + "." + name
+		}
+		dedupCfg.Input = messages
+		dedupCfg.WAL = wal
+		dedupCfg.Acks = acks
+		dedup, err := NewDedupService(dedupCfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		d.DedupService = dedup
+		messages = dedup.Messages
+	}
+
+	// configured stages replace the default processing -> storage pipeline
+	if len(cfg.Stages) > 0 {
+		pipeline, err := NewPipeline(&PipelineConfig{
+			Stages:    cfg.Stages,
+			Messages:  messages,
+			Retries:   retries,
+			Ledger:    ledger,
+			Transport: transport,
+			Acks:      acks,
+			Dedup:     d.DedupService,
+			Ordering:  cfg.Ordering,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		d.Pipeline = pipeline
+		return d
+	}
 
 	// attached upstream and downstream queues to processing service
-	processingCfg.Messages = source.Messages
+	processingCfg := buildProcessingConfig(cfg)
+	processingCfg.Messages = messages
 	processingCfg.Retries = retries
+	processingCfg.Ledger = ledger
+	processingCfg.Transport = transport
+	processingCfg.Quarantine = quarantine
+	processingCfg.WAL = wal
+	processingCfg.Acks = acks
+	processingCfg.Dedup = d.DedupService
 	processing, err := NewProcessingService(processingCfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	d.ProcessingService = processing
+	processed := processing.ProcessedMessages
+
+	// optionally mask, hash or encrypt fields between processing and storage
+	if cfg.Privacy.isSet() {
+		privacy, err := NewPrivacyService(&PrivacyServiceConfig{
+			Privacy: cfg.Privacy,
+			Input:   processed,
+			WAL:     wal,
+			Acks:    acks,
+			Dedup:   d.DedupService,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		d.PrivacyService = privacy
+		processed = privacy.ProcessedMessages
+	}
 
 	// attach upstream and downstream queues to storage service
-	storageCfg.ProcessedMessages = processing.ProcessedMessages
+	storageCfg := buildStorageConfig(cfg)
+	storageCfg.ProcessedMessages = processed
 	storageCfg.Retries = retries
+	storageCfg.Ledger = ledger
+	storageCfg.Transport = transport
+	storageCfg.WAL = wal
+	storageCfg.Acks = acks
+	storageCfg.Dedup = d.DedupService
 	storage, err := NewStorageService(storageCfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	d.StorageService = storage
 
-	retryCfg := buildRetryConfig(processing.Client, storage.Client, retries)
-	retryService, err := NewRetryService(retryCfg)
-	if err != nil {
-		log.Fatal(err)
+	return d
+}
+
+func (d *Downstream) Run() {
+	d.mu.Lock()
+	d.running = true
+	for _, input := range d.inputs {
+		go d.forward(input)
 	}
+	d.mu.Unlock()
 
-	return &CollectionEngine{
-		SourceService:     source,
-		ProcessingService: processing,
-		StorageService:    storage,
-		RetryService:      retryService,
+	if d.DedupService != nil {
+		go d.DedupService.Run()
+	}
+	if d.Pipeline != nil {
+		go d.Pipeline.Run()
+		return
+	}
+	go d.ProcessingService.Run()
+	if d.PrivacyService != nil {
+		go d.PrivacyService.Run()
+	}
+	go d.StorageService.Run()
+}
+
+// Attach adds input to the channels merged into Messages. Inputs can be
+// attached while the downstream runs, until every input has been closed.
+func (d *Downstream) Attach(input chan []Message) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return fmt.Errorf("downstream '%s' is closed, all of its sources have stopped", d.Name)
+	}
+	d.inputs = append(d.inputs, input)
+	d.open++
+	if d.running {
+		go d.forward(input)
+	}
+	return nil
+}
+
+// forward passes batches from input to Messages, closing Messages once the
+// last input is closed.
+func (d *Downstream) forward(input chan []Message) {
+	for batch := range input {
+		if d.contentHash {
+			if err := addContentHashes(batch); err != nil {
+				log.Printf("downstream '%s': %s", d.Name, err)
+			}
+		}
+		d.Messages <- batch
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.open--
+	if d.open == 0 {
+		d.closed = true
+		close(d.Messages)
 	}
 }
 
 func (ce *CollectionEngine) Run(cancel chan bool) {
-	go ce.ProcessingService.Run()
-	go ce.StorageService.Run()
+	for _, d := range ce.Downstreams {
+		d.Run()
+	}
 	go ce.RetryService.Run(cancel)
-	go ce.SourceService.Run(cancel)
+	// before the sources start, so replayed messages go out ahead of new ones
+	ce.replay()
+	if ce.Webhook != nil {
+		go ce.Webhook.Run(cancel)
+	}
+	if ce.Admin != nil {
+		go ce.Admin.Run(cancel)
+	}
+	for _, source := range ce.Sources {
+		go source.Run(cancel)
+	}
+	for _, stream := range ce.Streams {
+		go stream.Run(cancel)
+	}
+}
+
+// replay sends the messages the WAL held before a restart back into the
+// stage each was in: fetched messages to processing, past dedup, and
+// processed ones to storage. It returns once the services have taken them.
+func (ce *CollectionEngine) replay() {
+	msgs, processed, err := ce.WAL.Pending()
+	if err != nil {
+		log.Printf("error reading the WAL, not replaying it: %s", err)
+		return
+	}
+	if len(msgs)+len(processed) == 0 {
+		return
+	}
+	log.Printf("replaying %d messages for processing and %d for storage from the WAL", len(msgs), len(processed))
+
+	batches := make(map[*Downstream][]Message)
+	for _, msg := range msgs {
+		d := ce.route(msg.SourceName)
+		batches[d] = append(batches[d], msg)
+	}
+	for d, batch := range batches {
+		if d.contentHash {
+			if err := addContentHashes(batch); err != nil {
+				log.Printf("downstream '%s': %s", d.Name, err)
+			}
+		}
+		d.ProcessingService.WorkerPool.Jobs <- batch
+	}
+	for _, processedMsg := range processed {
+		ce.route(processedMsg.SourceName).ProcessingService.ProcessedMessages <- processedMsg
+	}
+}
+
+// route returns the downstream of the source called name, the shared one
+// for pushed messages and sources no longer configured.
+func (ce *CollectionEngine) route(name string) *Downstream {
+	if d, ok := ce.routes[name]; ok {
+		return d
+	}
+	return ce.Downstreams[0]
 }
@@ -2,6 +2,10 @@ package engine_test
 
 import (
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -100,6 +104,80 @@ func TestEngineRun(t *testing.T) {
 	})
 }
 
+func TestEngineMultipleSources(t *testing.T) {
+	sourceServer := func(count int) *httptest.Server {
+		resp, _ := json.Marshal(engine.MessageResponse{Results: test_utils.GenerateMockMessages(count)})
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write(resp)
+		}))
+	}
+	tenantA := sourceServer(1)
+	defer tenantA.Close()
+	tenantB := sourceServer(1)
+	defer tenantB.Close()
+	tenantC := sourceServer(1)
+	defer tenantC.Close()
+
+	var mu sync.Mutex
+	storedFrom := make(map[string]bool)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var pmsg engine.ProcessedMessage
+		json.NewDecoder(req.Body).Decode(&pmsg)
+		if strings.HasPrefix(req.URL.Path, "/storage") {
+			mu.Lock()
+			storedFrom[pmsg.SourceName] = true
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		json.NewEncoder(w).Encode(&pmsg)
+	}))
+	defer downstream.Close()
+
+	cfg := test_utils.BuildCollectionEngineConfig(2, 120, 5)
+	cfg.ProcessingApi.URL = downstream.URL + "/processing"
+	cfg.StorageApi.URL = downstream.URL + "/storage"
+	cfg.Sources = []engine.SourceConfig{
+		{Name: "tenant-a", URL: tenantA.URL, AuthToken: "a", ClientTimeout: (5 * time.Second), RateLimit: 120, RateLimitDuration: 5},
+		{Name: "tenant-b", URL: tenantB.URL, AuthToken: "b", ClientTimeout: (5 * time.Second), RateLimit: 120, RateLimitDuration: 5},
+		{Name: "tenant-c", URL: tenantC.URL, AuthToken: "c", ClientTimeout: (5 * time.Second), RateLimit: 120, RateLimitDuration: 5, Isolated: true},
+	}
+
+	ce := engine.NewCollectionEngine(cfg)
+	if len(ce.Sources) != 3 {
+		t.Fatalf("expected 3 sources, got %d", len(ce.Sources))
+	}
+	if len(ce.Downstreams) != 2 {
+		t.Fatalf("expected a shared and an isolated downstream, got %d", len(ce.Downstreams))
+	}
+	if ce.Downstreams[1].ProcessingService == ce.ProcessingService {
+		t.Error("isolated source should not share processing workers")
+	}
+
+	cancel := make(chan bool)
+	ce.Run(cancel)
+	defer close(cancel)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := len(storedFrom) == 3
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range []string{"tenant-a", "tenant-b", "tenant-c"} {
+		if !storedFrom[name] {
+			t.Errorf("expected messages tagged with source '%s' to be stored, got: %v", name, storedFrom)
+		}
+	}
+}
+
 func TestMessageStruct(t *testing.T) {
 	expected := `{
 		"id": "924c8cfbd9f94155985bf262cf2c3c67",
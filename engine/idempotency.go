@@ -0,0 +1,208 @@
+package engine
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotencyKey derives the key sent with a request from the message ID, the
+// stage it is sent to and a hash of the request body. The same payload sent to
+// the same stage always yields the same key, so retries reuse it.
+func IdempotencyKey(id, stage string, body []byte) string {
+	content := sha256.Sum256(body)
+	key := sha256.Sum256([]byte(id + "\n" + stage + "\n" + hex.EncodeToString(content[:])))
+	return hex.EncodeToString(key[:])
+}
+
+// ledgerCompactMin is the number of lines the ledger file grows to before it is first compacted.
+const ledgerCompactMin = 1024
+
+type ledgerEntry struct {
+	Key  string `json:"key"`
+	Body []byte `json:"body"`
+	// At is when the key was acknowledged, in Unix nanoseconds.
+	At int64 `json:"at,omitempty"`
+}
+
+type ledgerRecord struct {
+	body []byte
+	at   time.Time
+}
+
+// AckLedger is an append-only file of idempotency keys the downstream APIs
+// have acknowledged, along with the response body they returned. Clients
+// consult it before sending so an acknowledged request is never sent again.
+// Keys are forgotten once they are older than the window, and the file is
+// rewritten without them once it grows past twice the keys it held when it
+// was last rewritten.
+type AckLedger struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	window  time.Duration
+	entries map[string]ledgerRecord
+	// lines is the number of entries in the file, compactAt the number it is rewritten at.
+	lines     int
+	compactAt int
+	now       func() time.Time
+}
+
+// NewAckLedger opens the ledger at path, keeping keys for window, or for as
+// long as the file is kept when window is 0.
+func NewAckLedger(path string, window time.Duration) (*AckLedger, error) {
+	l := &AckLedger{
+		path:    path,
+		window:  window,
+		entries: make(map[string]ledgerRecord),
+		now:     time.Now,
+	}
+
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	if err := l.compact(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *AckLedger) load() error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening ack ledger '%s': %s", l.path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		var entry ledgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// a torn write from a crash, the request will simply be sent again
+			continue
+		}
+		// entries written before keys were timed are kept for a window from now
+		at := l.now()
+		if entry.At != 0 {
+			at = time.Unix(0, entry.At)
+		}
+		l.entries[entry.Key] = ledgerRecord{body: entry.Body, at: at}
+	}
+	return scanner.Err()
+}
+
+// expired reports whether r is outside the window. It must be called with mu
+// held or before the ledger is shared.
+func (l *AckLedger) expired(r ledgerRecord) bool {
+	return l.window > 0 && l.now().Sub(r.at) >= l.window
+}
+
+// compact drops the expired keys and rewrites the file with the others. It
+// must be called with mu held or before the ledger is shared.
+func (l *AckLedger) compact() error {
+	for key, r := range l.entries {
+		if l.expired(r) {
+			delete(l.entries, key)
+		}
+	}
+
+	tmp := l.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("error creating ack ledger '%s': %s", tmp, err)
+	}
+	w := bufio.NewWriter(f)
+	for key, r := range l.entries {
+		line, err := json.Marshal(ledgerEntry{Key: key, Body: r.body, At: r.at.UnixNano()})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing ack ledger '%s': %s", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return fmt.Errorf("error replacing ack ledger '%s': %s", l.path, err)
+	}
+
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file, err = os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening ack ledger '%s': %s", l.path, err)
+	}
+	l.lines = len(l.entries)
+	l.compactAt = 2 * l.lines
+	if l.compactAt < ledgerCompactMin {
+		l.compactAt = ledgerCompactMin
+	}
+	return nil
+}
+
+// Get returns the response body recorded for key and whether key was acknowledged within the window.
+func (l *AckLedger) Get(key string) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r, ok := l.entries[key]
+	if !ok || l.expired(r) {
+		return nil, false
+	}
+	return r.body, true
+}
+
+// Put records key as acknowledged with the response body the server returned.
+func (l *AckLedger) Put(key string, body []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if r, ok := l.entries[key]; ok && !l.expired(r) {
+		return nil
+	}
+
+	at := l.now()
+	line, err := json.Marshal(ledgerEntry{Key: key, Body: body, At: at.UnixNano()})
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing to ack ledger '%s': %s", l.path, err)
+	}
+	l.entries[key] = ledgerRecord{body: body, at: at}
+	l.lines++
+
+	if l.lines >= l.compactAt {
+		return l.compact()
+	}
+	return nil
+}
+
+// Len returns the number of keys held, expired ones included until the next compaction.
+func (l *AckLedger) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+func (l *AckLedger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
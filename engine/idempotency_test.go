@@ -0,0 +1,205 @@
+package engine_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	key := engine.IdempotencyKey("1", "storage", body)
+
+	if key != engine.IdempotencyKey("1", "storage", body) {
+		t.Error("key should be stable for the same message, stage and body")
+	}
+	if key == engine.IdempotencyKey("1", "processing", body) {
+		t.Error("key should differ between stages")
+	}
+	if key == engine.IdempotencyKey("1", "storage", []byte(`{"id":"1","title":"x"}`)) {
+		t.Error("key should differ when content changes")
+	}
+}
+
+func TestAckLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acks.log")
+	l, err := engine.NewAckLedger(path, time.Hour)
+	if err != nil {
+		t.Fatalf("should not return error opening a new ledger, err: %s", err)
+	}
+	if err := l.Put("key-1", []byte("response")); err != nil {
+		t.Errorf("should not return error recording a key, err: %s", err)
+	}
+	l.Close()
+
+	reopened, err := engine.NewAckLedger(path, time.Hour)
+	if err != nil {
+		t.Fatalf("should not return error reopening ledger, err: %s", err)
+	}
+	defer reopened.Close()
+
+	body, ok := reopened.Get("key-1")
+	if !ok {
+		t.Fatal("key recorded before reopening should be acknowledged")
+	}
+	if string(body) != "response" {
+		t.Errorf("expected recorded body to be 'response', got '%s'", string(body))
+	}
+	if _, ok := reopened.Get("key-2"); ok {
+		t.Error("unknown key should not be acknowledged")
+	}
+}
+
+func TestAckLedgerWindow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acks.log")
+	l, _ := engine.NewAckLedger(path, 50*time.Millisecond)
+	l.Put("old", []byte("response"))
+	time.Sleep(60 * time.Millisecond)
+	l.Put("new", []byte("response"))
+
+	if _, ok := l.Get("old"); ok {
+		t.Error("key older than the window should not be acknowledged")
+	}
+	if _, ok := l.Get("new"); !ok {
+		t.Error("key within the window should be acknowledged")
+	}
+	l.Close()
+
+	// reopening compacts the file, dropping the expired key from memory and disk
+	reopened, _ := engine.NewAckLedger(path, 50*time.Millisecond)
+	reopened.Close()
+	if reopened.Len() != 1 {
+		t.Errorf("expected only the key within the window to be kept, got %d", reopened.Len())
+	}
+	data, _ := os.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Errorf("expected the compacted file to hold 1 key, got %d", lines)
+	}
+}
+
+func TestAckLedgerCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acks.log")
+	l, _ := engine.NewAckLedger(path, 50*time.Millisecond)
+	defer l.Close()
+	for i := 0; i < 1000; i++ {
+		l.Put("old-"+strconv.Itoa(i), nil)
+	}
+	time.Sleep(60 * time.Millisecond)
+	// the file reaches its first compaction while the old keys have expired
+	for i := 0; i < 100; i++ {
+		l.Put("new-"+strconv.Itoa(i), nil)
+	}
+
+	if l.Len() >= 1000 {
+		t.Errorf("expected the expired keys to be dropped, got %d", l.Len())
+	}
+	data, _ := os.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines >= 1000 {
+		t.Errorf("expected the file to be rewritten without the expired keys, got %d lines", lines)
+	}
+}
+
+// keyRecorder returns a server answering with statusCode and the list of
+// Idempotency-Key headers it received.
+func keyRecorder(statusCode int, body string) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var keys []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		keys = append(keys, req.Header.Get(engine.IdempotencyKeyHeader))
+		mu.Unlock()
+		w.WriteHeader(statusCode)
+		w.Write([]byte(body))
+	}))
+	return ts, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), keys...)
+	}
+}
+
+func TestStorageIdempotency(t *testing.T) {
+	pmsg := engine.ProcessedMessage{
+		test_utils.GenerateMockMessages(1)[0],
+		time.Now().UTC().String(),
+	}
+
+	t.Run("retries should reuse the same key", func(t *testing.T) {
+		ss, _ := engine.NewStorageService(&scfg)
+		ts, keys := keyRecorder(500, "error")
+		defer ts.Close()
+		ss.SetUrl(ts.URL)
+
+		ss.Client.PostMessage(&pmsg)
+		ss.Client.PostMessage(&pmsg)
+
+		sent := keys()
+		if len(sent) != 2 {
+			t.Fatalf("expected 2 requests, got %d", len(sent))
+		}
+		if sent[0] == "" || sent[0] != sent[1] {
+			t.Errorf("expected the same non empty key on every attempt, got: %v", sent)
+		}
+	})
+
+	t.Run("acknowledged messages should not be sent again", func(t *testing.T) {
+		ledger, _ := engine.NewAckLedger(filepath.Join(t.TempDir(), "acks.log"), time.Hour)
+		defer ledger.Close()
+		cfgCopy := scfg
+		cfgCopy.Ledger = ledger
+		ss, _ := engine.NewStorageService(&cfgCopy)
+		ts, keys := keyRecorder(201, "created")
+		defer ts.Close()
+		ss.SetUrl(ts.URL)
+
+		if err := ss.Client.PostMessage(&pmsg); err != nil {
+			t.Fatalf("should not return error on successful post, err: %s", err)
+		}
+		if err := ss.Client.PostMessage(&pmsg); err != nil {
+			t.Errorf("should not return error for an acknowledged message, err: %s", err)
+		}
+
+		if len(keys()) != 1 {
+			t.Errorf("expected only 1 request to be sent, got %d", len(keys()))
+		}
+	})
+}
+
+func TestProcessingIdempotency(t *testing.T) {
+	msg := test_utils.GenerateMockMessages(1)[0]
+
+	ledger, _ := engine.NewAckLedger(filepath.Join(t.TempDir(), "acks.log"), time.Hour)
+	defer ledger.Close()
+	cfgCopy := pcfg
+	cfgCopy.Ledger = ledger
+	ps, _ := engine.NewProcessingService(&cfgCopy)
+
+	recorder, keys := keyRecorder(200, `{"id":"`+msg.ID+`","processing_date":"2030-08-24T17:16:52.228009"}`)
+	defer recorder.Close()
+	ps.SetUrl(recorder.URL)
+
+	first, err := ps.Client.PostMessage(&msg)
+	if err != nil {
+		t.Fatalf("should not return error on successful post, err: %s", err)
+	}
+	second, err := ps.Client.PostMessage(&msg)
+	if err != nil {
+		t.Fatalf("should not return error for an acknowledged message, err: %s", err)
+	}
+
+	if len(keys()) != 1 {
+		t.Errorf("expected only 1 request to be sent, got %d", len(keys()))
+	}
+	if first.ProcessingDate != second.ProcessingDate {
+		t.Errorf("expected recorded response to be returned, got: %+v", second)
+	}
+}
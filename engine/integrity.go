@@ -0,0 +1,207 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	// ContentHashField is the unmodelled field a message's content hash is carried in.
+	ContentHashField = "content_hash"
+	// RecordSignatureField is the unmodelled field the storage signature of a record is sent in.
+	RecordSignatureField = "signature"
+
+	contentHashPrefix = "sha256:"
+)
+
+// IntegrityConfig proves a stored record is what the source emitted and the
+// processing API returned.
+type IntegrityConfig struct {
+	// Enabled adds the content hash of every ingested message to it.
+	Enabled bool `yaml:"enabled"`
+	// SigningKeyPath is a PEM Ed25519 private key, storage signs every record with it when set.
+	SigningKeyPath string `yaml:"signingKeyPath"`
+}
+
+// canonicalJSON returns doc with its object keys sorted and its whitespace
+// removed at every level, so equal documents encode to the same bytes.
+func canonicalJSON(doc []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// recordJSON returns the canonical document of msg without the fields in omit.
+func recordJSON(msg Payload, omit ...string) ([]byte, error) {
+	doc, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return nil, err
+	}
+	for _, key := range omit {
+		delete(fields, key)
+	}
+	doc, err = json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalJSON(doc)
+}
+
+// setExtra sets an unmodelled field of m on a copy of its Extra, which may
+// be shared with the message m was built from.
+func (m *Message) setExtra(key string, val json.RawMessage) {
+	extra := make(map[string]json.RawMessage, len(m.Extra)+1)
+	for k, v := range m.Extra {
+		extra[k] = v
+	}
+	extra[key] = val
+	m.Extra = extra
+}
+
+// ContentHash returns the SHA-256 of the canonical document of m as
+// ingested, without the source name the engine adds or a content hash.
+func ContentHash(m *Message) (string, error) {
+	doc, err := recordJSON(m, "source_name", ContentHashField, RecordSignatureField)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(doc)
+	return contentHashPrefix + hex.EncodeToString(sum[:]), nil
+}
+
+// addContentHashes sets the content hash field of every message of batch.
+func addContentHashes(batch []Message) error {
+	for i := range batch {
+		hash, err := ContentHash(&batch[i])
+		if err != nil {
+			return fmt.Errorf("error hashing messageID='%s': %s", batch[i].ID, err)
+		}
+		val, _ := json.Marshal(hash)
+		batch[i].setExtra(ContentHashField, val)
+	}
+	return nil
+}
+
+// RecordSigner signs the records sent to storage with an Ed25519 key.
+type RecordSigner struct {
+	key ed25519.PrivateKey
+}
+
+// NewRecordSigner returns the signer of cfg, nil when no signing key is set.
+func NewRecordSigner(cfg *IntegrityConfig) (*RecordSigner, error) {
+	if cfg.SigningKeyPath == "" {
+		return nil, nil
+	}
+	if !cfg.Enabled {
+		return nil, fmt.Errorf("Integrity config: Enabled must be set to sign records, they are signed along with their content hash")
+	}
+	block, err := readPEM(cfg.SigningKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Integrity config: %s", err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Integrity config: error parsing signing key '%s': %s", cfg.SigningKeyPath, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Integrity config: signing key '%s' is a %T, not an Ed25519 key", cfg.SigningKeyPath, key)
+	}
+	return &RecordSigner{key: edKey}, nil
+}
+
+// Sign sets the signature field of msg to the base64 Ed25519 signature of
+// its canonical document without the field. Signatures are deterministic,
+// so a retried record is sent with the same body.
+func (s *RecordSigner) Sign(msg Payload) error {
+	m := payloadMessage(msg)
+	if m == nil {
+		return fmt.Errorf("cannot sign payload of type %T", msg)
+	}
+	doc, err := recordJSON(msg, RecordSignatureField)
+	if err != nil {
+		return err
+	}
+	val, _ := json.Marshal(base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, doc)))
+	m.setExtra(RecordSignatureField, val)
+	return nil
+}
+
+// LoadVerifyKey reads a PEM Ed25519 public key.
+func LoadVerifyKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing public key '%s': %s", path, err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key '%s' is a %T, not an Ed25519 key", path, key)
+	}
+	return edKey, nil
+}
+
+// VerifyRecord checks the signature of doc, a stored record, against key.
+func VerifyRecord(key ed25519.PublicKey, doc []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return err
+	}
+	var signature string
+	if err := json.Unmarshal(fields[RecordSignatureField], &signature); err != nil || signature == "" {
+		return errors.New("record is not signed")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature is not base64: %s", err)
+	}
+	if _, ok := fields[ContentHashField]; !ok {
+		return errors.New("record has no content hash")
+	}
+
+	delete(fields, RecordSignatureField)
+	unsigned, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	unsigned, err = canonicalJSON(unsigned)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, unsigned, sig) {
+		return errors.New("signature does not match the record")
+	}
+	return nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key '%s': %s", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key '%s' is not PEM encoded", path)
+	}
+	return block, nil
+}
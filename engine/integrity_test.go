@@ -0,0 +1,151 @@
+package engine_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+// writeEd25519Keys writes a PEM key pair and returns the private and public key paths.
+func writeEd25519Keys(t *testing.T) (string, string) {
+	t.Helper()
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	dir := t.TempDir()
+	privDER, _ := x509.MarshalPKCS8PrivateKey(priv)
+	pubDER, _ := x509.MarshalPKIXPublicKey(pub)
+	privPath := filepath.Join(dir, "signing.pem")
+	pubPath := filepath.Join(dir, "signing.pub.pem")
+	os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600)
+	os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644)
+	return privPath, pubPath
+}
+
+func TestEngineSignsRecords(t *testing.T) {
+	var msg engine.Message
+	json.Unmarshal([]byte(extendedMessage), &msg)
+	wantHash, _ := engine.ContentHash(&msg)
+
+	resp, _ := json.Marshal(engine.MessageResponse{Results: []engine.Message{msg}})
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(resp)
+	}))
+	defer source.Close()
+
+	var mu sync.Mutex
+	var stored []byte
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if strings.HasPrefix(req.URL.Path, "/storage") {
+			mu.Lock()
+			stored = body
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		// answer with the modelled fields and a content hash of its own, the engine's is carried over
+		var pmsg engine.ProcessedMessage
+		json.Unmarshal(body, &pmsg)
+		pmsg.Extra = map[string]json.RawMessage{engine.ContentHashField: json.RawMessage(`"sha256:forged"`)}
+		pmsg.ProcessingDate = "2030-08-24T17:20:00Z"
+		json.NewEncoder(w).Encode(&pmsg)
+	}))
+	defer downstream.Close()
+
+	privPath, pubPath := writeEd25519Keys(t)
+	cfg := test_utils.BuildCollectionEngineConfig(1, 120, 5)
+	cfg.ProcessingApi.URL = downstream.URL + "/processing"
+	cfg.StorageApi.URL = downstream.URL + "/storage"
+	cfg.Sources = []engine.SourceConfig{
+		{Name: "tenant-a", URL: source.URL, AuthToken: "a", ClientTimeout: (5 * time.Second), RateLimit: 120, RateLimitDuration: 5},
+	}
+	cfg.Integrity = engine.IntegrityConfig{Enabled: true, SigningKeyPath: privPath}
+
+	ce := engine.NewCollectionEngine(cfg)
+	cancel := make(chan bool)
+	ce.Run(cancel)
+	defer close(cancel)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := stored != nil
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if stored == nil {
+		t.Fatal("expected the record to be stored")
+	}
+	var record engine.ProcessedMessage
+	json.Unmarshal(stored, &record)
+	if string(record.Extra[engine.ContentHashField]) != `"`+wantHash+`"` {
+		t.Errorf("expected the content hash of the source message %s, got %s", wantHash, record.Extra[engine.ContentHashField])
+	}
+
+	key, err := engine.LoadVerifyKey(pubPath)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+	if err := engine.VerifyRecord(key, stored); err != nil {
+		t.Errorf("expected the stored record to verify, err: %s", err)
+	}
+	tampered := bytes.Replace(stored, []byte("2030-08-24T17:20:00Z"), []byte("2030-08-25T17:20:00Z"), 1)
+	if err := engine.VerifyRecord(key, tampered); err == nil {
+		t.Error("expected a modified record not to verify")
+	}
+}
+
+func TestContentHashIgnoresFormatting(t *testing.T) {
+	var a, b engine.Message
+	json.Unmarshal([]byte(`{"id": "1", "message": "hi", "meta": {"b": 2, "a": 1}}`), &a)
+	json.Unmarshal([]byte(`{"meta":{"a":1,"b":2},"message":"hi","id":"1","source_name":"tenant-a"}`), &b)
+	hashA, _ := engine.ContentHash(&a)
+	hashB, _ := engine.ContentHash(&b)
+	if hashA != hashB || !strings.HasPrefix(hashA, "sha256:") {
+		t.Errorf("expected equal documents to hash the same, got %s and %s", hashA, hashB)
+	}
+
+	b.Message = "bye"
+	if hashC, _ := engine.ContentHash(&b); hashC == hashA {
+		t.Error("expected a different message to hash differently")
+	}
+}
+
+func TestNewRecordSignerBadConfig(t *testing.T) {
+	privPath, pubPath := writeEd25519Keys(t)
+	tests := map[string]engine.IntegrityConfig{
+		"not enabled":   {SigningKeyPath: privPath},
+		"public key":    {Enabled: true, SigningKeyPath: pubPath},
+		"missing file":  {Enabled: true, SigningKeyPath: filepath.Join(t.TempDir(), "none.pem")},
+		"not a pem key": {Enabled: true, SigningKeyPath: writeKeyring(t, "k1", "k1")},
+	}
+	for name, cfg := range tests {
+		cfg := cfg
+		if _, err := engine.NewRecordSigner(&cfg); err == nil {
+			t.Errorf("Test - %s: expected an error", name)
+		}
+	}
+
+	if signer, err := engine.NewRecordSigner(&engine.IntegrityConfig{Enabled: true}); signer != nil || err != nil {
+		t.Errorf("expected no signer without a signing key, got %v, err: %v", signer, err)
+	}
+}
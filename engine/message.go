@@ -0,0 +1,213 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// messageKeys are the JSON keys of the fields Message models, everything
+// else in a document is kept in Extra.
+var messageKeys = []string{"id", "source", "title", "creation_date", "message", "tags", "author", "source_name"}
+
+// legacyMessageKey is the key the message body was sent under before it was
+// renamed "message". It is still read when "message" is absent.
+const legacyMessageKey = "string"
+
+// timestampLayouts are tried in order by Message.Timestamp.
+var timestampLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02 15:04:05.999999999"}
+
+// UnmarshalJSON decodes the modelled fields of a message document and keeps
+// the rest in Extra.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type plain Message
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if legacy, ok := fields[legacyMessageKey]; ok {
+		if _, ok := fields["message"]; !ok {
+			if err := json.Unmarshal(legacy, &p.Message); err != nil {
+				return err
+			}
+		}
+		delete(fields, legacyMessageKey)
+	}
+	for _, key := range messageKeys {
+		delete(fields, key)
+	}
+
+	p.Extra = nil
+	if len(fields) > 0 {
+		p.Extra = fields
+	}
+	*m = Message(p)
+	return nil
+}
+
+// MarshalJSON encodes the modelled fields along with the unmodelled ones in
+// Extra, which are passed on unchanged.
+func (m Message) MarshalJSON() ([]byte, error) {
+	type plain Message
+	known, err := json.Marshal(plain(m))
+	if err != nil || len(m.Extra) == 0 {
+		return known, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(known, &fields); err != nil {
+		return nil, err
+	}
+	for key, val := range m.Extra {
+		if _, ok := fields[key]; !ok {
+			fields[key] = val
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// Field returns the raw value at a dotted path of the message document, such
+// as "meta.region", and whether it is present.
+func (m *Message) Field(path string) (json.RawMessage, bool) {
+	doc, err := json.Marshal(m)
+	if err != nil {
+		return nil, false
+	}
+	val, err := lookupField(doc, path)
+	if err != nil || val == nil {
+		return nil, false
+	}
+	return val, true
+}
+
+// Timestamp parses CreationDate.
+func (m *Message) Timestamp() (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, m.CreationDate); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("could not parse creation_date '%s' of messageID='%s'", m.CreationDate, m.ID)
+}
+
+// inherit copies the unmodelled fields of from that m does not have, so
+// they survive APIs that answer with only the modelled fields. The ID and
+// source name are always copied, the WAL and ack tracker key the message by
+// them whatever the API answered, and so is the content hash, which vouches
+// for the message as ingested rather than for what the API sent back.
+func (m *Message) inherit(from *Message) {
+	m.ID, m.SourceName = from.ID, from.SourceName
+	for key, val := range from.Extra {
+		if _, ok := m.Extra[key]; ok && key != ContentHashField {
+			continue
+		}
+		if m.Extra == nil {
+			m.Extra = make(map[string]json.RawMessage)
+		}
+		m.Extra[key] = val
+	}
+}
+
+// payloadMessage returns the message of a payload, nil for other payloads.
+func payloadMessage(p Payload) *Message {
+	switch m := p.(type) {
+	case *Message:
+		return m
+	case *ProcessedMessage:
+		return &m.Message
+	}
+	return nil
+}
+
+// UnmarshalJSON decodes a processed message, the message fields and its processing date.
+func (p *ProcessedMessage) UnmarshalJSON(data []byte) error {
+	if err := p.Message.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	p.ProcessingDate = ""
+	if raw, ok := p.Extra["processing_date"]; ok {
+		if err := json.Unmarshal(raw, &p.ProcessingDate); err != nil {
+			return err
+		}
+		delete(p.Extra, "processing_date")
+		if len(p.Extra) == 0 {
+			p.Extra = nil
+		}
+	}
+	return nil
+}
+
+// MarshalJSON encodes the message fields, unmodelled ones included, and the processing date.
+func (p ProcessedMessage) MarshalJSON() ([]byte, error) {
+	date, err := json.Marshal(p.ProcessingDate)
+	if err != nil {
+		return nil, err
+	}
+	msg := p.Message
+	msg.Extra = map[string]json.RawMessage{"processing_date": date}
+	for key, val := range p.Extra {
+		if key != "processing_date" {
+			msg.Extra[key] = val
+		}
+	}
+	return msg.MarshalJSON()
+}
+
+// FieldMapping names the dotted JSON paths of a source's documents that hold
+// the message ID and timestamp, for sources that do not send them as "id"
+// and "creation_date". The fields stay in the document as they were.
+type FieldMapping struct {
+	ID        string `yaml:"id"`
+	Timestamp string `yaml:"timestamp"`
+}
+
+// apply sets the ID and CreationDate of msgs from the mapped paths, in
+// place, and returns the messages it could map. A string or number at a path is used as
+// text and messages without one are left as they are. Messages with anything
+// else at a path are put in q for source and dropped, so they do not hold
+// back the rest of their page.
+func (fm *FieldMapping) apply(msgs []Message, q *Quarantine, source string) []Message {
+	if fm.ID == "" && fm.Timestamp == "" {
+		return msgs
+	}
+	mapped := make([]Message, 0, len(msgs))
+	for i := range msgs {
+		if err := fm.mapMessage(&msgs[i]); err != nil {
+			doc, _ := msgs[i].MarshalJSON()
+			q.Put(QuarantineEntry{Stage: "source", Source: source, ID: msgs[i].ID, Errors: []string{err.Error()}, Document: doc})
+			continue
+		}
+		mapped = append(mapped, msgs[i])
+	}
+	return mapped
+}
+
+// mapMessage sets the ID and CreationDate of msg from the mapped paths.
+func (fm *FieldMapping) mapMessage(msg *Message) error {
+	for _, mapping := range []struct {
+		path string
+		dest *string
+	}{
+		{fm.ID, &msg.ID},
+		{fm.Timestamp, &msg.CreationDate},
+	} {
+		if mapping.path == "" {
+			continue
+		}
+		raw, ok := msg.Field(mapping.path)
+		if !ok {
+			continue
+		}
+		val, err := cursorString(raw)
+		if err != nil {
+			return fmt.Errorf("field '%s' must be a string or number, got: %s", mapping.path, raw)
+		}
+		*mapping.dest = val
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/google/go-cmp/cmp"
+)
+
+const extendedMessage = `{
+	"id": "924c8cfbd9f94155985bf262cf2c3c67",
+	"source": "MessagingSystem",
+	"title": "Where are my pants?",
+	"creation_date": "2030-08-24T17:16:52.228009",
+	"message": "Erlang is known...",
+	"tags": ["no", "collection"],
+	"author": "Dominic Mccormick",
+	"priority": 3,
+	"meta": {"region": "eu-west-1", "thread": {"id": "t-42"}}
+}`
+
+// jsonEqual compares two documents ignoring key order and whitespace.
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatalf("invalid json %s: %s", a, err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatalf("invalid json %s: %s", b, err)
+	}
+	return cmp.Equal(va, vb)
+}
+
+func TestMessageUnmodelledFields(t *testing.T) {
+	var msg engine.Message
+	if err := json.Unmarshal([]byte(extendedMessage), &msg); err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	if msg.ID != "924c8cfbd9f94155985bf262cf2c3c67" || msg.Message != "Erlang is known..." || len(msg.Tags) != 2 {
+		t.Errorf("expected the modelled fields to be decoded, got %+v", msg)
+	}
+	if len(msg.Extra) != 2 || string(msg.Extra["priority"]) != "3" {
+		t.Errorf("expected priority and meta to be kept in Extra, got %v", msg.Extra)
+	}
+	if region, ok := msg.Field("meta.region"); !ok || string(region) != `"eu-west-1"` {
+		t.Errorf("expected meta.region to be found, got %s", region)
+	}
+	if _, ok := msg.Field("meta.missing"); ok {
+		t.Error("expected a missing path not to be found")
+	}
+
+	body, err := json.Marshal(&msg)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+	if !jsonEqual(t, body, []byte(extendedMessage)) {
+		t.Errorf("expected the document to round trip unchanged, got %s", body)
+	}
+
+	ts, err := msg.Timestamp()
+	if err != nil || !ts.Equal(time.Date(2030, 8, 24, 17, 16, 52, 228009000, time.UTC)) {
+		t.Errorf("expected the creation date to parse, got %v, err: %v", ts, err)
+	}
+}
+
+func TestMessageLegacyBodyKey(t *testing.T) {
+	var msg engine.Message
+	json.Unmarshal([]byte(`{"id": "1", "string": "old body"}`), &msg)
+	if msg.Message != "old body" || msg.Extra != nil {
+		t.Errorf("expected the legacy key to be read into Message, got %+v", msg)
+	}
+
+	body, _ := json.Marshal(&msg)
+	if !jsonEqual(t, body, []byte(`{"id": "1", "source": "", "title": "", "creation_date": "", "message": "old body", "tags": null, "author": ""}`)) {
+		t.Errorf("expected the body to be sent as message, got %s", body)
+	}
+}
+
+func TestProcessedMessageUnmodelledFields(t *testing.T) {
+	var msg engine.Message
+	json.Unmarshal([]byte(extendedMessage), &msg)
+
+	// the processing API answers with the modelled fields only, storage
+	// receives messages that already have a processing date
+	var stored []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		var processed engine.ProcessedMessage
+		json.Unmarshal(body, &processed)
+		if processed.ProcessingDate == "" {
+			processed.ProcessingDate = "2030-08-24T17:20:00Z"
+			writeJSON(w, map[string]interface{}{
+				"id": processed.ID, "source": processed.Source, "title": processed.Title, "creation_date": processed.CreationDate,
+				"message": processed.Message.Message, "tags": processed.Tags, "author": processed.Author, "processing_date": processed.ProcessingDate,
+			})
+			return
+		}
+		stored = body
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	cfg := pcfg
+	cfg.URL = ts.URL
+	ps, _ := engine.NewProcessingService(&cfg)
+	processed, err := ps.Client.PostMessage(&msg)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+	if processed.ProcessingDate != "2030-08-24T17:20:00Z" || len(processed.Extra) != 2 {
+		t.Errorf("expected the processing date and the unmodelled fields of the sent message, got %+v", processed)
+	}
+
+	storageCfg := scfg
+	storageCfg.URL = ts.URL
+	ss, _ := engine.NewStorageService(&storageCfg)
+	if err := ss.Client.PostMessage(processed); err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	var expected map[string]interface{}
+	json.Unmarshal([]byte(extendedMessage), &expected)
+	expected["processing_date"] = "2030-08-24T17:20:00Z"
+	want, _ := json.Marshal(expected)
+	if !jsonEqual(t, stored, want) {
+		t.Errorf("expected the unmodelled fields to reach storage untouched, got %s", stored)
+	}
+}
+
+func TestSourceFieldMapping(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"results": [
+			{"uuid": "a-1", "meta": {"created": "2030-01-01T00:00:00Z"}, "body": "first"},
+			{"uuid": 2, "meta": {"created": "2030-01-02T00:00:00Z"}, "body": "second"}
+		], "cursor": null}`))
+	}))
+	defer ts.Close()
+
+	ss, err := engine.NewSourceService(&engine.SourceServiceConfig{
+		URL:               ts.URL,
+		AuthToken:         "test",
+		ClientTimeout:     time.Second,
+		RateLimitDuration: time.Minute,
+		RequestsLimit:     10,
+		Fields:            engine.FieldMapping{ID: "uuid", Timestamp: "meta.created"},
+	})
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	msgs := ss.HandleGetMessages()
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	if msgs[0].ID != "a-1" || msgs[1].ID != "2" || msgs[1].CreationDate != "2030-01-02T00:00:00Z" {
+		t.Errorf("expected the ID and timestamp to be mapped, got %+v", msgs)
+	}
+	if string(msgs[0].Extra["body"]) != `"first"` || msgs[0].Extra["uuid"] == nil {
+		t.Errorf("expected the mapped document to be kept, got %v", msgs[0].Extra)
+	}
+}
+
+func TestSourceFieldMappingQuarantinesBadMessages(t *testing.T) {
+	var offsets []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		offsets = append(offsets, req.URL.Query().Get("offset"))
+		w.Write([]byte(`{"results": [
+			{"uuid": {"not": "an id"}, "body": "first"},
+			{"uuid": "b-2", "body": "second"}
+		]}`))
+	}))
+	defer ts.Close()
+
+	quarantine, _ := engine.NewQuarantine("")
+	ss, err := engine.NewSourceService(&engine.SourceServiceConfig{
+		Name:              "tenant-a",
+		URL:               ts.URL,
+		AuthToken:         "test",
+		ClientTimeout:     time.Second,
+		RateLimitDuration: time.Minute,
+		RequestsLimit:     10,
+		Pagination:        engine.PaginationConfig{Strategy: engine.PaginationOffset},
+		Fields:            engine.FieldMapping{ID: "uuid"},
+		Quarantine:        quarantine,
+	})
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	msgs := ss.HandleGetMessages()
+	if len(msgs) != 1 || msgs[0].ID != "b-2" {
+		t.Errorf("expected only the message that could be mapped, got %+v", msgs)
+	}
+	if quarantine.Count() != 1 {
+		t.Errorf("expected the message that could not be mapped to be quarantined, got %d", quarantine.Count())
+	}
+
+	// the source moves past the whole page rather than fetching the bad message again
+	ss.HandleGetMessages()
+	if len(offsets) != 2 || offsets[1] != "2" {
+		t.Errorf("expected the next page to start after both messages, got offsets %v", offsets)
+	}
+}
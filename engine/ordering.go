@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// OrderingConfig keeps the messages that share a key in order through
+// processing and storage. Every message is handed to the worker its key
+// hashes to, and failed messages are retried on that worker before it takes
+// the next one, so a message is never overtaken by a later one with the same
+// key. A retrying worker holds back every key that hashes to it.
+type OrderingConfig struct {
+	// Key is the field messages are partitioned on: a modelled field such as
+	// "author" or "source_name", or the key of an unmodelled one. Messages
+	// without it are spread by ID. Disabled when blank.
+	Key string `yaml:"key"`
+}
+
+func (cfg *OrderingConfig) isSet() bool {
+	return cfg != nil && cfg.Key != ""
+}
+
+func (cfg *OrderingConfig) validate(privacy *PrivacyConfig) error {
+	if !cfg.isSet() || privacy == nil {
+		return nil
+	}
+	for _, rule := range privacy.Fields {
+		if rule.Field == cfg.Key && rule.Action == PrivacyEncrypt {
+			return fmt.Errorf("Ordering config: key '%s' is encrypted by the privacy stage before storage, and every message encrypts to a different value", cfg.Key)
+		}
+	}
+	return nil
+}
+
+// key returns the ordering key of msg.
+func (cfg *OrderingConfig) key(msg Payload) string {
+	m := payloadMessage(msg)
+	if m == nil {
+		return msg.GetID()
+	}
+	var value string
+	switch cfg.Key {
+	case "id":
+		value = m.ID
+	case "source":
+		value = m.Source
+	case "title":
+		value = m.Title
+	case "creation_date":
+		value = m.CreationDate
+	case "author":
+		value = m.Author
+	case "source_name":
+		value = m.SourceName
+	default:
+		value = string(m.Extra[cfg.Key])
+	}
+	if value == "" {
+		return m.ID
+	}
+	return value
+}
+
+// partition returns the worker of count that key is handled by.
+func partition(key string, count int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(count))
+}
@@ -0,0 +1,135 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+func TestWorkerPoolDispatchOrdered(t *testing.T) {
+	jobs := make(chan int)
+	pool := engine.NewPool(4, jobs)
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	var mu sync.Mutex
+	last := make(map[string]int)
+	pool.DispatchOrdered(func(j int) string {
+		return strconv.Itoa(j % 5)
+	}, func(j int) {
+		// later jobs finish sooner, so unordered workers would overtake earlier ones
+		time.Sleep(time.Duration(100-j) * 10 * time.Microsecond)
+		mu.Lock()
+		defer mu.Unlock()
+		key := strconv.Itoa(j % 5)
+		if prev, ok := last[key]; ok && prev > j {
+			t.Errorf("expected job %d of key %s to be handled after job %d", j, key, prev)
+		}
+		last[key] = j
+	})
+
+	if len(last) != 5 {
+		t.Errorf("expected jobs of every key to be handled, got %v", last)
+	}
+}
+
+func TestEngineOrderedDelivery(t *testing.T) {
+	authors := []string{"ada", "grace", "linus"}
+	msgs := test_utils.GenerateMockMessages(30)
+	for i := range msgs {
+		msgs[i].Author = authors[i%len(authors)]
+	}
+	// one message a page, so the pages are processed by different workers at once
+	var pages int64
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		results := []engine.Message{}
+		if i := atomic.AddInt64(&pages, 1) - 1; i < int64(len(msgs)) {
+			results = msgs[i : i+1]
+		}
+		writeJSON(w, engine.MessageResponse{Results: results})
+	}))
+	defer source.Close()
+
+	var mu sync.Mutex
+	failed := false
+	stored := make(map[string][]string)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var pmsg engine.ProcessedMessage
+		json.NewDecoder(req.Body).Decode(&pmsg)
+		if !strings.HasPrefix(req.URL.Path, "/storage") && pmsg.ID == msgs[len(authors)].ID {
+			// a slow message is overtaken by the later ones of its author without ordering
+			time.Sleep(100 * time.Millisecond)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasPrefix(req.URL.Path, "/storage") {
+			stored[pmsg.Author] = append(stored[pmsg.Author], pmsg.ID)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		// the first message fails once, the ones after it must wait for its retry
+		if pmsg.ID == msgs[0].ID && !failed {
+			failed = true
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(&pmsg)
+	}))
+	defer downstream.Close()
+
+	cfg := test_utils.BuildCollectionEngineConfig(4, 120, 5)
+	cfg.ProcessingApi.URL = downstream.URL + "/processing"
+	cfg.StorageApi.URL = downstream.URL + "/storage"
+	cfg.Sources = []engine.SourceConfig{
+		{Name: "tenant-a", URL: source.URL, AuthToken: "a", ClientTimeout: (5 * time.Second), RateLimit: 120, RateLimitDuration: 5},
+	}
+	cfg.Ordering = engine.OrderingConfig{Key: "author"}
+
+	ce := engine.NewCollectionEngine(cfg)
+	cancel := make(chan bool)
+	ce.Run(cancel)
+	defer close(cancel)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := 0
+		for _, ids := range stored {
+			n += len(ids)
+		}
+		mu.Unlock()
+		if n == len(msgs) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, author := range authors {
+		var want []string
+		for j := i; j < len(msgs); j += len(authors) {
+			want = append(want, msgs[j].ID)
+		}
+		if strings.Join(stored[author], ",") != strings.Join(want, ",") {
+			t.Errorf("expected the messages of %s to be stored in order %v, got %v", author, want, stored[author])
+		}
+	}
+	if ce.ProcessingService.Metrics.Recovered() != 1 {
+		t.Errorf("expected the failed message to be recovered, got %d", ce.ProcessingService.Metrics.Recovered())
+	}
+}
@@ -0,0 +1,408 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PaginationPathCursor = "pathCursor"
+	PaginationQueryToken = "queryToken"
+	PaginationLinkHeader = "linkHeader"
+	PaginationOffset     = "offset"
+	PaginationSince      = "since"
+
+	defaultMessagesPath = "/messages"
+	defaultResultsField = "results"
+	defaultCursorField  = "cursor"
+)
+
+// PaginationConfig chooses how a source API is paged through and where the
+// results and cursor are found in its responses.
+type PaginationConfig struct {
+	// Strategy is one of the Pagination* constants, default pathCursor.
+	Strategy string `yaml:"strategy"`
+	// Path is appended to the source base url, default "/messages".
+	Path string `yaml:"path"`
+	// Param is the query parameter carrying the token, offset or timestamp.
+	Param string `yaml:"param"`
+	// Limit is the page size requested by the offset strategy.
+	Limit      int    `yaml:"limit"`
+	LimitParam string `yaml:"limitParam"`
+	// ResultsField and CursorField are dotted paths into the response body,
+	// "." for ResultsField when the body is the array of results itself.
+	ResultsField string `yaml:"resultsField"`
+	CursorField  string `yaml:"cursorField"`
+}
+
+// Page is one decoded response from a source API.
+type Page struct {
+	Results []Message
+	// Cursor is the raw value at the cursor field, nil when absent.
+	Cursor json.RawMessage
+	Header http.Header
+	// URL is the url the page was requested from.
+	URL string
+}
+
+// Paginator walks through the pages of a source API.
+type Paginator interface {
+	// Next returns the url of the next page under base.
+	Next(base string) (string, error)
+	// Advance moves past page once it was received.
+	Advance(page *Page) error
+	// Position returns where the paginator is, to be checkpointed. Blank at the start.
+	Position() string
+	// Seek restores a checkpointed Position.
+	Seek(position string) error
+}
+
+// NewPaginator returns the strategy chosen in cfg. cursor is the client's
+// integer cursor, which the pathCursor strategy reads and updates.
+func NewPaginator(cfg *PaginationConfig, cursor **int) (Paginator, error) {
+	switch cfg.Strategy {
+	case "", PaginationPathCursor:
+		return &pathCursorPaginator{cursor: cursor}, nil
+	case PaginationQueryToken:
+		return &queryTokenPaginator{param: paramOrDefault(cfg.Param, "cursor")}, nil
+	case PaginationLinkHeader:
+		return &linkHeaderPaginator{}, nil
+	case PaginationOffset:
+		if cfg.Limit < 0 {
+			return nil, fmt.Errorf("Pagination config: Limit cannot be negative. Limit: %v", cfg.Limit)
+		}
+		return &offsetPaginator{
+			param:      paramOrDefault(cfg.Param, "offset"),
+			limitParam: paramOrDefault(cfg.LimitParam, "limit"),
+			limit:      cfg.Limit,
+		}, nil
+	case PaginationSince:
+		return &sincePaginator{param: paramOrDefault(cfg.Param, "since")}, nil
+	}
+	return nil, fmt.Errorf("Pagination config: unknown strategy '%s'", cfg.Strategy)
+}
+
+func paramOrDefault(param, def string) string {
+	if param == "" {
+		return def
+	}
+	return param
+}
+
+func withQuery(base string, params map[string]string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("error parsing source url '%s': %s", base, err)
+	}
+	q := u.Query()
+	for k, v := range params {
+		q.Set(k, v)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// cursorString returns a string or number cursor as text, blank for null.
+func cursorString(raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	if raw[0] == '"' {
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return "", fmt.Errorf("cursor must be a string or number, got: %s", raw)
+	}
+	return n.String(), nil
+}
+
+// pathCursorPaginator appends an integer cursor as a path segment,
+// /messages/{cursor}. A null cursor starts over from the first page.
+type pathCursorPaginator struct {
+	cursor **int
+}
+
+func (p *pathCursorPaginator) Next(base string) (string, error) {
+	if *p.cursor == nil {
+		return base, nil
+	}
+	return base + "/" + fmt.Sprint(**p.cursor), nil
+}
+
+func (p *pathCursorPaginator) Advance(page *Page) error {
+	var cursor *int
+	if len(page.Cursor) > 0 {
+		if err := json.Unmarshal(page.Cursor, &cursor); err != nil {
+			return fmt.Errorf("cursor must be an integer, got: %s", page.Cursor)
+		}
+	}
+	*p.cursor = cursor
+	return nil
+}
+
+func (p *pathCursorPaginator) Position() string {
+	if *p.cursor == nil {
+		return ""
+	}
+	return strconv.Itoa(**p.cursor)
+}
+
+func (p *pathCursorPaginator) Seek(position string) error {
+	if position == "" {
+		*p.cursor = nil
+		return nil
+	}
+	cursor, err := strconv.Atoi(position)
+	if err != nil {
+		return fmt.Errorf("path cursor position must be an integer, got '%s'", position)
+	}
+	*p.cursor = &cursor
+	return nil
+}
+
+// queryTokenPaginator sends an opaque token in a query parameter. A page
+// without a token keeps the current one, so the last page is polled again
+// until the source hands out a new token.
+type queryTokenPaginator struct {
+	param string
+	token string
+}
+
+func (p *queryTokenPaginator) Next(base string) (string, error) {
+	if p.token == "" {
+		return base, nil
+	}
+	return withQuery(base, map[string]string{p.param: p.token})
+}
+
+func (p *queryTokenPaginator) Advance(page *Page) error {
+	token, err := cursorString(page.Cursor)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		p.token = token
+	}
+	return nil
+}
+
+func (p *queryTokenPaginator) Position() string { return p.token }
+
+func (p *queryTokenPaginator) Seek(position string) error {
+	p.token = position
+	return nil
+}
+
+// linkHeaderPaginator follows the rel="next" url of the Link response
+// header, polling the last page again when there is none.
+type linkHeaderPaginator struct {
+	next string
+}
+
+func (p *linkHeaderPaginator) Next(base string) (string, error) {
+	if p.next == "" {
+		return base, nil
+	}
+	return p.next, nil
+}
+
+func (p *linkHeaderPaginator) Advance(page *Page) error {
+	next := nextLink(page.Header.Values("Link"))
+	if next == "" {
+		p.next = page.URL
+		return nil
+	}
+	ref, err := url.Parse(next)
+	if err != nil {
+		return fmt.Errorf("error parsing Link next url '%s': %s", next, err)
+	}
+	current, err := url.Parse(page.URL)
+	if err != nil {
+		return fmt.Errorf("error parsing page url '%s': %s", page.URL, err)
+	}
+	p.next = current.ResolveReference(ref).String()
+	return nil
+}
+
+// nextLink returns the rel="next" target of Link header values.
+func nextLink(values []string) string {
+	for _, value := range values {
+		for _, link := range strings.Split(value, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				key, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(key, "rel") && strings.Trim(val, `"`) == "next" {
+					return strings.Trim(target, "<>")
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func (p *linkHeaderPaginator) Position() string { return p.next }
+
+func (p *linkHeaderPaginator) Seek(position string) error {
+	p.next = position
+	return nil
+}
+
+// offsetPaginator requests offset/limit pages, moving the offset by the
+// number of results received.
+type offsetPaginator struct {
+	param      string
+	limitParam string
+	limit      int
+	offset     int
+}
+
+func (p *offsetPaginator) Next(base string) (string, error) {
+	params := map[string]string{p.param: strconv.Itoa(p.offset)}
+	if p.limit > 0 {
+		params[p.limitParam] = strconv.Itoa(p.limit)
+	}
+	return withQuery(base, params)
+}
+
+func (p *offsetPaginator) Advance(page *Page) error {
+	p.offset += len(page.Results)
+	return nil
+}
+
+func (p *offsetPaginator) Position() string { return strconv.Itoa(p.offset) }
+
+func (p *offsetPaginator) Seek(position string) error {
+	if position == "" {
+		p.offset = 0
+		return nil
+	}
+	offset, err := strconv.Atoi(position)
+	if err != nil {
+		return fmt.Errorf("offset position must be an integer, got '%s'", position)
+	}
+	p.offset = offset
+	return nil
+}
+
+// sincePaginator requests messages created after a timestamp, taken from the
+// response cursor when there is one and otherwise from the newest
+// creation_date received.
+type sincePaginator struct {
+	param string
+	since string
+}
+
+func (p *sincePaginator) Next(base string) (string, error) {
+	if p.since == "" {
+		return base, nil
+	}
+	return withQuery(base, map[string]string{p.param: p.since})
+}
+
+func (p *sincePaginator) Advance(page *Page) error {
+	since, err := cursorString(page.Cursor)
+	if err != nil {
+		return err
+	}
+	if since != "" {
+		p.since = since
+		return nil
+	}
+	for _, msg := range page.Results {
+		if laterTimestamp(msg.CreationDate, p.since) {
+			p.since = msg.CreationDate
+		}
+	}
+	return nil
+}
+
+// laterTimestamp reports whether a is after b, comparing as RFC 3339 times
+// when both parse and as strings otherwise.
+func laterTimestamp(a, b string) bool {
+	if b == "" {
+		return a != ""
+	}
+	ta, errA := time.Parse(time.RFC3339Nano, a)
+	tb, errB := time.Parse(time.RFC3339Nano, b)
+	if errA == nil && errB == nil {
+		return ta.After(tb)
+	}
+	return a > b
+}
+
+func (p *sincePaginator) Position() string { return p.since }
+
+func (p *sincePaginator) Seek(position string) error {
+	p.since = position
+	return nil
+}
+
+// decodePage finds the results and cursor in body at the configured fields.
+// Results that are CloudEvents are replaced with their data when cloudEvents
+// is set. With a validator every result is checked on its own, and the
+// invalid ones are quarantined and left out of the page instead of failing it.
+func decodePage(body []byte, resultsField, cursorField string, cloudEvents bool, v *Validator) (*Page, error) {
+	page := &Page{}
+
+	results, err := lookupField(body, paramOrDefault(resultsField, defaultResultsField))
+	if err != nil {
+		return nil, err
+	}
+	if cloudEvents && len(results) > 0 {
+		if results, err = unwrapCloudEvents(results); err != nil {
+			return nil, err
+		}
+	}
+	if len(results) > 0 && string(results) != "null" {
+		if v == nil || v.Schema == nil {
+			if err := json.Unmarshal(results, &page.Results); err != nil {
+				return nil, err
+			}
+		} else if page.Results, err = v.decodeMessages(results); err != nil {
+			return nil, err
+		}
+	}
+
+	if resultsField == "." {
+		return page, nil
+	}
+	page.Cursor, err = lookupField(body, paramOrDefault(cursorField, defaultCursorField))
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// lookupField returns the raw value at a dotted path, nil if it is absent.
+func lookupField(body []byte, path string) (json.RawMessage, error) {
+	raw := json.RawMessage(body)
+	if path == "." {
+		return raw, nil
+	}
+	for _, key := range strings.Split(path, ".") {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		val, ok := obj[key]
+		if !ok {
+			return nil, nil
+		}
+		raw = val
+	}
+	return raw, nil
+}
@@ -0,0 +1,178 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	r, _ := json.Marshal(v)
+	w.Write(r)
+}
+
+func TestPaginationStrategies(t *testing.T) {
+	msgs := test_utils.GenerateMockMessages(4)
+	msgs[0].CreationDate = "2030-01-01T00:00:00Z"
+	msgs[1].CreationDate = "2030-01-02T00:00:00Z"
+
+	tests := map[string]struct {
+		pagination engine.PaginationConfig
+		pages      func(base string) []func(w http.ResponseWriter)
+		expected   []string
+	}{
+		"query token": {
+			pagination: engine.PaginationConfig{Strategy: engine.PaginationQueryToken, Param: "page_token"},
+			pages: func(base string) []func(w http.ResponseWriter) {
+				return []func(w http.ResponseWriter){
+					func(w http.ResponseWriter) {
+						writeJSON(w, map[string]interface{}{"results": msgs[:2], "cursor": "abc"})
+					},
+					func(w http.ResponseWriter) {
+						writeJSON(w, map[string]interface{}{"results": msgs[2:], "cursor": nil})
+					},
+					func(w http.ResponseWriter) { writeJSON(w, map[string]interface{}{"results": []engine.Message{}}) },
+				}
+			},
+			expected: []string{"/messages", "/messages?page_token=abc", "/messages?page_token=abc"},
+		},
+		"link header": {
+			pagination: engine.PaginationConfig{Strategy: engine.PaginationLinkHeader},
+			pages: func(base string) []func(w http.ResponseWriter) {
+				return []func(w http.ResponseWriter){
+					func(w http.ResponseWriter) {
+						w.Header().Set("Link", `</messages?after=2>; rel="next", </messages>; rel="first"`)
+						writeJSON(w, map[string]interface{}{"results": msgs[:2]})
+					},
+					func(w http.ResponseWriter) {
+						w.Header().Set("Link", fmt.Sprintf(`<%s/messages?after=4>; rel="next"`, base))
+						writeJSON(w, map[string]interface{}{"results": msgs[2:]})
+					},
+					func(w http.ResponseWriter) { writeJSON(w, map[string]interface{}{"results": []engine.Message{}}) },
+				}
+			},
+			expected: []string{"/messages", "/messages?after=2", "/messages?after=4"},
+		},
+		"offset": {
+			pagination: engine.PaginationConfig{Strategy: engine.PaginationOffset, Limit: 2},
+			pages: func(base string) []func(w http.ResponseWriter) {
+				return []func(w http.ResponseWriter){
+					func(w http.ResponseWriter) { writeJSON(w, map[string]interface{}{"results": msgs[:2]}) },
+					func(w http.ResponseWriter) { writeJSON(w, map[string]interface{}{"results": msgs[2:3]}) },
+					func(w http.ResponseWriter) { writeJSON(w, map[string]interface{}{"results": []engine.Message{}}) },
+				}
+			},
+			expected: []string{"/messages?limit=2&offset=0", "/messages?limit=2&offset=2", "/messages?limit=2&offset=3"},
+		},
+		"since": {
+			pagination: engine.PaginationConfig{Strategy: engine.PaginationSince},
+			pages: func(base string) []func(w http.ResponseWriter) {
+				return []func(w http.ResponseWriter){
+					func(w http.ResponseWriter) { writeJSON(w, map[string]interface{}{"results": msgs[:2]}) },
+					func(w http.ResponseWriter) {
+						writeJSON(w, map[string]interface{}{"results": []engine.Message{}, "cursor": "2030-01-03T00:00:00Z"})
+					},
+					func(w http.ResponseWriter) { writeJSON(w, map[string]interface{}{"results": []engine.Message{}}) },
+				}
+			},
+			expected: []string{"/messages", "/messages?since=2030-01-02T00%3A00%3A00Z", "/messages?since=2030-01-03T00%3A00%3A00Z"},
+		},
+		"field mapping": {
+			pagination: engine.PaginationConfig{
+				Strategy:     engine.PaginationQueryToken,
+				Path:         "/v2/events",
+				ResultsField: "data.items",
+				CursorField:  "meta.next",
+			},
+			pages: func(base string) []func(w http.ResponseWriter) {
+				return []func(w http.ResponseWriter){
+					func(w http.ResponseWriter) {
+						writeJSON(w, map[string]interface{}{
+							"data": map[string]interface{}{"items": msgs},
+							"meta": map[string]interface{}{"next": 7},
+						})
+					},
+					func(w http.ResponseWriter) { writeJSON(w, map[string]interface{}{"data": map[string]interface{}{}}) },
+				}
+			},
+			expected: []string{"/v2/events", "/v2/events?cursor=7"},
+		},
+	}
+
+	for name, test := range tests {
+		var requests []string
+		var ts *httptest.Server
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			requests = append(requests, req.URL.RequestURI())
+			pages := test.pages(ts.URL)
+			if len(requests) > len(pages) {
+				t.Errorf("Test - %s: unexpected request %s", name, req.URL.RequestURI())
+				return
+			}
+			pages[len(requests)-1](w)
+		}))
+
+		cfgCopy := cfg
+		cfgCopy.URL = ts.URL
+		cfgCopy.Pagination = test.pagination
+		source, err := engine.NewSourceService(&cfgCopy)
+		if err != nil {
+			t.Fatalf("Test - %s: should not return error with pagination config, err: %s", name, err)
+		}
+
+		fetched := 0
+		for range test.expected {
+			fetched += len(source.HandleGetMessages())
+		}
+		ts.Close()
+
+		if fetched == 0 {
+			t.Errorf("Test - %s: expected messages to be fetched", name)
+		}
+		if fmt.Sprint(requests) != fmt.Sprint(test.expected) {
+			t.Errorf("Test - %s: expected requests %v, got %v", name, test.expected, requests)
+		}
+	}
+}
+
+func TestPaginationCheckpoint(t *testing.T) {
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.URL.RequestURI())
+		writeJSON(w, map[string]interface{}{"results": test_utils.GenerateMockMessages(1), "cursor": "token-2"})
+	}))
+	defer ts.Close()
+
+	cfgCopy := cfg
+	cfgCopy.Name = "tokens"
+	cfgCopy.URL = ts.URL
+	cfgCopy.Pagination = engine.PaginationConfig{Strategy: engine.PaginationQueryToken}
+	cfgCopy.Checkpoint, _ = engine.NewCheckpointStore(filepath.Join(t.TempDir(), "checkpoints.json"))
+
+	source, _ := engine.NewSourceService(&cfgCopy)
+	source.HandleGetMessages()
+
+	restarted, _ := engine.NewSourceService(&cfgCopy)
+	restarted.HandleGetMessages()
+
+	expected := "/messages?cursor=token-2"
+	if len(requests) != 2 || requests[1] != expected {
+		t.Errorf("expected restarted source to resume with '%s', got requests %v", expected, requests)
+	}
+}
+
+func TestNewPaginator(t *testing.T) {
+	var cursor *int
+	if _, err := engine.NewPaginator(&engine.PaginationConfig{Strategy: "pages"}, &cursor); err == nil {
+		t.Error("expected an error for an unknown strategy")
+	}
+	if _, err := engine.NewPaginator(&engine.PaginationConfig{Strategy: engine.PaginationOffset, Limit: -1}, &cursor); err == nil {
+		t.Error("expected an error for a negative limit")
+	}
+}
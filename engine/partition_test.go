@@ -0,0 +1,101 @@
+package engine_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := engine.NewRateLimiter(3, (100 * time.Millisecond))
+
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if rl.Allow() {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("expected 3 requests to be allowed in the period, got %d", allowed)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if !rl.Allow() {
+		t.Error("expected the limit to reset after the period")
+	}
+
+	if !engine.NewRateLimiter(0, time.Second).Allow() {
+		t.Error("a limit of 0 should allow every request")
+	}
+}
+
+func TestPartitionedSources(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		requests = append(requests, req.URL.RequestURI())
+		mu.Unlock()
+		partition, _ := strconv.Atoi(req.URL.Query().Get("shard"))
+		next := 100 + partition
+		writeJSON(w, engine.MessageResponse{Results: test_utils.GenerateMockMessages(1), Cursor: &next})
+	}))
+	defer ts.Close()
+
+	cfg := test_utils.BuildCollectionEngineConfig(1, 3, 60)
+	cfg.SourceApi.URL = ts.URL
+	cfg.SourceApi.Partitions = 3
+	cfg.SourceApi.PartitionParam = "shard"
+	cfg.CheckpointPath = filepath.Join(t.TempDir(), "checkpoints.json")
+	ce := engine.NewCollectionEngine(cfg)
+
+	if len(ce.Sources) != 3 {
+		t.Fatalf("expected a source service per partition, got %d", len(ce.Sources))
+	}
+	for i, source := range ce.Sources {
+		if source.Client.Partition != strconv.Itoa(i) {
+			t.Errorf("expected source %d to own partition %d, got '%s'", i, i, source.Client.Partition)
+		}
+		if source.Client.Limiter != ce.Sources[0].Client.Limiter {
+			t.Error("expected every partition to share one rate limiter")
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, source := range ce.Sources {
+		wg.Add(1)
+		go func(source *engine.SourceService) {
+			defer wg.Done()
+			source.HandleGetMessages()
+		}(source)
+	}
+	wg.Wait()
+
+	sort.Strings(requests)
+	expected := []string{"/messages?shard=0", "/messages?shard=1", "/messages?shard=2"}
+	if strings.Join(requests, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected one request per partition %v, got %v", expected, requests)
+	}
+
+	// the shared limit of 3 requests is used up by the three partitions together
+	if msgs := ce.Sources[0].HandleGetMessages(); msgs != nil {
+		t.Error("expected the shared rate limit to stop a fourth request")
+	}
+
+	store, _ := engine.NewCheckpointStore(cfg.CheckpointPath)
+	for i := 0; i < 3; i++ {
+		cursor := store.Load("default#" + strconv.Itoa(i))
+		if cursor == nil || *cursor != 100+i {
+			t.Errorf("expected partition %d to checkpoint cursor %d, got %v", i, 100+i, cursor)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// StageConfig describes one HTTP step of a configured pipeline.
+type StageConfig struct {
+	Name           string        `yaml:"name"`
+	URL            string        `yaml:"url"`
+	Method         string        `yaml:"method"`
+	ExpectedStatus int           `yaml:"expectedStatus"`
+	Timeout        time.Duration `yaml:"timeout"`
+	Workers        int           `yaml:"workers"`
+	MaxRetries     int           `yaml:"maxRetries"`
+	Auth           AuthConfig    `yaml:"auth"`
+	Signing        SigningConfig `yaml:"signing"`
+	TLS            TLSConfig     `yaml:"tls"`
+	// CloudEvents wraps the messages sent to the step as CloudEvents when its Mode is set.
+	CloudEvents CloudEventsConfig `yaml:"cloudEvents"`
+}
+
+// StepClient sends messages to the URL of a configured pipeline step.
+type StepClient struct {
+	Name           string
+	URL            string
+	Method         string
+	ExpectedStatus int
+	HttpClient     *http.Client
+	Ledger         *AckLedger
+	Auth           AuthProvider
+	Signer         *RequestSigner
+	CloudEvents    *CloudEventsConfig
+}
+
+func (c *StepClient) endpoint() endpoint {
+	return endpoint{
+		stage:          c.Name,
+		method:         c.Method,
+		url:            c.URL,
+		expectedStatus: c.ExpectedStatus,
+		httpClient:     c.HttpClient,
+		ledger:         c.Ledger,
+		auth:           c.Auth,
+		signer:         c.Signer,
+		events:         c.CloudEvents,
+	}
+}
+
+// PostMessage sends msg to the step. A step that answers with a message (it
+// has an "id") replaces msg for the following steps, any other response
+// passes msg through unchanged.
+func (c *StepClient) PostMessage(msg Payload) (*ProcessedMessage, error) {
+	body, err := c.endpoint().send(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var processedMsg ProcessedMessage
+	if json.Unmarshal(body, &processedMsg) == nil && processedMsg.ID != "" {
+		if sent := payloadMessage(msg); sent != nil {
+			processedMsg.inherit(sent)
+		}
+		return &processedMsg, nil
+	}
+
+	switch m := msg.(type) {
+	case *ProcessedMessage:
+		return m, nil
+	case *Message:
+		return &ProcessedMessage{Message: *m}, nil
+	}
+	return nil, fmt.Errorf("%s step cannot pass through payload of type %T for messageID='%s'", c.Name, msg, msg.GetID())
+}
+
+// StepService runs one configured pipeline step.
+type StepService struct {
+	Client *StepClient
+	WorkerPool[Payload]
+	*Stage[Payload, *ProcessedMessage]
+	// Output feeds the next step, it is nil for the last step.
+	Output chan Payload
+	// Ordering hands every message to the worker its key hashes to when set.
+	Ordering *OrderingConfig
+}
+
+func (s *StepService) SetUrl(url string) {
+	s.Client.URL = url
+}
+
+func (s *StepService) post(msg Payload) (*ProcessedMessage, error) {
+	return s.Client.PostMessage(msg)
+}
+
+func (s *StepService) emit(processedMsg *ProcessedMessage) {
+	s.Output <- processedMsg
+}
+
+func (s *StepService) Run() {
+	log.Printf("%s step started with %d workers", s.Name, s.WorkerPool.count)
+	if s.Ordering.isSet() {
+		s.WorkerPool.DispatchOrdered(s.Ordering.key, s.Handle)
+	} else {
+		s.WorkerPool.Dispatch(s.Handle)
+	}
+	if s.Output != nil {
+		close(s.Output)
+	}
+}
+
+type PipelineConfig struct {
+	Stages   []StageConfig
+	Messages chan []Message
+	Retries  chan *Retry
+	Ledger   *AckLedger
+	// Transport pools the connections of every step, DefaultTransport when nil.
+	Transport *Transport
+	// Acks is told of every message through the last step or dead-lettered when set.
+	Acks *AckTracker
+	// Dedup is told of every message through the last step or dead-lettered when set.
+	Dedup *DedupService
+	// Ordering keeps the messages with the same key in order through every step when set.
+	Ordering OrderingConfig
+}
+
+// done tells Acks and Dedup that the message of p is through every step or dead-lettered.
+func (cfg *PipelineConfig) done(p Payload) {
+	cfg.Acks.Ack(p)
+	cfg.Dedup.Done(p)
+}
+
+// Pipeline chains configured HTTP steps, feeding each message from the
+// source through every step in order.
+type Pipeline struct {
+	Messages chan []Message
+	Steps    []*StepService
+}
+
+func NewPipeline(cfg *PipelineConfig) (*Pipeline, error) {
+	if len(cfg.Stages) == 0 {
+		return nil, fmt.Errorf("Pipeline config: at least one stage must be configured")
+	}
+
+	if cfg.Messages == nil || cfg.Retries == nil {
+		return nil, fmt.Errorf("Pipeline config: upstream and downstream channels cannot be nil. Messages: %v, Retries: %v", cfg.Messages, cfg.Retries)
+	}
+
+	p := &Pipeline{Messages: cfg.Messages}
+	jobs := make(chan Payload)
+	for i, sc := range cfg.Stages {
+		if sc.Name == "" || sc.URL == "" || sc.Method == "" || sc.ExpectedStatus == 0 || sc.Timeout == 0 || sc.Workers == 0 {
+			return nil, fmt.Errorf("Pipeline config: stage %d must set name, url, method, expectedStatus, timeout and workers. Stage: %+v", i, sc)
+		}
+
+		httpClient, err := newHTTPClient(cfg.Transport, sc.Timeout, &sc.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("Pipeline config: stage '%s': %s", sc.Name, err)
+		}
+
+		step := &StepService{
+			Client: &StepClient{
+				Name:           sc.Name,
+				URL:            sc.URL,
+				Method:         sc.Method,
+				ExpectedStatus: sc.ExpectedStatus,
+				HttpClient:     httpClient,
+				Ledger:         cfg.Ledger,
+			},
+			WorkerPool: NewPool(sc.Workers, jobs),
+		}
+		auth, err := NewAuthProvider(&sc.Auth, step.Client.HttpClient)
+		if err != nil {
+			return nil, fmt.Errorf("Pipeline config: stage '%s': %s", sc.Name, err)
+		}
+		step.Client.Auth = auth
+		signer, err := NewRequestSigner(&sc.Signing)
+		if err != nil {
+			return nil, fmt.Errorf("Pipeline config: stage '%s': %s", sc.Name, err)
+		}
+		step.Client.Signer = signer
+		if err := sc.CloudEvents.validate(); err != nil {
+			return nil, fmt.Errorf("Pipeline config: stage '%s': %s", sc.Name, err)
+		}
+		step.Client.CloudEvents = &sc.CloudEvents
+
+		var emit func(*ProcessedMessage)
+		if i < len(cfg.Stages)-1 {
+			step.Output = make(chan Payload)
+			jobs = step.Output
+			emit = step.emit
+		} else if cfg.Acks != nil || cfg.Dedup != nil {
+			emit = func(processedMsg *ProcessedMessage) { cfg.done(processedMsg) }
+		}
+		step.Stage = NewStage(sc.Name, step.post, emit, cfg.Retries)
+		step.MaxRetries = sc.MaxRetries
+		step.DeadLetter = cfg.done
+		if cfg.Ordering.isSet() {
+			step.Ordering = &cfg.Ordering
+			step.Ordered = true
+		}
+
+		p.Steps = append(p.Steps, step)
+	}
+
+	return p, nil
+}
+
+// Run starts every step and feeds them messages until the Messages channel is closed.
+func (p *Pipeline) Run() {
+	for _, step := range p.Steps {
+		go step.Run()
+	}
+
+	first := p.Steps[0].WorkerPool.Jobs
+	for batch := range p.Messages {
+		for _, msg := range batch {
+			msg := msg
+			first <- &msg
+		}
+	}
+	close(first)
+}
@@ -0,0 +1,164 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+func stageConfig(name, url string, status int) engine.StageConfig {
+	return engine.StageConfig{
+		Name:           name,
+		URL:            url,
+		Method:         http.MethodPost,
+		ExpectedStatus: status,
+		Timeout:        (5 * time.Second),
+		Workers:        2,
+	}
+}
+
+func TestNewPipeline(t *testing.T) {
+	t.Run("should chain a step per configured stage", func(t *testing.T) {
+		p, err := engine.NewPipeline(&engine.PipelineConfig{
+			Stages: []engine.StageConfig{
+				stageConfig("enrichment", "http://enrichment/message", 200),
+				stageConfig("classification", "http://classification/message", 200),
+				stageConfig("storage", "http://storage/message", 201),
+			},
+			Messages: make(chan []engine.Message),
+			Retries:  make(chan *engine.Retry),
+		})
+		if err != nil {
+			t.Fatalf("new config should not return error when all fields are set. err: %s", err)
+		}
+
+		if len(p.Steps) != 3 {
+			t.Fatalf("expected 3 steps, got %d", len(p.Steps))
+		}
+		for i := 0; i < 2; i++ {
+			if p.Steps[i].Output != p.Steps[i+1].WorkerPool.Jobs {
+				t.Errorf("output of step %d should feed step %d", i, i+1)
+			}
+		}
+		if p.Steps[2].Output != nil {
+			t.Error("last step should not have an output")
+		}
+	})
+
+	t.Run("bad configs", func(t *testing.T) {
+		tests := map[string]engine.PipelineConfig{
+			"no stages": {
+				Messages: make(chan []engine.Message),
+				Retries:  make(chan *engine.Retry),
+			},
+			"missing channels": {
+				Stages: []engine.StageConfig{stageConfig("storage", "http://storage/message", 201)},
+			},
+			"stage missing url": {
+				Stages:   []engine.StageConfig{stageConfig("storage", "", 201)},
+				Messages: make(chan []engine.Message),
+				Retries:  make(chan *engine.Retry),
+			},
+		}
+
+		for name, badConfig := range tests {
+			badConfig := badConfig
+			_, err := engine.NewPipeline(&badConfig)
+			if err == nil {
+				t.Errorf("Test - %s: expected an error", name)
+			}
+		}
+	})
+}
+
+func TestRunPipeline(t *testing.T) {
+	enrichment := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var pmsg engine.ProcessedMessage
+		json.NewDecoder(req.Body).Decode(&pmsg)
+		pmsg.Tags = append(pmsg.Tags, "enriched")
+		pmsg.ProcessingDate = "2030-08-24T17:16:52.228009"
+		json.NewEncoder(w).Encode(&pmsg)
+	}))
+	defer enrichment.Close()
+
+	classification := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("accepted"))
+	}))
+	defer classification.Close()
+
+	stored := make(chan engine.ProcessedMessage, 10)
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		var pmsg engine.ProcessedMessage
+		json.Unmarshal(body, &pmsg)
+		stored <- pmsg
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer storage.Close()
+
+	messages := make(chan []engine.Message)
+	p, err := engine.NewPipeline(&engine.PipelineConfig{
+		Stages: []engine.StageConfig{
+			stageConfig("enrichment", enrichment.URL+"/message", 200),
+			stageConfig("classification", classification.URL+"/message", 200),
+			stageConfig("storage", storage.URL+"/message", 201),
+		},
+		Messages: messages,
+		Retries:  make(chan *engine.Retry),
+	})
+	if err != nil {
+		t.Fatalf("should not return error building pipeline. err: %s", err)
+	}
+	go p.Run()
+
+	msgs := test_utils.GenerateMockMessages(5)
+	messages <- msgs
+	close(messages)
+
+	for i := 0; i < len(msgs); i++ {
+		select {
+		case pmsg := <-stored:
+			if pmsg.ProcessingDate == "" {
+				t.Errorf("messageID='%s' should carry the enrichment response to storage", pmsg.ID)
+			}
+			if pmsg.Tags[len(pmsg.Tags)-1] != "enriched" {
+				t.Errorf("messageID='%s' should be tagged by the enrichment step, got tags: %v", pmsg.ID, pmsg.Tags)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected %d messages to be stored, got %d", len(msgs), i)
+		}
+	}
+}
+
+func TestPipelineStepRetries(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	retries := make(chan *engine.Retry, 1)
+	cfg := stageConfig("storage", ts.URL+"/message", 201)
+	cfg.MaxRetries = 5
+	p, _ := engine.NewPipeline(&engine.PipelineConfig{
+		Stages:   []engine.StageConfig{cfg},
+		Messages: make(chan []engine.Message),
+		Retries:  retries,
+	})
+
+	msg := test_utils.GenerateMockMessages(1)[0]
+	p.Steps[0].Handle(&msg)
+
+	r := <-retries
+	if r.ServiceName != "storage" {
+		t.Errorf("expected retry for the storage step, got '%s'", r.ServiceName)
+	}
+	if r.MaxRetries != 5 {
+		t.Errorf("expected the stage retry policy to apply, got MaxRetries: %d", r.MaxRetries)
+	}
+}
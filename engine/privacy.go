@@ -0,0 +1,421 @@
+package engine
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	PrivacyMask    = "mask"
+	PrivacyHash    = "hash"
+	PrivacyEncrypt = "encrypt"
+
+	defaultMaskReplacement = "[REDACTED]"
+	hashPrefix             = "hmac-sha256:"
+	encryptedPrefix        = "enc:v1:"
+)
+
+// maskPatterns are the named patterns a mask rule can use instead of a regular expression.
+var maskPatterns = map[string]string{
+	"email": `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	"phone": `\+?\d[\d ().-]{6,}\d`,
+}
+
+// PrivacyConfig masks, hashes or encrypts message fields before they are
+// stored. Disabled when Fields is empty.
+type PrivacyConfig struct {
+	// KeyringPath is the keyring file of encrypt rules.
+	KeyringPath string `yaml:"keyringPath"`
+	// Salt keys the HMAC of hash rules, so the hashes cannot be looked up in a precomputed table.
+	Salt   string        `yaml:"salt"`
+	Fields []PrivacyRule `yaml:"fields"`
+}
+
+// PrivacyRule is the action taken on one field of every message: a modelled
+// field such as "author" or "tags", or the key of an unmodelled one.
+type PrivacyRule struct {
+	Field  string `yaml:"field"`
+	Action string `yaml:"action"`
+	// Patterns are the regular expressions, or "email" and "phone", masked by
+	// a mask rule. The whole value is masked when empty.
+	Patterns []string `yaml:"patterns"`
+	// Replacement replaces masked text, "[REDACTED]" by default.
+	Replacement string `yaml:"replacement"`
+	// KeyID is the keyring key of an encrypt rule, the primary key by default.
+	KeyID string `yaml:"keyId"`
+}
+
+// Keyring holds the AES keys values are encrypted with. Its file is JSON,
+// {"primary": "<id>", "keys": {"<id>": "<base64 key>"}}, keys of 16, 24 or
+// 32 bytes. Retired keys are kept so older values can still be decrypted.
+type Keyring struct {
+	Primary string
+	keys    map[string]cipher.AEAD
+}
+
+// LoadKeyring reads the keyring file at path.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keyring '%s': %s", path, err)
+	}
+	var file struct {
+		Primary string            `json:"primary"`
+		Keys    map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error decoding keyring '%s': %s", path, err)
+	}
+
+	k := &Keyring{Primary: file.Primary, keys: make(map[string]cipher.AEAD)}
+	for id, encoded := range file.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("keyring '%s': key ID '%s' must be set and cannot contain ':'", path, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("keyring '%s': key '%s' is not base64: %s", path, id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("keyring '%s': key '%s': %s", path, id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+	}
+	if _, ok := k.keys[k.Primary]; !ok {
+		return nil, fmt.Errorf("keyring '%s': primary key '%s' is not one of its keys", path, k.Primary)
+	}
+	return k, nil
+}
+
+// Encrypt seals plaintext with the key keyID, the primary key when blank.
+// field is authenticated along with it, so a value cannot be moved to
+// another field. The result is "enc:v1:<key ID>:<base64 nonce and ciphertext>".
+func (k *Keyring) Encrypt(keyID, field string, plaintext []byte) (string, error) {
+	keyID = paramOrDefault(keyID, k.Primary)
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("keyring has no key '%s'", keyID)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(field))
+	return encryptedPrefix + keyID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value of field returned by Encrypt.
+func (k *Keyring) Decrypt(field, value string) ([]byte, error) {
+	keyID, encoded, ok := strings.Cut(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if !ok || !strings.HasPrefix(value, encryptedPrefix) {
+		return nil, fmt.Errorf("value of field '%s' is not encrypted", field)
+	}
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("keyring has no key '%s' to decrypt field '%s'", keyID, field)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted value of field '%s' is malformed", field)
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(field))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt field '%s': %s", field, err)
+	}
+	return plaintext, nil
+}
+
+// DecryptDocument returns doc, a message document or an array of them, with
+// every encrypted field replaced by its original value.
+func (k *Keyring) DecryptDocument(doc []byte) ([]byte, error) {
+	return k.decryptValue("", doc)
+}
+
+func (k *Keyring) decryptValue(field string, raw json.RawMessage) (json.RawMessage, error) {
+	trimmed := strings.TrimSpace(string(raw))
+	switch {
+	case strings.HasPrefix(trimmed, "{"):
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+		for key, val := range fields {
+			decrypted, err := k.decryptValue(key, val)
+			if err != nil {
+				return nil, err
+			}
+			fields[key] = decrypted
+		}
+		return json.Marshal(fields)
+	case strings.HasPrefix(trimmed, "["):
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, err
+		}
+		for i := range items {
+			decrypted, err := k.decryptValue(field, items[i])
+			if err != nil {
+				return nil, err
+			}
+			items[i] = decrypted
+		}
+		return json.Marshal(items)
+	case strings.HasPrefix(trimmed, `"`+encryptedPrefix):
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+		// the plaintext is the JSON of the original value
+		return k.Decrypt(field, value)
+	}
+	return raw, nil
+}
+
+// privacyRule is a PrivacyRule with its patterns compiled.
+type privacyRule struct {
+	PrivacyRule
+	patterns []*regexp.Regexp
+}
+
+func (cfg *PrivacyConfig) isSet() bool {
+	return cfg != nil && len(cfg.Fields) > 0
+}
+
+func (cfg *PrivacyConfig) rules() ([]*privacyRule, error) {
+	var rules []*privacyRule
+	for _, r := range cfg.Fields {
+		// the engine tracks messages by their ID and source name until they are stored
+		if r.Field == "" || r.Field == "id" || r.Field == "source_name" {
+			return nil, fmt.Errorf("Privacy config: Field must be set and cannot be 'id' or 'source_name'. Field: '%v'", r.Field)
+		}
+		rule := &privacyRule{PrivacyRule: r}
+		switch r.Action {
+		case PrivacyMask:
+			for _, pattern := range r.Patterns {
+				expr, err := regexp.Compile(paramOrDefault(maskPatterns[pattern], pattern))
+				if err != nil {
+					return nil, fmt.Errorf("Privacy config: pattern '%s' of field '%s': %s", pattern, r.Field, err)
+				}
+				rule.patterns = append(rule.patterns, expr)
+			}
+		case PrivacyHash:
+			if cfg.Salt == "" {
+				return nil, fmt.Errorf("Privacy config: Salt cannot be blank to hash field '%s'", r.Field)
+			}
+		case PrivacyEncrypt:
+			if cfg.KeyringPath == "" {
+				return nil, fmt.Errorf("Privacy config: KeyringPath cannot be blank to encrypt field '%s'", r.Field)
+			}
+		default:
+			return nil, fmt.Errorf("Privacy config: Action of field '%s' must be '%s', '%s' or '%s'. Action: '%v'", r.Field, PrivacyMask, PrivacyHash, PrivacyEncrypt, r.Action)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// PrivacyService applies the privacy rules to processed messages on their
+// way to storage.
+type PrivacyService struct {
+	Input             chan *ProcessedMessage
+	ProcessedMessages chan *ProcessedMessage
+	Keyring           *Keyring
+	// WAL, Acks and Dedup are told of every message dropped when set.
+	WAL     *WAL
+	Acks    *AckTracker
+	Dedup   *DedupService
+	rules   []*privacyRule
+	salt    []byte
+	dropped int64
+}
+
+type PrivacyServiceConfig struct {
+	Privacy PrivacyConfig
+	Input   chan *ProcessedMessage
+	WAL     *WAL
+	Acks    *AckTracker
+	Dedup   *DedupService
+}
+
+func NewPrivacyService(cfg *PrivacyServiceConfig) (*PrivacyService, error) {
+	if cfg.Input == nil {
+		return nil, fmt.Errorf("Privacy service config: Input channel cannot be nil")
+	}
+	rules, err := cfg.Privacy.rules()
+	if err != nil {
+		return nil, err
+	}
+
+	ps := &PrivacyService{
+		Input:             cfg.Input,
+		ProcessedMessages: make(chan *ProcessedMessage),
+		WAL:               cfg.WAL,
+		Acks:              cfg.Acks,
+		Dedup:             cfg.Dedup,
+		rules:             rules,
+		salt:              []byte(cfg.Privacy.Salt),
+	}
+	for _, rule := range rules {
+		if rule.Action != PrivacyEncrypt {
+			continue
+		}
+		if ps.Keyring == nil {
+			ps.Keyring, err = LoadKeyring(cfg.Privacy.KeyringPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if rule.KeyID != "" && ps.Keyring.keys[rule.KeyID] == nil {
+			return nil, fmt.Errorf("Privacy config: keyring has no key '%s' to encrypt field '%s'", rule.KeyID, rule.Field)
+		}
+	}
+	return ps, nil
+}
+
+// Dropped returns the number of messages dropped because a rule could not be applied.
+func (ps *PrivacyService) Dropped() int64 {
+	return atomic.LoadInt64(&ps.dropped)
+}
+
+// Apply masks, hashes or encrypts the configured fields of msg in place.
+// Fields that are absent or empty are left as they are.
+func (ps *PrivacyService) Apply(msg *ProcessedMessage) error {
+	modelled := map[string]*string{
+		"source":          &msg.Source,
+		"title":           &msg.Title,
+		"creation_date":   &msg.CreationDate,
+		"message":         &msg.Message.Message,
+		"author":          &msg.Author,
+		"processing_date": &msg.ProcessingDate,
+	}
+	// the map may be shared with the message that was sent to processing
+	if len(msg.Extra) > 0 {
+		extra := make(map[string]json.RawMessage, len(msg.Extra))
+		for key, val := range msg.Extra {
+			extra[key] = val
+		}
+		msg.Extra = extra
+	}
+
+	for _, rule := range ps.rules {
+		if field, ok := modelled[rule.Field]; ok {
+			if *field == "" {
+				continue
+			}
+			value, err := ps.applyString(rule, *field)
+			if err != nil {
+				return err
+			}
+			*field = value
+			continue
+		}
+		if rule.Field == "tags" {
+			tags := make([]string, len(msg.Tags))
+			for i, tag := range msg.Tags {
+				value, err := ps.applyString(rule, tag)
+				if err != nil {
+					return err
+				}
+				tags[i] = value
+			}
+			msg.Tags = tags
+			continue
+		}
+
+		raw, ok := msg.Extra[rule.Field]
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		value, err := ps.applyRaw(rule, raw)
+		if err != nil {
+			return err
+		}
+		msg.Extra[rule.Field] = value
+	}
+	return nil
+}
+
+func (ps *PrivacyService) applyString(rule *privacyRule, value string) (string, error) {
+	switch rule.Action {
+	case PrivacyMask:
+		replacement := paramOrDefault(rule.Replacement, defaultMaskReplacement)
+		if len(rule.patterns) == 0 {
+			return replacement, nil
+		}
+		for _, expr := range rule.patterns {
+			value = expr.ReplaceAllLiteralString(value, replacement)
+		}
+		return value, nil
+	case PrivacyHash:
+		return ps.hash([]byte(value)), nil
+	}
+	plaintext, _ := json.Marshal(value)
+	return ps.Keyring.Encrypt(rule.KeyID, rule.Field, plaintext)
+}
+
+// applyRaw applies rule to the JSON value of an unmodelled field. Strings are
+// treated like modelled fields, other values are hashed or encrypted as their
+// JSON and left as they are by mask rules.
+func (ps *PrivacyService) applyRaw(rule *privacyRule, raw json.RawMessage) (json.RawMessage, error) {
+	var value string
+	isString := json.Unmarshal(raw, &value) == nil
+	switch {
+	case isString && rule.Action != PrivacyEncrypt:
+		result, err := ps.applyString(rule, value)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(result)
+	case rule.Action == PrivacyMask:
+		return raw, nil
+	case rule.Action == PrivacyHash:
+		return json.Marshal(ps.hash(raw))
+	}
+	encrypted, err := ps.Keyring.Encrypt(rule.KeyID, rule.Field, raw)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(encrypted)
+}
+
+func (ps *PrivacyService) hash(value []byte) string {
+	mac := hmac.New(sha256.New, ps.salt)
+	mac.Write(value)
+	return hashPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (ps *PrivacyService) Run() {
+	log.Printf("Privacy service started with %d field rules", len(ps.rules))
+	for msg := range ps.Input {
+		if err := ps.Apply(msg); err != nil {
+			// never store a message the rules could not be applied to
+			dropped := atomic.AddInt64(&ps.dropped, 1)
+			log.Printf("dropping messageID='%s', privacy rules could not be applied, total dropped: %d. err: %s", msg.ID, dropped, err)
+			if err := ps.WAL.Complete(&msg.Message); err != nil {
+				log.Printf("error completing messageID='%s' in the WAL: %s", msg.ID, err)
+			}
+			ps.Acks.Ack(msg)
+			ps.Dedup.Done(msg)
+			continue
+		}
+		ps.ProcessedMessages <- msg
+	}
+	close(ps.ProcessedMessages)
+}
@@ -0,0 +1,174 @@
+package engine_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+)
+
+func writeKeyring(t *testing.T, primary string, ids ...string) string {
+	t.Helper()
+	keys := make(map[string]string)
+	for i, id := range ids {
+		keys[id] = base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune('a'+i)), 32)))
+	}
+	data, _ := json.Marshal(map[string]interface{}{"primary": primary, "keys": keys})
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func privacyMessage() *engine.ProcessedMessage {
+	var msg engine.ProcessedMessage
+	json.Unmarshal([]byte(`{
+		"id": "1",
+		"title": "Quarterly numbers",
+		"message": "mail jane.doe@example.com or call +1 (555) 010-9999 today",
+		"author": "Jane Doe",
+		"tags": ["jane", "finance"],
+		"account": {"number": 1234},
+		"processing_date": "2030-08-24T17:20:00Z"
+	}`), &msg)
+	return &msg
+}
+
+func TestPrivacyServiceApply(t *testing.T) {
+	keyring := writeKeyring(t, "k2", "k1", "k2")
+	ps, err := engine.NewPrivacyService(&engine.PrivacyServiceConfig{
+		Input: make(chan *engine.ProcessedMessage),
+		Privacy: engine.PrivacyConfig{
+			KeyringPath: keyring,
+			Salt:        "pepper",
+			Fields: []engine.PrivacyRule{
+				{Field: "message", Action: engine.PrivacyMask, Patterns: []string{"email", "phone"}},
+				{Field: "author", Action: engine.PrivacyHash},
+				{Field: "tags", Action: engine.PrivacyMask, Patterns: []string{"^jane$"}, Replacement: "***"},
+				{Field: "title", Action: engine.PrivacyEncrypt},
+				{Field: "account", Action: engine.PrivacyEncrypt, KeyID: "k1"},
+				{Field: "missing", Action: engine.PrivacyHash},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	msg := privacyMessage()
+	if err := ps.Apply(msg); err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	if msg.Message.Message != "mail [REDACTED] or call [REDACTED] today" {
+		t.Errorf("expected the email and phone number to be masked, got '%s'", msg.Message.Message)
+	}
+	if !strings.HasPrefix(msg.Author, "hmac-sha256:") || strings.Contains(msg.Author, "Jane") {
+		t.Errorf("expected the author to be hashed, got '%s'", msg.Author)
+	}
+	again := privacyMessage()
+	ps.Apply(again)
+	if again.Author != msg.Author {
+		t.Error("expected the same author to hash to the same value")
+	}
+	if msg.Tags[0] != "***" || msg.Tags[1] != "finance" {
+		t.Errorf("expected the matching tag to be masked, got %v", msg.Tags)
+	}
+	if !strings.HasPrefix(msg.Title, "enc:v1:k2:") || again.Title == msg.Title {
+		t.Errorf("expected the title to be encrypted with the primary key and a fresh nonce, got '%s'", msg.Title)
+	}
+	if !strings.HasPrefix(string(msg.Extra["account"]), `"enc:v1:k1:`) {
+		t.Errorf("expected the unmodelled field to be encrypted with key k1, got %s", msg.Extra["account"])
+	}
+	if msg.ID != "1" || msg.ProcessingDate != "2030-08-24T17:20:00Z" {
+		t.Errorf("expected the fields without rules to be kept, got %+v", msg)
+	}
+
+	// the decrypt command restores the stored document
+	k, err := engine.LoadKeyring(keyring)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+	stored, _ := json.Marshal(msg)
+	decrypted, err := k.DecryptDocument(stored)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+	var restored engine.ProcessedMessage
+	json.Unmarshal(decrypted, &restored)
+	if restored.Title != "Quarterly numbers" || !jsonEqual(t, restored.Extra["account"], []byte(`{"number": 1234}`)) {
+		t.Errorf("expected the encrypted fields to be decrypted, got %s", decrypted)
+	}
+}
+
+func TestKeyringDecryptChecksField(t *testing.T) {
+	k, err := engine.LoadKeyring(writeKeyring(t, "k1", "k1"))
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+	value, _ := k.Encrypt("", "title", []byte(`"secret"`))
+
+	if plaintext, err := k.Decrypt("title", value); err != nil || string(plaintext) != `"secret"` {
+		t.Errorf("expected the value to decrypt, got %s, err: %v", plaintext, err)
+	}
+	if _, err := k.Decrypt("author", value); err == nil {
+		t.Error("expected a value moved to another field not to decrypt")
+	}
+
+	other, _ := engine.LoadKeyring(writeKeyring(t, "k1", "k0", "k1"))
+	if _, err := other.Decrypt("title", value); err == nil {
+		t.Error("expected a value sealed with another key not to decrypt")
+	}
+}
+
+func TestRunPrivacyService(t *testing.T) {
+	input := make(chan *engine.ProcessedMessage)
+	ps, _ := engine.NewPrivacyService(&engine.PrivacyServiceConfig{
+		Input:   input,
+		Privacy: engine.PrivacyConfig{Fields: []engine.PrivacyRule{{Field: "author", Action: engine.PrivacyMask}}},
+	})
+	go ps.Run()
+	go func() {
+		input <- privacyMessage()
+		close(input)
+	}()
+
+	var results []*engine.ProcessedMessage
+	for msg := range ps.ProcessedMessages {
+		results = append(results, msg)
+	}
+	if len(results) != 1 || results[0].Author != "[REDACTED]" {
+		t.Errorf("expected the masked message to be passed on, got %+v", results)
+	}
+}
+
+func TestPrivacyServiceBadConfig(t *testing.T) {
+	keyring := writeKeyring(t, "k1", "k1")
+	tests := map[string]engine.PrivacyConfig{
+		"unknown action":    {Fields: []engine.PrivacyRule{{Field: "author", Action: "drop"}}},
+		"id field":          {Fields: []engine.PrivacyRule{{Field: "id", Action: engine.PrivacyMask}}},
+		"source name field": {Fields: []engine.PrivacyRule{{Field: "source_name", Action: engine.PrivacyHash}}},
+		"bad pattern":       {Fields: []engine.PrivacyRule{{Field: "message", Action: engine.PrivacyMask, Patterns: []string{"("}}}},
+		"hash no salt":      {Fields: []engine.PrivacyRule{{Field: "author", Action: engine.PrivacyHash}}},
+		"encrypt no keys":   {Fields: []engine.PrivacyRule{{Field: "title", Action: engine.PrivacyEncrypt}}},
+		"unknown key":       {KeyringPath: keyring, Fields: []engine.PrivacyRule{{Field: "title", Action: engine.PrivacyEncrypt, KeyID: "k9"}}},
+		"missing keyring":   {KeyringPath: filepath.Join(t.TempDir(), "none.json"), Fields: []engine.PrivacyRule{{Field: "title", Action: engine.PrivacyEncrypt}}},
+		"no primary key":    {KeyringPath: writeKeyring(t, "k2", "k1"), Fields: []engine.PrivacyRule{{Field: "title", Action: engine.PrivacyEncrypt}}},
+		"no input channel":  {},
+	}
+
+	for name, privacy := range tests {
+		cfg := engine.PrivacyServiceConfig{Privacy: privacy, Input: make(chan *engine.ProcessedMessage)}
+		if name == "no input channel" {
+			cfg.Input = nil
+		}
+		if _, err := engine.NewPrivacyService(&cfg); err == nil {
+			t.Errorf("Test - %s: expected an error", name)
+		}
+	}
+}
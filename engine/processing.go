@@ -1,44 +1,71 @@
 package engine
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"sync"
 	"time"
 )
 
 type ProcessingClient struct {
 	URL        string
 	HttpClient *http.Client
+	Ledger     *AckLedger
+	Auth       AuthProvider
+	Signer     *RequestSigner
+	// CloudEvents wraps every message sent as a CloudEvent when its Mode is set.
+	CloudEvents *CloudEventsConfig
+	// Validator quarantines the responses that do not match the processing schema when set.
+	Validator *Validator
+	// Compression compresses large request bodies when its Algorithm is set.
+	Compression *CompressionConfig
+	// Codec encodes messages and decodes responses, JSON when nil.
+	Codec Codec
 }
 
 type ProcessingService struct {
 	Client *ProcessingClient
-	WorkerPool
+	WorkerPool[[]Message]
 	ProcessedMessages chan *ProcessedMessage
-	Retries           chan *Retry
+	// WAL logs every processed message until it is stored when set.
+	WAL *WAL
+	// Acks is told of every message dead-lettered when set.
+	Acks *AckTracker
+	// Dedup is told of every message dead-lettered when set.
+	Dedup *DedupService
+	// Ordering hands every message to the worker its key hashes to when set.
+	Ordering *OrderingConfig
+	*Stage[*Message, *ProcessedMessage]
 }
 
 func (ps *ProcessingService) SetUrl(url string) {
 	ps.Client.URL = url
 }
 
-type WorkerPool struct {
-	count int
-	Jobs  chan []Message
-}
-
 type ProcessingServiceConfig struct {
 	URL           string
 	ClientTimeout time.Duration
 	WorkerCount   int
 	Messages      chan []Message
 	Retries       chan *Retry
+	Ledger        *AckLedger
+	Auth          AuthConfig
+	TLS           TLSConfig
+	Signing       SigningConfig
+	Transport     *Transport
+	CloudEvents   CloudEventsConfig
+	// Codec is the wire encoding of the API, "json" (default), "protobuf" or "msgpack".
+	Codec       string
+	Compression CompressionConfig
+	// Schema is the path of the JSON Schema every response is validated
+	// against, the messages of responses that fail it are sent to Quarantine
+	// instead of storage.
+	Schema     string
+	Quarantine *Quarantine
+	WAL        *WAL
+	Acks       *AckTracker
+	Dedup      *DedupService
+	Ordering   OrderingConfig
 }
 
 func NewProcessingService(cfg *ProcessingServiceConfig) (*ProcessingService, error) {
@@ -50,92 +77,159 @@ func NewProcessingService(cfg *ProcessingServiceConfig) (*ProcessingService, err
 		return nil, fmt.Errorf("Processing service config: upstream and downstream channels cannot be nil. Messages: %v, Retries: %v", cfg.Messages, cfg.Retries)
 	}
 
-	return &ProcessingService{
+	httpClient, err := newHTTPClient(cfg.Transport, cfg.ClientTimeout, &cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := &ProcessingService{
 		Client: &ProcessingClient{
 			URL:        cfg.URL,
-			HttpClient: &http.Client{Timeout: cfg.ClientTimeout},
+			HttpClient: httpClient,
+			Ledger:     cfg.Ledger,
 		},
 		WorkerPool:        NewPool(cfg.WorkerCount, cfg.Messages),
 		ProcessedMessages: make(chan *ProcessedMessage),
-		Retries:           cfg.Retries,
-	}, nil
-}
-
-func NewPool(count int, jobsChannel chan []Message) WorkerPool {
-	return WorkerPool{
-		count: count,
-		Jobs:  jobsChannel,
+		WAL:               cfg.WAL,
+		Acks:              cfg.Acks,
+		Dedup:             cfg.Dedup,
 	}
-}
-
-func (c *ProcessingClient) PostMessage(msg Payload) (*ProcessedMessage, error) {
-	var processedMsg ProcessedMessage
-	payload, err := json.Marshal(msg)
-
+	auth, err := NewAuthProvider(&cfg.Auth, ps.Client.HttpClient)
 	if err != nil {
-		log.Printf("error marshalling Message before sending to processing. Error: %s", err)
+		return nil, err
 	}
-
-	req, err := http.NewRequest(http.MethodPost, c.URL+"/message", bytes.NewBuffer(payload))
-
+	ps.Client.Auth = auth
+	signer, err := NewRequestSigner(&cfg.Signing)
 	if err != nil {
-		log.Printf("error creating POST message request to processing service. Error: %s", err)
 		return nil, err
 	}
-	resp, err := c.HttpClient.Do(req)
+	ps.Client.Signer = signer
+	if err := cfg.CloudEvents.validate(); err != nil {
+		return nil, err
+	}
+	ps.Client.CloudEvents = &cfg.CloudEvents
+	codec, err := NewCodec(cfg.Codec)
 	if err != nil {
-		log.Printf("error posting message to processing client. Error: %s", err)
+		return nil, fmt.Errorf("Processing service config: %s", err)
+	}
+	ps.Client.Codec = codec
+	if err := cfg.Compression.validate(); err != nil {
 		return nil, err
 	}
-
-	body, err := io.ReadAll(resp.Body)
+	ps.Client.Compression = &cfg.Compression
+	validator, err := newValidator("processing", "", cfg.Schema, cfg.Quarantine)
 	if err != nil {
 		return nil, err
 	}
+	ps.Client.Validator = validator
+	ps.Stage = NewStage("processing", ps.post, ps.emit, cfg.Retries)
+	ps.Stage.DeadLetter = ps.deadLetter
+	if cfg.Ordering.isSet() {
+		ps.Ordering = &cfg.Ordering
+		ps.Stage.Ordered = true
+	}
+	return ps, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		err = errors.New(fmt.Sprintf("received non 200 response from processing api: '%s, body: %s'", resp.Status, string(body)))
+func (c *ProcessingClient) endpoint() endpoint {
+	return endpoint{
+		stage:          "processing",
+		method:         http.MethodPost,
+		url:            c.URL + "/message",
+		expectedStatus: http.StatusOK,
+		httpClient:     c.HttpClient,
+		ledger:         c.Ledger,
+		auth:           c.Auth,
+		signer:         c.Signer,
+		events:         c.CloudEvents,
+		codec:          c.Codec,
+		compression:    c.Compression,
+	}
+}
+
+func (c *ProcessingClient) PostMessage(msg Payload) (*ProcessedMessage, error) {
+	var processedMsg ProcessedMessage
+
+	body, err := c.endpoint().send(msg)
+	if err != nil {
 		return nil, err
 	}
+	if c.Validator != nil {
+		doc, err := documentJSON(c.Codec, body, &ProcessedMessage{})
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Validator.check(msg.GetID(), doc); err != nil {
+			return nil, err
+		}
+	}
 
-	err = json.Unmarshal(body, &processedMsg)
+	err = codecOrDefault(c.Codec).Unmarshal(body, &processedMsg)
 	if err != nil {
 		return nil, err
 	}
+	if sent := payloadMessage(msg); sent != nil {
+		processedMsg.inherit(sent)
+	}
 
 	return &processedMsg, nil
 }
 
-func (ps *ProcessingService) ProcessMessage(msg *Message) {
-	processedMsg, err := ps.Client.PostMessage(msg)
-	if err != nil {
-		log.Printf("error for messageID='%s', sending to retry queue. err: %s", msg.ID, err)
-		var r Retry
-		r.New("processing", msg, ps.ProcessedMessages)
-		ps.Retries <- &r
-		return
+func (ps *ProcessingService) post(msg *Message) (*ProcessedMessage, error) {
+	return ps.Client.PostMessage(msg)
+}
+
+// deadLetter completes a message that was quarantined or ran out of
+// retries, replaying it after a restart would only fail it again.
+func (ps *ProcessingService) deadLetter(msg *Message) {
+	if err := ps.WAL.Complete(msg); err != nil {
+		log.Printf("error completing messageID='%s' in the WAL: %s", msg.ID, err)
+	}
+	ps.Acks.Ack(msg)
+	ps.Dedup.Done(msg)
+}
+
+func (ps *ProcessingService) emit(processedMsg *ProcessedMessage) {
+	if err := ps.WAL.Processed(processedMsg); err != nil {
+		log.Printf("error writing messageID='%s' to the WAL: %s", processedMsg.ID, err)
 	}
 	ps.ProcessedMessages <- processedMsg
 }
 
+func (ps *ProcessingService) ProcessMessage(msg *Message) {
+	ps.Stage.Handle(msg)
+}
+
 func (ps *ProcessingService) Run() {
 	log.Printf("Processing Service started with %d workers", ps.WorkerPool.count)
-	var wg sync.WaitGroup
-	for i := 0; i < ps.WorkerPool.count; i++ {
-		wg.Add(1)
-		i := i
-		go ps.processJob(i, &wg, ps.WorkerPool.Jobs)
+	if ps.Ordering.isSet() {
+		ps.dispatchOrdered()
+	} else {
+		ps.WorkerPool.Dispatch(ps.processJob)
 	}
-	wg.Wait()
 	close(ps.ProcessedMessages)
 }
 
-func (ps *ProcessingService) processJob(id int, wg *sync.WaitGroup, jobs <-chan []Message) {
-	defer wg.Done()
-	for j := range jobs {
-		for _, msg := range j {
-			msg := msg
-			ps.ProcessMessage(&msg)
+// dispatchOrdered splits the batches into messages, handed to the workers by
+// their ordering key.
+func (ps *ProcessingService) dispatchOrdered() {
+	msgs := make(chan *Message)
+	go func() {
+		for batch := range ps.WorkerPool.Jobs {
+			for _, msg := range batch {
+				msg := msg
+				msgs <- &msg
+			}
 		}
+		close(msgs)
+	}()
+	key := func(msg *Message) string { return ps.Ordering.key(msg) }
+	NewPool(ps.WorkerPool.count, msgs).DispatchOrdered(key, ps.ProcessMessage)
+}
+
+func (ps *ProcessingService) processJob(batch []Message) {
+	for _, msg := range batch {
+		msg := msg
+		ps.ProcessMessage(&msg)
 	}
 }
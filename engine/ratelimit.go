@@ -0,0 +1,45 @@
+package engine
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter allows Limit requests per Period across every client sharing
+// it, so partitions of a source stay within the source's rate limit together.
+type RateLimiter struct {
+	Limit  int
+	Period time.Duration
+	mu     sync.Mutex
+	count  int
+	window time.Time
+}
+
+func NewRateLimiter(limit int, period time.Duration) *RateLimiter {
+	return &RateLimiter{
+		Limit:  limit,
+		Period: period,
+	}
+}
+
+// Allow reports whether another request fits in the current period, and
+// counts it if so. A Limit of 0 allows every request.
+func (rl *RateLimiter) Allow() bool {
+	if rl.Limit <= 0 {
+		return true
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.window) >= rl.Period {
+		rl.window = now
+		rl.count = 0
+	}
+	if rl.count >= rl.Limit {
+		return false
+	}
+	rl.count++
+	return true
+}
@@ -5,41 +5,42 @@ import (
 	"log"
 )
 
+const defaultMaxRetries = 2
+
 type RetryService struct {
-	ProcessingClient *ProcessingClient
-	Retries          chan *Retry
-	StorageClient    *StorageClient
+	Retries chan *Retry
 }
 
 type Retry struct {
-	RetryCount    int
-	MaxRetries    int
-	ServiceName   string
-	Payload       Payload
-	OutputChannel chan *ProcessedMessage
+	RetryCount  int
+	MaxRetries  int
+	ServiceName string
+	Payload     Payload
+	// Attempt re-runs the failed job, passing its result downstream on success.
+	Attempt func() error
+	// Exhausted, if set, is called once MaxRetries attempts have failed.
+	Exhausted func()
 }
 
-func (r *Retry) New(service string, payload Payload, channel chan *ProcessedMessage) {
-	r.MaxRetries = 2
-	r.ServiceName = service
-	r.Payload = payload
-	r.OutputChannel = channel
+func NewRetry(service string, payload Payload, attempt func() error) *Retry {
+	return &Retry{
+		MaxRetries:  defaultMaxRetries,
+		ServiceName: service,
+		Payload:     payload,
+		Attempt:     attempt,
+	}
 }
 
 type RetryConfig struct {
-	ProcessingClient *ProcessingClient
-	StorageClient    *StorageClient
-	Retries          chan *Retry
+	Retries chan *Retry
 }
 
 func NewRetryService(cfg *RetryConfig) (*RetryService, error) {
-	if cfg.ProcessingClient == nil || cfg.Retries == nil || cfg.StorageClient == nil {
-		return nil, fmt.Errorf("Retry service config: clients or Retries cannot be nil. ProcessingClient: %v, StorageClient: %v, Retries: %v", cfg.ProcessingClient, cfg.StorageClient, cfg.Retries)
+	if cfg.Retries == nil {
+		return nil, fmt.Errorf("Retry service config: Retries cannot be nil. Retries: %v", cfg.Retries)
 	}
 	return &RetryService{
-		ProcessingClient: cfg.ProcessingClient,
-		StorageClient:    cfg.StorageClient,
-		Retries:          cfg.Retries,
+		Retries: cfg.Retries,
 	}, nil
 }
 
@@ -56,32 +57,24 @@ func (rs *RetryService) Run(cancel chan bool) {
 }
 
 func (rs *RetryService) ProcessRetry(r *Retry) {
+	runRetry(r)
+}
+
+// runRetry attempts r until it succeeds or runs out of retries.
+func runRetry(r *Retry) {
 	if r.RetryCount >= r.MaxRetries {
 		log.Printf("max retry count reached for messageID='%s'", r.Payload.GetID())
 		log.Printf("FAILED: %s for messageID='%s' failed.", r.ServiceName, r.Payload.GetID())
-		return
-	}
-
-	if r.ServiceName == "processing" {
-		pmsg, err := rs.ProcessingClient.PostMessage(r.Payload)
-		r.RetryCount++
-		if err != nil {
-			log.Printf("retry attempt %d for messageID='%s' failed", r.RetryCount, r.Payload.GetID())
-			rs.ProcessRetry(r)
-		}
-		if pmsg != nil {
-			r.OutputChannel <- pmsg
-			return
+		if r.Exhausted != nil {
+			r.Exhausted()
 		}
+		return
 	}
 
-	if r.ServiceName == "storage" {
-		err := rs.StorageClient.PostMessage(r.Payload)
-		r.RetryCount++
-		if err != nil {
-			log.Printf("retry attempt %d for messageID='%s' failed", r.RetryCount, r.Payload.GetID())
-			rs.ProcessRetry(r)
-		}
-		return
+	err := r.Attempt()
+	r.RetryCount++
+	if err != nil {
+		log.Printf("retry attempt %d for messageID='%s' failed", r.RetryCount, r.Payload.GetID())
+		runRetry(r)
 	}
 }
@@ -34,9 +34,7 @@ var testStorageService, scfgerr = engine.NewStorageService(&tStoragecfg)
 var testProcessingService, cfgerr = engine.NewProcessingService(&tProcessingCfg)
 
 var retryCfg = engine.RetryConfig{
-	ProcessingClient: testProcessingService.Client,
-	StorageClient:    testStorageService.Client,
-	Retries:          make(chan *engine.Retry),
+	Retries: make(chan *engine.Retry),
 }
 
 func TestNewRetryService(t *testing.T) {
@@ -66,12 +64,7 @@ func TestStorageRetry(t *testing.T) {
 		test_utils.GenerateMockMessages(1)[0],
 		time.Now().UTC().String(),
 	}
-	var retry = engine.Retry{
-		MaxRetries:    2,
-		ServiceName:   "storage",
-		Payload:       &pmsg,
-		OutputChannel: nil,
-	}
+	var retry = *testStorageService.Retry(&pmsg)
 	t.Run("should retry on failures until max retry amount is met", func(t *testing.T) {
 		r, _ := engine.NewRetryService(&retryCfg)
 
@@ -117,13 +110,9 @@ func TestProcessRetry(t *testing.T) {
 		msg,
 		time.Now().UTC().String(),
 	}
-	var retry = engine.Retry{
-		MaxRetries:  2,
-		ServiceName: "processing",
-		Payload:     &msg,
-		// OutputChannel: testProcessingService.ProcessedMessages,
-		OutputChannel: make(chan *engine.ProcessedMessage, 5),
-	}
+	output := make(chan *engine.ProcessedMessage, 5)
+	testProcessingService.ProcessedMessages = output
+	var retry = *testProcessingService.Retry(&msg)
 	t.Run("should retry on failures until max retry amount is met", func(t *testing.T) {
 		r, _ := engine.NewRetryService(&retryCfg)
 
@@ -132,7 +121,7 @@ func TestProcessRetry(t *testing.T) {
 		retryCopy := retry
 		r.ProcessRetry(&retryCopy)
 
-		if len(retry.OutputChannel) > 0 {
+		if len(output) > 0 {
 			t.Error("should not add to output queue on failures")
 		}
 	})
@@ -146,16 +135,16 @@ func TestProcessRetry(t *testing.T) {
 		retryCopy := retry
 		r.ProcessRetry(&retryCopy)
 
-		if len(retry.OutputChannel) != 1 {
+		if len(output) != 1 {
 			t.Error("only one output should be added to queue")
 		}
-		output := <-retry.OutputChannel
-		fmt.Printf("%+v", output)
+		result := <-output
+		fmt.Printf("%+v", result)
 
-		if output.ID != pmsg.ID {
+		if result.ID != pmsg.ID {
 			t.Error("output from retry should match the processed massage server returned")
 		}
-		if output.ProcessingDate != pmsg.ProcessingDate {
+		if result.ProcessingDate != pmsg.ProcessingDate {
 			t.Error("output should be a processed message with a ProcessingDate value")
 		}
 	})
@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SignatureKeyIDHeader     = "X-Signature-Key-Id"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureHeader          = "X-Signature"
+	signaturePrefix          = "sha256="
+)
+
+// SigningConfig turns on HMAC signing of the requests a client sends.
+type SigningConfig struct {
+	// KeyFile holds one "<key id> <secret>" pair per line. The last line is
+	// the key requests are signed with, so a new key is rotated in by
+	// appending it, and the file is re-read whenever it changes.
+	KeyFile string `yaml:"keyFile"`
+}
+
+// SignRequest returns the X-Signature header value of a request, the
+// HMAC-SHA256 of its method, path, timestamp and body keyed with secret.
+func SignRequest(secret []byte, method, path, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// RequestSigner signs requests with the active key of a key file.
+type RequestSigner struct {
+	KeyFile string
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	keyID   string
+	secret  []byte
+}
+
+// NewRequestSigner returns the signer configured in cfg, nil when no key
+// file is set. The key file must be readable when the signer is created.
+func NewRequestSigner(cfg *SigningConfig) (*RequestSigner, error) {
+	if cfg.KeyFile == "" {
+		return nil, nil
+	}
+	s := &RequestSigner{KeyFile: cfg.KeyFile}
+	if err := s.reload(); err != nil {
+		return nil, fmt.Errorf("Signing config: %s", err)
+	}
+	return s, nil
+}
+
+// Sign sets the key ID, timestamp and signature headers on req, body being
+// the request body. Requests are signed as they are sent, so every retry
+// carries a fresh timestamp.
+func (s *RequestSigner) Sign(req *http.Request, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		if s.secret == nil {
+			return err
+		}
+		log.Printf("error reloading signing keys, signing with key '%s'. Error: %s", s.keyID, err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(SignatureKeyIDHeader, s.keyID)
+	req.Header.Set(SignatureTimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, SignRequest(s.secret, req.Method, req.URL.Path, timestamp, body))
+	return nil
+}
+
+// reload reads the key file if it changed since it was last read.
+func (s *RequestSigner) reload() error {
+	info, err := os.Stat(s.KeyFile)
+	if err != nil {
+		return fmt.Errorf("could not read signing key file '%s': %s", s.KeyFile, err)
+	}
+	if s.secret != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.KeyFile)
+	if err != nil {
+		return fmt.Errorf("could not read signing key file '%s': %s", s.KeyFile, err)
+	}
+
+	var keyID, secret string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("signing key file '%s' lines must be '<key id> <secret>'", s.KeyFile)
+		}
+		keyID, secret = fields[0], fields[1]
+	}
+	if keyID == "" {
+		return fmt.Errorf("signing key file '%s' has no keys", s.KeyFile)
+	}
+
+	if s.keyID != "" && s.keyID != keyID {
+		log.Printf("signing key rotated from '%s' to '%s'", s.keyID, keyID)
+	}
+	s.keyID = keyID
+	s.secret = []byte(secret)
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	return nil
+}
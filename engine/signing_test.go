@@ -0,0 +1,141 @@
+package engine_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+type signedRequest struct {
+	keyID       string
+	timestamp   string
+	signature   string
+	contentType string
+	valid       bool
+}
+
+// signingServer records every request and checks its signature against keys.
+func signingServer(keys map[string]string, status int, requests *[]signedRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		sr := signedRequest{
+			keyID:       req.Header.Get(engine.SignatureKeyIDHeader),
+			timestamp:   req.Header.Get(engine.SignatureTimestampHeader),
+			signature:   req.Header.Get(engine.SignatureHeader),
+			contentType: req.Header.Get("Content-Type"),
+		}
+		sr.valid = sr.signature == engine.SignRequest([]byte(keys[sr.keyID]), req.Method, req.URL.Path, sr.timestamp, body)
+		*requests = append(*requests, sr)
+		w.WriteHeader(status)
+	}))
+}
+
+func writeKeyFile(t *testing.T, path, content string) {
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("could not write key file: %s", err)
+	}
+}
+
+func TestStorageRequestSigning(t *testing.T) {
+	keys := map[string]string{"key-1": "secret-1", "key-2": "secret-2"}
+	var requests []signedRequest
+	ts := signingServer(keys, http.StatusCreated, &requests)
+	defer ts.Close()
+
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	writeKeyFile(t, keyFile, "key-1 secret-1\n")
+
+	cfg := scfg
+	cfg.URL = ts.URL
+	cfg.Signing = engine.SigningConfig{KeyFile: keyFile}
+	ss, err := engine.NewStorageService(&cfg)
+	if err != nil {
+		t.Fatalf("should not return error with a key file, err: %s", err)
+	}
+
+	msg := engine.ProcessedMessage{test_utils.GenerateMockMessages(1)[0], time.Now().UTC().String()}
+	if err := ss.Client.PostMessage(&msg); err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	// rotate by appending the new key
+	writeKeyFile(t, keyFile, "key-1 secret-1\nkey-2 secret-2\n")
+	if err := ss.Client.PostMessage(&msg); err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(requests))
+	}
+	for i, keyID := range []string{"key-1", "key-2"} {
+		sr := requests[i]
+		if sr.keyID != keyID || !sr.valid {
+			t.Errorf("expected request %d to be validly signed with '%s', got %+v", i, keyID, sr)
+		}
+		if sr.contentType != "application/json" {
+			t.Errorf("expected a JSON Content-Type, got '%s'", sr.contentType)
+		}
+		ts, _ := strconv.ParseInt(sr.timestamp, 10, 64)
+		if time.Since(time.Unix(ts, 0)) > time.Minute {
+			t.Errorf("expected a current timestamp, got '%s'", sr.timestamp)
+		}
+	}
+}
+
+func TestRetriesAreResigned(t *testing.T) {
+	keys := map[string]string{"key-1": "secret-1"}
+	var requests []signedRequest
+	ts := signingServer(keys, http.StatusInternalServerError, &requests)
+	defer ts.Close()
+
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	writeKeyFile(t, keyFile, "key-1 secret-1\n")
+
+	cfg := pcfg
+	cfg.URL = ts.URL
+	cfg.Signing = engine.SigningConfig{KeyFile: keyFile}
+	ps, _ := engine.NewProcessingService(&cfg)
+
+	msg := test_utils.GenerateMockMessages(1)[0]
+	ps.Client.PostMessage(&msg)
+	time.Sleep(1100 * time.Millisecond)
+	ps.Client.PostMessage(&msg)
+
+	if len(requests) != 2 || !requests[0].valid || !requests[1].valid {
+		t.Fatalf("expected 2 validly signed requests, got %+v", requests)
+	}
+	if requests[0].timestamp == requests[1].timestamp {
+		t.Error("expected the retried request to be signed with a fresh timestamp")
+	}
+}
+
+func TestNewRequestSignerBadConfigs(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty")
+	writeKeyFile(t, empty, "# no keys yet\n")
+	malformed := filepath.Join(dir, "malformed")
+	writeKeyFile(t, malformed, "secret-only\n")
+
+	tests := map[string]string{
+		"missing file": filepath.Join(dir, "missing"),
+		"no keys":      empty,
+		"malformed":    malformed,
+	}
+	for name, path := range tests {
+		if _, err := engine.NewRequestSigner(&engine.SigningConfig{KeyFile: path}); err == nil {
+			t.Errorf("Test - %s: expected an error", name)
+		}
+	}
+
+	if signer, err := engine.NewRequestSigner(&engine.SigningConfig{}); signer != nil || err != nil {
+		t.Error("expected no signer and no error without a key file")
+	}
+}
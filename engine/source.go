@@ -1,11 +1,10 @@
 package engine
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,13 +21,56 @@ type ApiClient struct {
 	RequestsLimit int
 	RequestsCount int
 	URL           string
+	// Path is appended to URL for every page request.
+	Path         string
+	Paginator    Paginator
+	ResultsField string
+	CursorField  string
+	// Auth sets the credentials of every request, the X-Auth-Token header with AuthToken by default.
+	Auth AuthProvider
+	// Limiter, when set, replaces RequestsLimit with a limit shared with other clients.
+	Limiter *RateLimiter
+	// Partition is sent in the PartitionParam query parameter of every request when set.
+	Partition      string
+	PartitionParam string
+	// Fields maps the ID and timestamp of every message received.
+	Fields FieldMapping
+	// Quarantine receives the messages of Source whose fields cannot be mapped.
+	Quarantine *Quarantine
+	// MaxResponseSize is the largest page, once decompressed, read in bytes.
+	MaxResponseSize int
+	Source          string
+	// Validator quarantines the results that do not match the source schema when set.
+	Validator *Validator
+	// CloudEvents makes the client unwrap results that are CloudEvents.
+	CloudEvents bool
+	// Codec decodes the pages of the source, JSON when nil.
+	Codec Codec
 }
 
 type SourceService struct {
-	Client   *ApiClient
-	Cursor   *int
+	Name       string
+	Client     *ApiClient
+	Cursor     *int
+	Checkpoint *CheckpointStore
+	// WAL logs every page fetched before it is checkpointed when set.
+	WAL *WAL
+	// Acks, when set, holds back the checkpoint past a page until every
+	// message of it is stored or dead-lettered.
+	Acks     *AckTracker
 	Messages chan []Message
-	Ticker   time.Ticker
+	Ticker   *time.Ticker
+	// PageSize is the number of results in a full page. A full page means the
+	// source has more data waiting and is polled again immediately.
+	PageSize        int
+	MinPollInterval time.Duration
+	MaxPollInterval time.Duration
+	interval        time.Duration
+	learnPageSize   bool
+	fetched         int64
+	saved           string
+	// tracked is the position of the last page given to Acks.
+	tracked string
 }
 
 func (s *SourceService) SetUrl(url string) {
@@ -46,62 +88,282 @@ type HttpError struct {
 }
 
 type SourceServiceConfig struct {
+	// Name tags every message fetched by the service and keys its checkpoint.
+	Name              string
 	AuthToken         string
 	ClientTimeout     time.Duration
 	RateLimitDuration time.Duration
 	RetryWaitTime     time.Duration
 	RequestsLimit     int
 	URL               string
+	Checkpoint        *CheckpointStore
+	// PageSize is learned from the largest page received when 0.
+	PageSize int
+	// MinPollInterval and MaxPollInterval bound the wait between polls,
+	// default errWaitTime and backoffDuration.
+	MinPollInterval time.Duration
+	MaxPollInterval time.Duration
+	Pagination      PaginationConfig
+	// Partition makes the service fetch one partition of the source, with
+	// its own cursor and checkpoint.
+	Partition      string
+	PartitionParam string
+	Limiter        *RateLimiter
+	// Auth replaces the X-Auth-Token header with another way of authenticating when set.
+	Auth AuthConfig
+	TLS  TLSConfig
+	// Transport pools the connections of the client, DefaultTransport when nil.
+	Transport *Transport
+	Fields    FieldMapping
+	// Schema is the path of the JSON Schema every result is validated against,
+	// the results that fail it are sent to Quarantine instead of downstream.
+	Schema     string
+	Quarantine *Quarantine
+	// CloudEvents unwraps results that are structured CloudEvents, and pages
+	// that are CloudEvents batches, into the messages they carry.
+	CloudEvents bool
+	// Codec is the wire encoding of the source, "json" (default), "protobuf"
+	// or "msgpack". Protobuf pages are MessagePages with the default results
+	// and cursor fields.
+	Codec string
+	// MaxResponseSize bounds the size in bytes of a page once decompressed,
+	// defaultMaxResponseSize when 0.
+	MaxResponseSize int
+	WAL             *WAL
+	Acks            *AckTracker
 }
 
 func NewSourceService(cfg *SourceServiceConfig) (*SourceService, error) {
-	if cfg.AuthToken == "" || cfg.URL == "" {
+	if (cfg.AuthToken == "" && cfg.Auth.Type == "") || cfg.URL == "" {
 		return nil, fmt.Errorf("Source service config: AuthToken and URL cannot be blank. AuthToken: '%v', URL: '%v'", cfg.AuthToken, cfg.URL)
 	}
 
 	if cfg.ClientTimeout == 0 {
 		return nil, fmt.Errorf("Source service config: ClientTimeout cannot be 0. ClientTimeout: %v", cfg.ClientTimeout)
 	}
-	return &SourceService{
+
+	maxResponseSize := cfg.MaxResponseSize
+	if maxResponseSize < 0 {
+		return nil, fmt.Errorf("Source service config: MaxResponseSize cannot be negative. MaxResponseSize: %v", cfg.MaxResponseSize)
+	}
+	if maxResponseSize == 0 {
+		maxResponseSize = defaultMaxResponseSize
+	}
+
+	minInterval, maxInterval := cfg.MinPollInterval, cfg.MaxPollInterval
+	if minInterval == 0 {
+		minInterval = errWaitTime
+	}
+	if maxInterval == 0 {
+		maxInterval = backoffDuration
+	}
+	if maxInterval < minInterval {
+		return nil, fmt.Errorf("Source service config: MaxPollInterval cannot be less than MinPollInterval. MinPollInterval: %v, MaxPollInterval: %v", minInterval, maxInterval)
+	}
+
+	httpClient, err := newHTTPClient(cfg.Transport, cfg.ClientTimeout, &cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	ss := &SourceService{
+		Name: cfg.Name,
 		Client: &ApiClient{
-			URL:           cfg.URL,
-			AuthToken:     cfg.AuthToken,
-			HttpClient:    &http.Client{Timeout: cfg.ClientTimeout},
-			RequestsLimit: cfg.RequestsLimit,
+			URL:             cfg.URL,
+			AuthToken:       cfg.AuthToken,
+			HttpClient:      httpClient,
+			RequestsLimit:   cfg.RequestsLimit,
+			Path:            paramOrDefault(cfg.Pagination.Path, defaultMessagesPath),
+			ResultsField:    cfg.Pagination.ResultsField,
+			CursorField:     cfg.Pagination.CursorField,
+			Limiter:         cfg.Limiter,
+			Partition:       cfg.Partition,
+			PartitionParam:  paramOrDefault(cfg.PartitionParam, "partition"),
+			Fields:          cfg.Fields,
+			Quarantine:      cfg.Quarantine,
+			Source:          cfg.Name,
+			CloudEvents:     cfg.CloudEvents,
+			MaxResponseSize: maxResponseSize,
 		},
-		Messages: make(chan []Message),
-		Ticker:   *time.NewTicker(cfg.RateLimitDuration),
-	}, nil
+		Checkpoint:      cfg.Checkpoint,
+		WAL:             cfg.WAL,
+		Acks:            cfg.Acks,
+		Messages:        make(chan []Message),
+		Ticker:          time.NewTicker(cfg.RateLimitDuration),
+		PageSize:        cfg.PageSize,
+		MinPollInterval: minInterval,
+		MaxPollInterval: maxInterval,
+		learnPageSize:   cfg.PageSize == 0,
+	}
+
+	auth, err := newSourceAuth(&cfg.Auth, cfg.AuthToken, ss.Client.HttpClient)
+	if err != nil {
+		return nil, err
+	}
+	ss.Client.Auth = auth
+
+	validator, err := newValidator("source", cfg.Name, cfg.Schema, cfg.Quarantine)
+	if err != nil {
+		return nil, err
+	}
+	if validator != nil {
+		validator.IDField = cfg.Fields.ID
+	}
+	ss.Client.Validator = validator
+
+	codec, err := NewCodec(cfg.Codec)
+	if err != nil {
+		return nil, fmt.Errorf("Source service config: %s", err)
+	}
+	ss.Client.Codec = codec
+
+	paginator, err := NewPaginator(&cfg.Pagination, &ss.Client.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	ss.Client.Paginator = paginator
+
+	if ss.Checkpoint != nil {
+		if _, ok := paginator.(*pathCursorPaginator); ok {
+			ss.Client.Cursor = ss.Checkpoint.Load(ss.checkpointKey())
+		} else if err := paginator.Seek(ss.Checkpoint.LoadPosition(ss.checkpointKey())); err != nil {
+			return nil, err
+		}
+		ss.saved = paginator.Position()
+		ss.tracked = ss.saved
+		if ss.saved != "" {
+			log.Printf("source '%s' resuming from checkpointed cursor %s", ss.checkpointKey(), ss.saved)
+		}
+	}
+	return ss, nil
 }
 
-func (c *ApiClient) getMessages() ([]Message, error) {
-	var msgResp MessageResponse
+// newSourceAuth returns the configured auth provider, or the static
+// X-Auth-Token header the source API uses by default.
+func newSourceAuth(cfg *AuthConfig, authToken string, httpClient *http.Client) (AuthProvider, error) {
+	if cfg.Type == "" {
+		return &staticAuth{header: defaultAuthHeader, value: authToken}, nil
+	}
+	return NewAuthProvider(cfg, httpClient)
+}
 
-	if c.RequestsLimit > 0 && c.RequestsCount >= c.RequestsLimit {
-		return nil, fmt.Errorf("Reached requests per minute limit, waiting to reissue requests")
+func (ss *SourceService) checkpointKey() string {
+	key := ss.Name
+	if key == "" {
+		key = "default"
+	}
+	if ss.Client.Partition != "" {
+		key = key + "#" + ss.Client.Partition
+	}
+	return key
+}
+
+// Fetched returns the number of messages the service has fetched from its source.
+func (ss *SourceService) Fetched() int64 {
+	return atomic.LoadInt64(&ss.fetched)
+}
+
+// saveCheckpoint records the client position if it moved since the last save.
+func (ss *SourceService) saveCheckpoint() {
+	position := ss.Client.Paginator.Position()
+	if ss.Checkpoint == nil || position == ss.saved {
+		return
+	}
+	var err error
+	if _, ok := ss.Client.Paginator.(*pathCursorPaginator); ok {
+		err = ss.Checkpoint.Save(ss.checkpointKey(), ss.Client.Cursor)
+	} else {
+		err = ss.Checkpoint.SavePosition(ss.checkpointKey(), position)
+	}
+	if err != nil {
+		log.Printf("error saving checkpoint for source '%s': %s", ss.checkpointKey(), err)
+		return
 	}
+	ss.saved = position
+}
 
-	url := c.URL + "/messages"
-	if c.Cursor != nil {
-		url = url + "/" + fmt.Sprint(*c.Cursor)
+// checkpoint saves the client position past msgs, the page just fetched,
+// or with Acks set, once every message of it and of the pages before it is
+// stored or dead-lettered. Without Acks or a WAL that makes delivery at most
+// once: the messages still in flight when the engine stops are lost, the
+// source resumes past them.
+func (ss *SourceService) checkpoint(msgs []Message) {
+	if ss.Acks == nil {
+		ss.saveCheckpoint()
+		return
+	}
+	position := ss.Client.Paginator.Position()
+	if ss.Checkpoint == nil || (len(msgs) == 0 && position == ss.tracked) {
+		return
 	}
+	ss.tracked = position
+	var cursor *int
+	if ss.Client.Cursor != nil {
+		c := *ss.Client.Cursor
+		cursor = &c
+	}
+	ss.Acks.Track(ss.checkpointKey(), msgs, func() {
+		ss.commitCheckpoint(position, cursor)
+	})
+}
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	log.Printf("requesting from Source API, url: %s", url)
+// commitCheckpoint saves a position checkpointed by the tracker.
+func (ss *SourceService) commitCheckpoint(position string, cursor *int) {
+	var err error
+	if _, ok := ss.Client.Paginator.(*pathCursorPaginator); ok {
+		err = ss.Checkpoint.Save(ss.checkpointKey(), cursor)
+	} else {
+		err = ss.Checkpoint.SavePosition(ss.checkpointKey(), position)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error creating request %s", err)
+		log.Printf("error saving checkpoint for source '%s': %s", ss.checkpointKey(), err)
 	}
+}
 
-	req.Header.Add("X-Auth-Token", c.AuthToken)
-	resp, err := c.HttpClient.Do(req)
+func (c *ApiClient) getMessages() ([]Message, error) {
+	if c.Limiter != nil {
+		if !c.Limiter.Allow() {
+			return nil, fmt.Errorf("Reached requests per minute limit, waiting to reissue requests")
+		}
+	} else if c.RequestsLimit > 0 && c.RequestsCount >= c.RequestsLimit {
+		return nil, fmt.Errorf("Reached requests per minute limit, waiting to reissue requests")
+	}
+
+	url, err := c.Paginator.Next(c.URL + c.Path)
+	if err != nil {
+		return nil, err
+	}
+	if c.Partition != "" {
+		url, err = withQuery(url, map[string]string{c.PartitionParam: c.Partition})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("requesting from Source API, url: %s", url)
+	resp, err := doWithAuth(c.HttpClient, c.Auth, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating request %s", err)
+		}
+		req.Header.Set("Accept", codecOrDefault(c.Codec).ContentType())
+		// set explicitly so zstd is accepted too, the body is decompressed below
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		return req, nil
+	})
 	c.RequestsCount++
 	if err != nil {
 		return nil, fmt.Errorf("error sending client request: %s", err)
 	}
+	defer drainAndClose(resp.Body)
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := readLimited(resp.Body, c.MaxResponseSize)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error reading GET %s response: %s", c.Path, err)
+	}
+	body, err = decompress(resp.Header, body, c.MaxResponseSize)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing GET %s response: %s", c.Path, err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
@@ -109,32 +371,97 @@ func (c *ApiClient) getMessages() ([]Message, error) {
 		return nil, NewHttpError(resp.StatusCode, errMsg)
 	}
 
-	err = json.Unmarshal(body, &msgResp)
-	if err != nil {
-		return nil, fmt.Errorf("Could not unmarshal GET /messages response into Message struct, response body: %v", string(body))
+	if body, err = pageJSON(c.Codec, body); err != nil {
+		return nil, fmt.Errorf("Could not decode GET %s response as %s: %s", c.Path, codecOrDefault(c.Codec).ContentType(), err)
 	}
 
-	c.Cursor = msgResp.Cursor
+	resultsField := c.ResultsField
+	if c.CloudEvents && isCloudEventsBatch(resp.Header) {
+		// a batch is an array of events with no room for a cursor
+		resultsField = "."
+	}
+	page, err := decodePage(body, resultsField, c.CursorField, c.CloudEvents, c.Validator)
+	if err != nil {
+		return nil, fmt.Errorf("Could not unmarshal GET %s response into Message struct, response body: %v", c.Path, string(body))
+	}
+	page.Header = resp.Header
+	page.URL = url
+	results := c.Fields.apply(page.Results, c.Quarantine, c.Source)
 
-	if len(msgResp.Results) < 1 {
-		return nil, fmt.Errorf("WARN: Empty results array received from source API. Waiting %v", errWaitTime)
+	// past the messages that could not be mapped too, they would only fail again
+	err = c.Paginator.Advance(page)
+	if err != nil {
+		return nil, fmt.Errorf("error advancing past page '%s': %s", url, err)
 	}
 
-	return msgResp.Results, nil
+	return results, nil
 }
 
 func (ss *SourceService) HandleGetMessages() []Message {
 	msgs, err := ss.Client.getMessages()
 	if err != nil {
+		ss.checkpoint(nil)
 		ss.HandleError(err)
 		return nil
 	}
+	if ss.Name != "" {
+		for i := range msgs {
+			msgs[i].SourceName = ss.Name
+		}
+	}
+	// the page is logged before the cursor past it is checkpointed, so a crash cannot lose it
+	if err := ss.WAL.Append(msgs); err != nil {
+		log.Printf("error writing page of source '%s' to the WAL, not checkpointing it: %s", ss.checkpointKey(), err)
+	} else {
+		ss.checkpoint(msgs)
+	}
+	ss.adjustInterval(len(msgs))
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	atomic.AddInt64(&ss.fetched, int64(len(msgs)))
 
 	return msgs
 }
 
+// Interval returns how long the service waits before its next poll.
+func (ss *SourceService) Interval() time.Duration {
+	return ss.interval
+}
+
+// adjustInterval sets the wait before the next poll from the size of the
+// page just received. Full pages are followed immediately, partial pages
+// after MinPollInterval, and every empty page doubles the wait up to
+// MaxPollInterval.
+func (ss *SourceService) adjustInterval(results int) {
+	// without a configured page size the largest page seen is taken as full
+	if ss.learnPageSize && results > ss.PageSize {
+		ss.PageSize = results
+	}
+
+	switch {
+	case results == 0:
+		if ss.interval == 0 {
+			ss.interval = ss.MinPollInterval
+		} else {
+			ss.interval *= 2
+		}
+		if ss.interval > ss.MaxPollInterval {
+			ss.interval = ss.MaxPollInterval
+		}
+		log.Printf("source '%s' caught up, next poll in %v", ss.checkpointKey(), ss.interval)
+	case results >= ss.PageSize:
+		ss.interval = 0
+	default:
+		ss.interval = ss.MinPollInterval
+	}
+}
+
 func (ss *SourceService) Run(cancel <-chan bool) {
 	log.Println("Source service started.")
+	poll := time.NewTimer(0)
+	defer poll.Stop()
 	for {
 		select {
 		case <-ss.Ticker.C:
@@ -143,7 +470,18 @@ func (ss *SourceService) Run(cancel <-chan bool) {
 			log.Println("Source Service received cancel signal. Stopping service.")
 			close(ss.Messages)
 			return
-		case ss.Messages <- ss.HandleGetMessages():
+		case <-poll.C:
+			msgs := ss.HandleGetMessages()
+			if len(msgs) > 0 {
+				select {
+				case ss.Messages <- msgs:
+				case <-cancel:
+					log.Println("Source Service received cancel signal. Stopping service.")
+					close(ss.Messages)
+					return
+				}
+			}
+			poll.Reset(ss.interval)
 		}
 	}
 }
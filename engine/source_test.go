@@ -327,6 +327,66 @@ func TestRunSourceService(t *testing.T) {
 	})
 }
 
+func TestAdaptivePollInterval(t *testing.T) {
+	pages := map[string][]engine.Message{
+		"full":    test_utils.GenerateMockMessages(10),
+		"partial": test_utils.GenerateMockMessages(4),
+		"empty":   {},
+	}
+	page := "full"
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r, _ := json.Marshal(engine.MessageResponse{Results: pages[page]})
+		w.Write(r)
+	}))
+	defer ts.Close()
+
+	cfgCopy := cfg
+	cfgCopy.URL = ts.URL
+	cfgCopy.MinPollInterval = (100 * time.Millisecond)
+	cfgCopy.MaxPollInterval = (350 * time.Millisecond)
+	source, _ := engine.NewSourceService(&cfgCopy)
+
+	steps := []struct {
+		page     string
+		expected time.Duration
+	}{
+		{page: "full", expected: 0},
+		{page: "partial", expected: (100 * time.Millisecond)},
+		{page: "empty", expected: (200 * time.Millisecond)},
+		{page: "empty", expected: (350 * time.Millisecond)},
+		{page: "empty", expected: (350 * time.Millisecond)},
+		{page: "full", expected: 0},
+		{page: "empty", expected: (100 * time.Millisecond)},
+	}
+
+	for i, step := range steps {
+		page = step.page
+		start := time.Now()
+		res := source.HandleGetMessages()
+		if page == "empty" {
+			if res != nil {
+				t.Errorf("step %d: an empty page should return no messages, got %d", i, len(res))
+			}
+			if time.Since(start) >= (500 * time.Millisecond) {
+				t.Errorf("step %d: an empty page should not be handled as an error", i)
+			}
+		}
+		if source.Interval() != step.expected {
+			t.Errorf("step %d: after a %s page expected next poll in %v, got %v", i, step.page, step.expected, source.Interval())
+		}
+	}
+
+	t.Run("max interval below min interval", func(t *testing.T) {
+		badConfig := cfg
+		badConfig.MinPollInterval = time.Second
+		badConfig.MaxPollInterval = (100 * time.Millisecond)
+		if _, err := engine.NewSourceService(&badConfig); err == nil {
+			t.Error("expected error when MaxPollInterval is less than MinPollInterval")
+		}
+	})
+}
+
 func TestHandleError(t *testing.T) {
 	t.Run("should handle 500 error", func(t *testing.T) {
 		source, _ := engine.NewSourceService(&cfg)
@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// WorkerPool is a fixed number of workers consuming jobs of type J.
+type WorkerPool[J any] struct {
+	count int
+	Jobs  chan J
+}
+
+func NewPool[J any](count int, jobsChannel chan J) WorkerPool[J] {
+	return WorkerPool[J]{
+		count: count,
+		Jobs:  jobsChannel,
+	}
+}
+
+// Dispatch starts the workers, each passing jobs to handle until Jobs is
+// closed, and blocks until all of them have returned.
+func (p WorkerPool[J]) Dispatch(handle func(J)) {
+	var wg sync.WaitGroup
+	for i := 0; i < p.count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range p.Jobs {
+				handle(j)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// orderedQueueSize is the number of jobs waiting for each worker of an
+// ordered dispatch before the dispatch blocks.
+const orderedQueueSize = 64
+
+// DispatchOrdered starts the workers and hands every job to the one its key
+// hashes to, so the jobs with the same key are handled one at a time in the
+// order they arrived. It blocks until Jobs is closed and all of the workers
+// have returned.
+func (p WorkerPool[J]) DispatchOrdered(key func(J) string, handle func(J)) {
+	var wg sync.WaitGroup
+	queues := make([]chan J, p.count)
+	for i := range queues {
+		queues[i] = make(chan J, orderedQueueSize)
+		wg.Add(1)
+		go func(jobs chan J) {
+			defer wg.Done()
+			for j := range jobs {
+				handle(j)
+			}
+		}(queues[i])
+	}
+	for j := range p.Jobs {
+		queues[partition(key(j), p.count)] <- j
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+}
+
+// StageMetrics counts the outcome of every job handled by a stage.
+type StageMetrics struct {
+	succeeded   int64
+	failed      int64
+	recovered   int64
+	dropped     int64
+	quarantined int64
+}
+
+// Succeeded is the number of jobs handled successfully on the first attempt.
+func (m *StageMetrics) Succeeded() int64 {
+	return atomic.LoadInt64(&m.succeeded)
+}
+
+// Failed is the number of jobs whose first attempt failed and were sent to the retry queue.
+func (m *StageMetrics) Failed() int64 {
+	return atomic.LoadInt64(&m.failed)
+}
+
+// Recovered is the number of failed jobs that later succeeded on a retry.
+func (m *StageMetrics) Recovered() int64 {
+	return atomic.LoadInt64(&m.recovered)
+}
+
+// Dropped is the number of failed jobs that ran out of retries.
+func (m *StageMetrics) Dropped() int64 {
+	return atomic.LoadInt64(&m.dropped)
+}
+
+// Quarantined is the number of jobs whose payload failed validation. They are not retried.
+func (m *StageMetrics) Quarantined() int64 {
+	return atomic.LoadInt64(&m.quarantined)
+}
+
+// Stage handles jobs of type In, one at a time, and passes results of type
+// Out downstream. Failed jobs are sent to the retry queue with an attempt
+// that re-runs the handler, so the RetryService needs no knowledge of stages.
+type Stage[In Payload, Out any] struct {
+	Name    string
+	Handler func(In) (Out, error)
+	// Emit passes a result downstream. Stages at the end of the pipeline leave it nil.
+	Emit    func(Out)
+	Retries chan *Retry
+	// MaxRetries overrides the default number of retries for failed jobs when set.
+	MaxRetries int
+	// Ordered retries failed jobs on the worker that handled them, instead of
+	// sending them to the retry queue, so the next job waits for them.
+	Ordered bool
+	// DeadLetter, if set, is called with every job that is quarantined or runs
+	// out of retries, the jobs the stage gives up on.
+	DeadLetter func(In)
+	Metrics    StageMetrics
+}
+
+func NewStage[In Payload, Out any](name string, handler func(In) (Out, error), emit func(Out), retries chan *Retry) *Stage[In, Out] {
+	return &Stage[In, Out]{
+		Name:    name,
+		Handler: handler,
+		Emit:    emit,
+		Retries: retries,
+	}
+}
+
+// Handle runs the handler for job and emits the result, or retries job if the
+// handler returns an error other than ErrQuarantined: on the retry queue, or
+// in place when the stage is Ordered.
+func (s *Stage[In, Out]) Handle(job In) {
+	err := s.attempt(job)
+	if errors.Is(err, ErrQuarantined) {
+		atomic.AddInt64(&s.Metrics.quarantined, 1)
+		s.deadLetter(job)
+		return
+	}
+	if err != nil {
+		atomic.AddInt64(&s.Metrics.failed, 1)
+		if s.Ordered {
+			log.Printf("error for messageID='%s', retrying it in order. err: %s", job.GetID(), err)
+			runRetry(s.Retry(job))
+			return
+		}
+		log.Printf("error for messageID='%s', sending to retry queue. err: %s", job.GetID(), err)
+		s.Retries <- s.Retry(job)
+		return
+	}
+	atomic.AddInt64(&s.Metrics.succeeded, 1)
+}
+
+// Retry builds the retry queue entry for job.
+func (s *Stage[In, Out]) Retry(job In) *Retry {
+	r := NewRetry(s.Name, job, func() error {
+		err := s.attempt(job)
+		if errors.Is(err, ErrQuarantined) {
+			// a retried request can get an invalid response too, retrying it again will not help
+			atomic.AddInt64(&s.Metrics.quarantined, 1)
+			s.deadLetter(job)
+			return nil
+		}
+		if err == nil {
+			atomic.AddInt64(&s.Metrics.recovered, 1)
+		}
+		return err
+	})
+	if s.MaxRetries > 0 {
+		r.MaxRetries = s.MaxRetries
+	}
+	r.Exhausted = func() {
+		atomic.AddInt64(&s.Metrics.dropped, 1)
+		s.deadLetter(job)
+	}
+	return r
+}
+
+func (s *Stage[In, Out]) deadLetter(job In) {
+	if s.DeadLetter != nil {
+		s.DeadLetter(job)
+	}
+}
+
+func (s *Stage[In, Out]) attempt(job In) error {
+	out, err := s.Handler(job)
+	if err != nil {
+		return err
+	}
+	if s.Emit != nil {
+		s.Emit(out)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package engine_test
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+func TestWorkerPoolDispatch(t *testing.T) {
+	jobs := make(chan int)
+	pool := engine.NewPool(4, jobs)
+
+	go func() {
+		for i := 1; i <= 100; i++ {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	var sum int64
+	pool.Dispatch(func(j int) {
+		atomic.AddInt64(&sum, int64(j))
+	})
+
+	if sum != 5050 {
+		t.Errorf("expected every job to be handled once, got sum: %d", sum)
+	}
+}
+
+func TestStage(t *testing.T) {
+	msg := test_utils.GenerateMockMessages(1)[0]
+
+	t.Run("successful jobs should be emitted downstream", func(t *testing.T) {
+		var emitted []string
+		stage := engine.NewStage("titles", func(m *engine.Message) (string, error) {
+			return m.Title, nil
+		}, func(title string) {
+			emitted = append(emitted, title)
+		}, make(chan *engine.Retry))
+
+		stage.Handle(&msg)
+
+		if len(emitted) != 1 || emitted[0] != msg.Title {
+			t.Errorf("expected '%s' to be emitted, got: %v", msg.Title, emitted)
+		}
+		if stage.Metrics.Succeeded() != 1 {
+			t.Errorf("expected 1 succeeded job, got %d", stage.Metrics.Succeeded())
+		}
+	})
+
+	t.Run("failed jobs should be sent to retries and re-run by the retry service", func(t *testing.T) {
+		calls := 0
+		var emitted []string
+		retries := make(chan *engine.Retry, 1)
+		stage := engine.NewStage("flaky", func(m *engine.Message) (string, error) {
+			calls++
+			if calls < 3 {
+				return "", errors.New("unavailable")
+			}
+			return m.ID, nil
+		}, func(id string) {
+			emitted = append(emitted, id)
+		}, retries)
+
+		stage.Handle(&msg)
+		if stage.Metrics.Failed() != 1 {
+			t.Errorf("expected 1 failed job, got %d", stage.Metrics.Failed())
+		}
+
+		r := <-retries
+		if r.ServiceName != "flaky" || r.Payload.GetID() != msg.ID {
+			t.Errorf("retry should carry the stage name and job, got: %s, %s", r.ServiceName, r.Payload.GetID())
+		}
+
+		rs, _ := engine.NewRetryService(&engine.RetryConfig{Retries: retries})
+		rs.ProcessRetry(r)
+
+		if len(emitted) != 1 {
+			t.Errorf("expected retried job to be emitted once, got %d", len(emitted))
+		}
+		if stage.Metrics.Recovered() != 1 {
+			t.Errorf("expected 1 recovered job, got %d", stage.Metrics.Recovered())
+		}
+	})
+
+	t.Run("jobs that run out of retries should be counted as dropped", func(t *testing.T) {
+		retries := make(chan *engine.Retry, 1)
+		stage := engine.NewStage("broken", func(m *engine.Message) (struct{}, error) {
+			return struct{}{}, errors.New("unavailable")
+		}, nil, retries)
+
+		stage.Handle(&msg)
+		rs, _ := engine.NewRetryService(&engine.RetryConfig{Retries: retries})
+		rs.ProcessRetry(<-retries)
+
+		if stage.Metrics.Dropped() != 1 {
+			t.Errorf("expected 1 dropped job, got %d", stage.Metrics.Dropped())
+		}
+	})
+}
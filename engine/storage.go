@@ -1,36 +1,47 @@
 package engine
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"sync"
 	"time"
 )
 
 type StorageClient struct {
 	URL        string
 	HttpClient *http.Client
+	Ledger     *AckLedger
+	Auth       AuthProvider
+	Signer     *RequestSigner
+	// CloudEvents wraps every message sent as a CloudEvent when its Mode is set.
+	CloudEvents *CloudEventsConfig
+	// Compression compresses large request bodies when its Algorithm is set.
+	Compression *CompressionConfig
+	// Codec encodes messages, JSON when nil.
+	Codec Codec
+	// RecordSigner signs every record before it is sent when set.
+	RecordSigner *RecordSigner
 }
 
 type StorageService struct {
 	Client *StorageClient
 	StorageWorkerPool
-	Retries chan *Retry
+	// WAL is told of every message stored or dead-lettered when set.
+	WAL *WAL
+	// Acks is told of every message stored or dead-lettered when set.
+	Acks *AckTracker
+	// Dedup is told of every message stored or dead-lettered when set.
+	Dedup *DedupService
+	// Ordering hands every message to the worker its key hashes to when set.
+	Ordering *OrderingConfig
+	*Stage[*ProcessedMessage, struct{}]
 }
 
 func (ss *StorageService) SetUrl(url string) {
 	ss.Client.URL = url
 }
 
-type StorageWorkerPool struct {
-	count int
-	Jobs  chan *ProcessedMessage
-}
+type StorageWorkerPool = WorkerPool[*ProcessedMessage]
 
 type StorageServiceConfig struct {
 	URL               string
@@ -38,6 +49,21 @@ type StorageServiceConfig struct {
 	WorkerCount       int
 	ProcessedMessages chan *ProcessedMessage
 	Retries           chan *Retry
+	Ledger            *AckLedger
+	Auth              AuthConfig
+	TLS               TLSConfig
+	Signing           SigningConfig
+	Transport         *Transport
+	CloudEvents       CloudEventsConfig
+	// Codec is the wire encoding of the API, "json" (default), "protobuf" or "msgpack".
+	Codec       string
+	Compression CompressionConfig
+	// Integrity signs every record with its SigningKeyPath when set.
+	Integrity IntegrityConfig
+	WAL       *WAL
+	Acks      *AckTracker
+	Dedup     *DedupService
+	Ordering  OrderingConfig
 }
 
 func NewStorageService(cfg *StorageServiceConfig) (*StorageService, error) {
@@ -49,83 +75,115 @@ func NewStorageService(cfg *StorageServiceConfig) (*StorageService, error) {
 		return nil, fmt.Errorf("Storage service config: upstream and downstream channels cannot be nil. ProcessedMessages: %v, Retries: %v", cfg.ProcessedMessages, cfg.Retries)
 	}
 
-	return &StorageService{
+	httpClient, err := newHTTPClient(cfg.Transport, cfg.ClientTimeout, &cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	ss := &StorageService{
 		Client: &StorageClient{
 			URL:        cfg.URL,
-			HttpClient: &http.Client{Timeout: cfg.ClientTimeout},
+			HttpClient: httpClient,
+			Ledger:     cfg.Ledger,
 		},
-		StorageWorkerPool: NewStoragePool(cfg.WorkerCount, cfg.ProcessedMessages),
-		Retries:           cfg.Retries,
-	}, nil
-}
-
-func NewStoragePool(count int, jobsChannel chan *ProcessedMessage) StorageWorkerPool {
-	return StorageWorkerPool{
-		count: count,
-		Jobs:  jobsChannel,
+		StorageWorkerPool: NewPool(cfg.WorkerCount, cfg.ProcessedMessages),
+		WAL:               cfg.WAL,
+		Acks:              cfg.Acks,
+		Dedup:             cfg.Dedup,
 	}
-}
-
-func (c *StorageClient) PostMessage(processedMsg Payload) error {
-	payload, err := json.Marshal(processedMsg)
-
+	auth, err := NewAuthProvider(&cfg.Auth, ss.Client.HttpClient)
 	if err != nil {
-		log.Printf("error marshalling ProcessedMessage before sending to storage. Error: %s", err)
+		return nil, err
 	}
-
-	req, err := http.NewRequest(http.MethodPost, c.URL+"/message", bytes.NewBuffer(payload))
-
+	ss.Client.Auth = auth
+	signer, err := NewRequestSigner(&cfg.Signing)
 	if err != nil {
-		log.Printf("error creating POST message request to storage service. Error: %s", err)
-		return err
+		return nil, err
 	}
-	resp, err := c.HttpClient.Do(req)
+	ss.Client.Signer = signer
+	if err := cfg.CloudEvents.validate(); err != nil {
+		return nil, err
+	}
+	ss.Client.CloudEvents = &cfg.CloudEvents
+	codec, err := NewCodec(cfg.Codec)
 	if err != nil {
-		log.Printf("error posting message to storage service. Error: %s", err)
-		return err
+		return nil, fmt.Errorf("Storage service config: %s", err)
 	}
-
-	body, err := io.ReadAll(resp.Body)
+	ss.Client.Codec = codec
+	if err := cfg.Compression.validate(); err != nil {
+		return nil, err
+	}
+	ss.Client.Compression = &cfg.Compression
+	recordSigner, err := NewRecordSigner(&cfg.Integrity)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	ss.Client.RecordSigner = recordSigner
+	ss.Stage = NewStage("storage", ss.post, nil, cfg.Retries)
+	ss.Stage.DeadLetter = ss.complete
+	if cfg.Ordering.isSet() {
+		ss.Ordering = &cfg.Ordering
+		ss.Stage.Ordered = true
+	}
+	return ss, nil
+}
 
-	if resp.StatusCode != http.StatusCreated {
-		err = errors.New(fmt.Sprintf("received non 201 response from storage api: '%s, body: %s'", resp.Status, string(body)))
-		return err
+func (c *StorageClient) endpoint() endpoint {
+	return endpoint{
+		stage:          "storage",
+		method:         http.MethodPost,
+		url:            c.URL + "/message",
+		expectedStatus: http.StatusCreated,
+		httpClient:     c.HttpClient,
+		ledger:         c.Ledger,
+		auth:           c.Auth,
+		signer:         c.Signer,
+		events:         c.CloudEvents,
+		codec:          c.Codec,
+		compression:    c.Compression,
 	}
+}
 
-	return nil
+func (c *StorageClient) PostMessage(processedMsg Payload) error {
+	if c.RecordSigner != nil {
+		if err := c.RecordSigner.Sign(processedMsg); err != nil {
+			return err
+		}
+	}
+	_, err := c.endpoint().send(processedMsg)
+	return err
 }
 
-func (ss *StorageService) StoreMessage(processedMsg *ProcessedMessage) {
+func (ss *StorageService) post(processedMsg *ProcessedMessage) (struct{}, error) {
 	err := ss.Client.PostMessage(processedMsg)
 	if err != nil {
-		log.Printf("error for messageID='%s', sending to retry queue. err: %s", processedMsg.ID, err)
-		var r Retry
-		r.New("storage", processedMsg, nil)
-		ss.Retries <- &r
-		return
+		return struct{}{}, err
 	}
 	log.Printf("storage successful for messageID='%s'", processedMsg.ID)
-	return
+	ss.complete(processedMsg)
+	return struct{}{}, nil
 }
 
-func (ss *StorageService) Run() {
-	log.Printf("Storage Service started with %d workers", ss.StorageWorkerPool.count)
-	var wg sync.WaitGroup
-	for i := 0; i < ss.StorageWorkerPool.count; i++ {
-		wg.Add(1)
-		i := i
-		go ss.processJob(i, &wg, ss.StorageWorkerPool.Jobs)
+// complete marks a message stored, or dead-lettered after running out of
+// retries, in the WAL, the ack tracker and the dedup seen set.
+func (ss *StorageService) complete(processedMsg *ProcessedMessage) {
+	if err := ss.WAL.Complete(&processedMsg.Message); err != nil {
+		log.Printf("error completing messageID='%s' in the WAL: %s", processedMsg.ID, err)
 	}
-	wg.Wait()
+	ss.Acks.Ack(processedMsg)
+	ss.Dedup.Done(processedMsg)
+}
+
+func (ss *StorageService) StoreMessage(processedMsg *ProcessedMessage) {
+	ss.Stage.Handle(processedMsg)
 }
 
-func (ss *StorageService) processJob(id int, wg *sync.WaitGroup, jobs <-chan *ProcessedMessage) {
-	defer wg.Done()
-	for j := range jobs {
-		msg := j
-		ss.StoreMessage(msg)
+func (ss *StorageService) Run() {
+	log.Printf("Storage Service started with %d workers", ss.StorageWorkerPool.count)
+	if ss.Ordering.isSet() {
+		key := func(processedMsg *ProcessedMessage) string { return ss.Ordering.key(processedMsg) }
+		ss.StorageWorkerPool.DispatchOrdered(key, ss.StoreMessage)
+		return
 	}
+	ss.StorageWorkerPool.Dispatch(ss.StoreMessage)
 }
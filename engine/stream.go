@@ -0,0 +1,395 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SourceModePoll   = "poll"
+	SourceModeStream = "stream"
+
+	StreamFormatSSE    = "sse"
+	StreamFormatNDJSON = "ndjson"
+
+	defaultStreamPath = "/messages/stream"
+)
+
+// StreamClient subscribes to a Server-Sent Events or newline delimited JSON
+// endpoint of the source API.
+type StreamClient struct {
+	AuthToken string
+	Auth      AuthProvider
+	Format    string
+	// LastEventID is the cursor of the stream, sent as Last-Event-ID when reconnecting.
+	LastEventID   string
+	HttpClient    *http.Client
+	RequestsLimit int
+	RequestsCount int
+	URL           string
+	// Fields maps the ID and timestamp of every message received.
+	Fields FieldMapping
+	// CloudEvents makes the client unwrap events whose data are CloudEvents.
+	CloudEvents bool
+}
+
+type StreamSource struct {
+	Name   string
+	Client *StreamClient
+	// Checkpoint saves the Last-Event-ID of the stream when set, so it resumes after a restart.
+	Checkpoint *CheckpointStore
+	// WAL logs every event received before it is checkpointed when set.
+	WAL *WAL
+	// Acks, when set, holds back the checkpoint past an event until every
+	// message of it is stored or dead-lettered.
+	Acks     *AckTracker
+	Messages chan []Message
+	Ticker   time.Ticker
+	fetched  int64
+}
+
+type StreamSourceConfig struct {
+	Name string
+	// URL is the full URL of the stream endpoint.
+	URL               string
+	AuthToken         string
+	Format            string
+	RateLimitDuration time.Duration
+	RequestsLimit     int
+	Auth              AuthConfig
+	TLS               TLSConfig
+	Transport         *Transport
+	Fields            FieldMapping
+	CloudEvents       bool
+	Checkpoint        *CheckpointStore
+	WAL               *WAL
+	Acks              *AckTracker
+}
+
+func NewStreamSource(cfg *StreamSourceConfig) (*StreamSource, error) {
+	if (cfg.AuthToken == "" && cfg.Auth.Type == "") || cfg.URL == "" {
+		return nil, fmt.Errorf("Stream source config: AuthToken and URL cannot be blank. AuthToken: '%v', URL: '%v'", cfg.AuthToken, cfg.URL)
+	}
+
+	if cfg.Format != StreamFormatSSE && cfg.Format != StreamFormatNDJSON {
+		return nil, fmt.Errorf("Stream source config: Format must be '%s' or '%s'. Format: '%v'", StreamFormatSSE, StreamFormatNDJSON, cfg.Format)
+	}
+
+	if cfg.RateLimitDuration == 0 {
+		return nil, fmt.Errorf("Stream source config: RateLimitDuration cannot be 0. RateLimitDuration: %v", cfg.RateLimitDuration)
+	}
+
+	// no client timeout, the response body stays open for as long as the stream does
+	httpClient, err := newHTTPClient(cfg.Transport, 0, &cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	tokenClient, err := newHTTPClient(cfg.Transport, (30 * time.Second), &cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &StreamClient{
+		AuthToken:     cfg.AuthToken,
+		Format:        cfg.Format,
+		HttpClient:    httpClient,
+		RequestsLimit: cfg.RequestsLimit,
+		URL:           cfg.URL,
+		Fields:        cfg.Fields,
+		CloudEvents:   cfg.CloudEvents,
+	}
+	auth, err := newSourceAuth(&cfg.Auth, cfg.AuthToken, tokenClient)
+	if err != nil {
+		return nil, err
+	}
+	client.Auth = auth
+
+	ss := &StreamSource{
+		Name:       cfg.Name,
+		Client:     client,
+		Checkpoint: cfg.Checkpoint,
+		WAL:        cfg.WAL,
+		Acks:       cfg.Acks,
+		Messages:   make(chan []Message),
+		Ticker:     *time.NewTicker(cfg.RateLimitDuration),
+	}
+	if ss.Checkpoint != nil {
+		client.LastEventID = ss.Checkpoint.LoadPosition(ss.checkpointKey())
+	}
+	return ss, nil
+}
+
+func (ss *StreamSource) checkpointKey() string {
+	if ss.Name == "" {
+		return "default"
+	}
+	return ss.Name
+}
+
+// checkpoint saves id, the event ID batch was received with, or with Acks
+// set, once every message of batch and of the events before it is stored or
+// dead-lettered. Without Acks or a WAL the messages in flight when the
+// engine stops are lost, the stream resumes past them.
+func (ss *StreamSource) checkpoint(batch []Message, id string) {
+	if ss.Checkpoint == nil || id == "" {
+		return
+	}
+	ss.Acks.Track(ss.checkpointKey(), batch, func() {
+		if err := ss.Checkpoint.SavePosition(ss.checkpointKey(), id); err != nil {
+			log.Printf("error saving checkpoint for stream source '%s': %s", ss.checkpointKey(), err)
+		}
+	})
+}
+
+func (ss *StreamSource) SetUrl(url string) {
+	ss.Client.URL = url
+}
+
+// Fetched returns the number of messages received from the stream.
+func (ss *StreamSource) Fetched() int64 {
+	return atomic.LoadInt64(&ss.fetched)
+}
+
+// connect opens the stream, resuming after LastEventID if one was received.
+func (c *StreamClient) connect(ctx context.Context) (*http.Response, error) {
+	if c.RequestsLimit > 0 && c.RequestsCount >= c.RequestsLimit {
+		return nil, fmt.Errorf("Reached requests per minute limit, waiting to reconnect")
+	}
+
+	log.Printf("connecting to Source API stream, url: %s, Last-Event-ID: '%s'", c.URL, c.LastEventID)
+	resp, err := doWithAuth(c.HttpClient, c.Auth, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating request %s", err)
+		}
+		if c.Format == StreamFormatSSE {
+			req.Header.Set("Accept", "text/event-stream")
+		} else {
+			req.Header.Set("Accept", "application/x-ndjson")
+		}
+		if c.LastEventID != "" {
+			req.Header.Set("Last-Event-ID", c.LastEventID)
+		}
+		return req, nil
+	})
+	c.RequestsCount++
+	if err != nil {
+		return nil, fmt.Errorf("error sending client request: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		errMsg := fmt.Sprintf("source api stream returned status: %v, requestUrl: %v, responseBody: %v", resp.Status, resp.Request.URL, string(body))
+		return nil, NewHttpError(resp.StatusCode, errMsg)
+	}
+	return resp, nil
+}
+
+// decodeStreamData decodes the payload of one event, a single message or an array of them.
+func decodeStreamData(data []byte) ([]Message, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if data[0] == '[' {
+		var batch []Message
+		err := json.Unmarshal(data, &batch)
+		return batch, err
+	}
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return []Message{msg}, nil
+}
+
+// decode decodes the payload of one event and maps the fields of its messages.
+func (c *StreamClient) decode(data []byte) ([]Message, error) {
+	if c.CloudEvents {
+		var err error
+		if data, err = unwrapCloudEvents(data); err != nil {
+			return nil, err
+		}
+	}
+	batch, err := decodeStreamData(data)
+	if err != nil {
+		return nil, err
+	}
+	// stream sources have no quarantine, the messages that cannot be mapped are logged
+	return c.Fields.apply(batch, nil, ""), nil
+}
+
+// read decodes events from body, calling emit with the messages of every
+// event along with the event ID to resume from.
+func (c *StreamClient) read(body io.Reader, emit func(batch []Message, id string) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+
+	if c.Format == StreamFormatNDJSON {
+		for scanner.Scan() {
+			batch, err := c.decode(scanner.Bytes())
+			if err != nil {
+				log.Printf("WARN: could not unmarshal stream line into Message, line: %s", scanner.Text())
+				continue
+			}
+			if len(batch) == 0 {
+				continue
+			}
+			if err := emit(batch, batch[len(batch)-1].ID); err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	}
+
+	var id string
+	var data bytes.Buffer
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			// a blank line dispatches the event
+			if data.Len() > 0 {
+				batch, err := c.decode(data.Bytes())
+				if err != nil {
+					log.Printf("WARN: could not unmarshal stream event into Message, data: %s", data.String())
+				} else if len(batch) > 0 {
+					if err := emit(batch, id); err != nil {
+						return err
+					}
+				}
+			}
+			data.Reset()
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// comment, usually a keep-alive
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			id = value
+		case "data":
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+		}
+	}
+	return scanner.Err()
+}
+
+// stream consumes one connection until it ends, returning how many events were received.
+func (ss *StreamSource) stream(ctx context.Context) (int, error) {
+	resp, err := ss.Client.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer drainAndClose(resp.Body)
+
+	events := 0
+	err = ss.Client.read(resp.Body, func(batch []Message, id string) error {
+		if ss.Name != "" {
+			for i := range batch {
+				batch[i].SourceName = ss.Name
+			}
+		}
+		// the batch is logged before the event ID past it is checkpointed, so a crash cannot lose it
+		logged := true
+		if err := ss.WAL.Append(batch); err != nil {
+			log.Printf("error writing event of stream source '%s' to the WAL, not checkpointing it: %s", ss.checkpointKey(), err)
+			logged = false
+		}
+		// tracked before the batch is sent, its messages may be stored before the send returns
+		if logged && ss.Acks != nil {
+			ss.checkpoint(batch, id)
+		}
+		select {
+		case ss.Messages <- batch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if logged && ss.Acks == nil {
+			ss.checkpoint(batch, id)
+		}
+		events++
+		atomic.AddInt64(&ss.fetched, int64(len(batch)))
+		if id != "" {
+			ss.Client.LastEventID = id
+		}
+		return nil
+	})
+	if err == nil {
+		err = fmt.Errorf("source api stream closed by server")
+	}
+	return events, err
+}
+
+// Run keeps the stream connected, reconnecting with exponential backoff from
+// Last-Event-ID, until cancel receives.
+func (ss *StreamSource) Run(cancel <-chan bool) {
+	log.Printf("Stream source '%s' started.", ss.Name)
+	wait := errWaitTime
+	for {
+		ctx, stop := context.WithCancel(context.Background())
+		type result struct {
+			events int
+			err    error
+		}
+		done := make(chan result, 1)
+		go func() {
+			events, err := ss.stream(ctx)
+			done <- result{events, err}
+		}()
+
+		var res result
+		select {
+		case res = <-done:
+			stop()
+		case <-cancel:
+			stop()
+			<-done
+			log.Println("Stream source received cancel signal. Stopping service.")
+			close(ss.Messages)
+			return
+		}
+
+		if res.events > 0 {
+			wait = errWaitTime
+		}
+		log.Printf("%s, reconnecting in %v", res.err, wait)
+
+		timer := time.NewTimer(wait)
+	waiting:
+		for {
+			select {
+			case <-ss.Ticker.C:
+				ss.Client.RequestsCount = 0
+			case <-timer.C:
+				break waiting
+			case <-cancel:
+				timer.Stop()
+				log.Println("Stream source received cancel signal. Stopping service.")
+				close(ss.Messages)
+				return
+			}
+		}
+
+		wait *= 2
+		if wait > backoffDuration {
+			wait = backoffDuration
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+var streamCfg = engine.StreamSourceConfig{
+	Name:              "stream",
+	URL:               "testurl",
+	AuthToken:         "testtoken",
+	Format:            engine.StreamFormatSSE,
+	RateLimitDuration: (60 * time.Second),
+	RequestsLimit:     120,
+}
+
+func TestNewStreamSource(t *testing.T) {
+	t.Run("should return a new source", func(t *testing.T) {
+		ss, err := engine.NewStreamSource(&streamCfg)
+		if err != nil {
+			t.Errorf("new config should not return error when all fields are set. err: %s", err)
+		}
+		if ss == nil {
+			t.Error("source should not be nil")
+		}
+	})
+
+	t.Run("bad configs", func(t *testing.T) {
+		noToken := streamCfg
+		noToken.AuthToken = ""
+		badFormat := streamCfg
+		badFormat.Format = "xml"
+
+		for name, badConfig := range map[string]engine.StreamSourceConfig{"no auth token": noToken, "bad format": badFormat} {
+			badConfig := badConfig
+			if _, err := engine.NewStreamSource(&badConfig); err == nil {
+				t.Errorf("Test - %s: expected an error", name)
+			}
+		}
+	})
+}
+
+func TestStreamSourceRun(t *testing.T) {
+	msgs := test_utils.GenerateMockMessages(3)
+
+	tests := map[string]struct {
+		format string
+		write  func(w http.ResponseWriter, msgs []engine.Message)
+	}{
+		"sse": {
+			format: engine.StreamFormatSSE,
+			write: func(w http.ResponseWriter, msgs []engine.Message) {
+				fmt.Fprint(w, ": keep-alive\n\n")
+				for i, msg := range msgs {
+					data, _ := json.Marshal(msg)
+					fmt.Fprintf(w, "id: event-%d\nevent: message\ndata: %s\n\n", i, data)
+				}
+			},
+		},
+		"ndjson": {
+			format: engine.StreamFormatNDJSON,
+			write: func(w http.ResponseWriter, msgs []engine.Message) {
+				for _, msg := range msgs {
+					data, _ := json.Marshal(msg)
+					fmt.Fprintf(w, "%s\n", data)
+				}
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			var lastEventIDs, tokens []string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				lastEventIDs = append(lastEventIDs, req.Header.Get("Last-Event-ID"))
+				tokens = append(tokens, req.Header.Get("X-Auth-Token"))
+				connection := len(lastEventIDs)
+				mu.Unlock()
+
+				// the first connection drops after two messages, the reconnect resumes with the third
+				if connection == 1 {
+					test.write(w, msgs[:2])
+					return
+				}
+				test.write(w, msgs[2:])
+				w.(http.Flusher).Flush()
+				<-req.Context().Done()
+			}))
+			defer ts.Close()
+
+			cfgCopy := streamCfg
+			cfgCopy.Format = test.format
+			cfgCopy.URL = ts.URL
+			ss, _ := engine.NewStreamSource(&cfgCopy)
+
+			cancel := make(chan bool)
+			go ss.Run(cancel)
+
+			for i, msg := range msgs {
+				select {
+				case batch := <-ss.Messages:
+					if batch[0].ID != msg.ID {
+						t.Errorf("expected message %d to be messageID='%s', got '%s'", i, msg.ID, batch[0].ID)
+					}
+					if batch[0].SourceName != cfgCopy.Name {
+						t.Errorf("expected messages to be tagged with '%s', got '%s'", cfgCopy.Name, batch[0].SourceName)
+					}
+				case <-time.After(3 * time.Second):
+					t.Fatalf("expected message %d to be streamed", i)
+				}
+			}
+			close(cancel)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(lastEventIDs) != 2 {
+				t.Fatalf("expected the source to reconnect once, got %d connections", len(lastEventIDs))
+			}
+			expected := msgs[1].ID
+			if test.format == engine.StreamFormatSSE {
+				expected = "event-1"
+			}
+			if lastEventIDs[0] != "" || lastEventIDs[1] != expected {
+				t.Errorf("expected Last-Event-ID '' then '%s', got %q", expected, lastEventIDs)
+			}
+			for _, token := range tokens {
+				if token != cfgCopy.AuthToken {
+					t.Errorf("expected X-Auth-Token '%s' on every connection, got '%s'", cfgCopy.AuthToken, token)
+				}
+			}
+			if ss.Fetched() != int64(len(msgs)) {
+				t.Errorf("expected %d messages fetched, got %d", len(msgs), ss.Fetched())
+			}
+		})
+	}
+}
+
+func TestStreamSourceCheckpoint(t *testing.T) {
+	msgs := test_utils.GenerateMockMessages(2)
+	var mu sync.Mutex
+	var lastEventIDs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		lastEventIDs = append(lastEventIDs, req.Header.Get("Last-Event-ID"))
+		mu.Unlock()
+		for i, msg := range msgs {
+			data, _ := json.Marshal(msg)
+			fmt.Fprintf(w, "id: event-%d\ndata: %s\n\n", i, data)
+		}
+		w.(http.Flusher).Flush()
+		<-req.Context().Done()
+	}))
+	defer ts.Close()
+
+	cfgCopy := streamCfg
+	cfgCopy.URL = ts.URL
+	cfgCopy.Checkpoint, _ = engine.NewCheckpointStore(filepath.Join(t.TempDir(), "checkpoints.json"))
+	cfgCopy.Acks = engine.NewAckTracker()
+	ss, _ := engine.NewStreamSource(&cfgCopy)
+
+	cancel := make(chan bool)
+	go ss.Run(cancel)
+	var received [][]engine.Message
+	for range msgs {
+		select {
+		case batch := <-ss.Messages:
+			received = append(received, batch)
+		case <-time.After(3 * time.Second):
+			t.Fatal("expected the events to be streamed")
+		}
+	}
+	close(cancel)
+
+	cfgCopy.Acks.Ack(&received[0][0])
+	if id := cfgCopy.Checkpoint.LoadPosition(cfgCopy.Name); id != "event-0" {
+		t.Errorf("expected the checkpoint to stop at the last event stored, got '%s'", id)
+	}
+	cfgCopy.Acks.Ack(&received[1][0])
+	if id := cfgCopy.Checkpoint.LoadPosition(cfgCopy.Name); id != "event-1" {
+		t.Errorf("expected the checkpoint to move to the last event once stored, got '%s'", id)
+	}
+
+	// a restarted source resumes after the checkpointed event
+	restarted, _ := engine.NewStreamSource(&cfgCopy)
+	if restarted.Client.LastEventID != "event-1" {
+		t.Errorf("expected the restarted source to resume from 'event-1', got '%s'", restarted.Client.LastEventID)
+	}
+}
@@ -0,0 +1,206 @@
+package engine
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig configures the TLS connections of a client. Certificates and the
+// CA bundle are re-read from disk when they change, so they can be rotated
+// without a restart.
+type TLSConfig struct {
+	// CAFile is a PEM bundle replacing the system roots when set.
+	CAFile string `yaml:"caFile"`
+	// CertFile and KeyFile are the PEM client certificate and key for mTLS.
+	CertFile   string `yaml:"certFile"`
+	KeyFile    string `yaml:"keyFile"`
+	ServerName string `yaml:"serverName"`
+	// MinVersion is one of "1.0", "1.1", "1.2" or "1.3", default 1.2.
+	MinVersion string `yaml:"minVersion"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (cfg *TLSConfig) isSet() bool {
+	return *cfg != TLSConfig{}
+}
+
+func newTLSClientConfig(cfg *TLSConfig) (*tls.Config, error) {
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, fmt.Errorf("TLS config: CertFile and KeyFile must be set together. CertFile: '%v', KeyFile: '%v'", cfg.CertFile, cfg.KeyFile)
+	}
+
+	tlsConfig := &tls.Config{ServerName: cfg.ServerName}
+	if cfg.MinVersion != "" {
+		version, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("TLS config: unknown MinVersion '%s'", cfg.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	r := &certReloader{cfg: *cfg}
+	if err := r.reload(); err != nil {
+		return nil, fmt.Errorf("TLS config: %s", err)
+	}
+	if cfg.CertFile != "" {
+		tlsConfig.GetClientCertificate = r.clientCertificate
+	}
+	if cfg.CAFile != "" {
+		// the standard verification is replaced by one against the
+		// current CA bundle, which may have been rotated
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = r.verifyConnection
+	}
+	return tlsConfig, nil
+}
+
+// certReloader keeps the client certificate and CA pool of a TLSConfig,
+// reloading them when their files change.
+type certReloader struct {
+	cfg     TLSConfig
+	mu      sync.Mutex
+	modTime map[string]time.Time
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+// reload reads the files of the config that changed since they were last read.
+func (r *certReloader) reload() error {
+	changed := func(path string) (bool, error) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		if r.modTime == nil {
+			r.modTime = make(map[string]time.Time)
+		}
+		if r.modTime[path].Equal(info.ModTime()) {
+			return false, nil
+		}
+		r.modTime[path] = info.ModTime()
+		return true, nil
+	}
+
+	if r.cfg.CAFile != "" {
+		ok, err := changed(r.cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("could not read CA file '%s': %s", r.cfg.CAFile, err)
+		}
+		if ok {
+			pem, err := os.ReadFile(r.cfg.CAFile)
+			if err != nil {
+				return fmt.Errorf("could not read CA file '%s': %s", r.cfg.CAFile, err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				delete(r.modTime, r.cfg.CAFile)
+				return fmt.Errorf("no certificates found in CA file '%s'", r.cfg.CAFile)
+			}
+			r.pool = pool
+		}
+	}
+
+	if r.cfg.CertFile != "" {
+		certChanged, err := changed(r.cfg.CertFile)
+		if err != nil {
+			return fmt.Errorf("could not read certificate file '%s': %s", r.cfg.CertFile, err)
+		}
+		keyChanged, err := changed(r.cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("could not read key file '%s': %s", r.cfg.KeyFile, err)
+		}
+		if certChanged || keyChanged {
+			cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+			if err != nil {
+				// retried on the next handshake, the pair may be half written
+				delete(r.modTime, r.cfg.CertFile)
+				return fmt.Errorf("could not load client certificate: %s", err)
+			}
+			r.cert = &cert
+		}
+	}
+	return nil
+}
+
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reload(); err != nil {
+		log.Printf("error reloading TLS files, using the previous ones. Error: %s", err)
+	}
+	return r.cert, r.pool
+}
+
+func (r *certReloader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, _ := r.current()
+	return cert, nil
+}
+
+func (r *certReloader) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("server presented no certificate")
+	}
+	if cs.ServerName == "" {
+		return fmt.Errorf("no server name to verify the certificate against, set serverName")
+	}
+	_, pool := r.current()
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// dialTLS returns the DialTLSContext of a pool with a CA file. The handshake
+// is done here rather than by the pool so the certificate is verified against
+// the host dialled when no ServerName is configured: crypto/tls leaves IP
+// addresses out of the connection state, which would skip the host check.
+func dialTLS(pool *http.Transport, dial func(ctx context.Context, network, addr string) (net.Conn, error), timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := pool.TLSClientConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = host
+		}
+		serverName, verify := cfg.ServerName, cfg.VerifyConnection
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			cs.ServerName = serverName
+			return verify(cs)
+		}
+		tlsConn := tls.Client(conn, cfg)
+		handshakeCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
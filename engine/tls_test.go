@@ -0,0 +1,244 @@
+package engine_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+// writeCertificate writes a PEM certificate, signed by parent when one is
+// given, and its key to dir, returning the parsed certificate and key.
+func writeCertificate(t *testing.T, dir, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		// unconstrained, so it can sign server certificates too
+		template.ExtKeyUsage = nil
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func writeServerCA(t *testing.T, ts *httptest.Server, path string) {
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+}
+
+func TestTLSCustomCA(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, engine.ProcessedMessage{})
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	writeServerCA(t, ts, caFile)
+	writeCertificate(t, dir, "other-ca", 1, nil, nil)
+
+	tests := map[string]struct {
+		tls engine.TLSConfig
+		ok  bool
+	}{
+		"system roots":        {engine.TLSConfig{MinVersion: "1.2"}, false},
+		"custom CA":           {engine.TLSConfig{CAFile: caFile}, true},
+		"server name":         {engine.TLSConfig{CAFile: caFile, ServerName: "example.com"}, true},
+		"wrong server name":   {engine.TLSConfig{CAFile: caFile, ServerName: "collection-engine.test"}, false},
+		"untrusted server CA": {engine.TLSConfig{CAFile: filepath.Join(dir, "other-ca.crt")}, false},
+	}
+	for name, tc := range tests {
+		cfg := pcfg
+		cfg.URL = ts.URL
+		cfg.TLS = tc.tls
+		ps, err := engine.NewProcessingService(&cfg)
+		if err != nil {
+			t.Fatalf("Test - %s: should not return error, err: %s", name, err)
+		}
+		msg := test_utils.GenerateMockMessages(1)[0]
+		_, err = ps.Client.PostMessage(&msg)
+		if tc.ok && err != nil {
+			t.Errorf("Test - %s: expected the request to succeed, err: %s", name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("Test - %s: expected the TLS handshake to fail", name)
+		}
+	}
+}
+
+func TestTLSCustomCAIPHost(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCertificate(t, dir, "server-ca", 1, nil, nil)
+	caFile := filepath.Join(dir, "server-ca.crt")
+
+	// signed by the configured CA, but for another host than the one dialled
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "evil.example"},
+		DNSNames:     []string{"evil.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, engine.ProcessedMessage{})
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	tests := map[string]struct {
+		tls engine.TLSConfig
+		ok  bool
+	}{
+		"IP host":     {engine.TLSConfig{CAFile: caFile}, false},
+		"server name": {engine.TLSConfig{CAFile: caFile, ServerName: "evil.example"}, true},
+	}
+	for name, tc := range tests {
+		cfg := pcfg
+		cfg.URL = ts.URL
+		cfg.TLS = tc.tls
+		ps, err := engine.NewProcessingService(&cfg)
+		if err != nil {
+			t.Fatalf("Test - %s: should not return error, err: %s", name, err)
+		}
+		msg := test_utils.GenerateMockMessages(1)[0]
+		_, err = ps.Client.PostMessage(&msg)
+		if tc.ok && err != nil {
+			t.Errorf("Test - %s: expected the request to succeed, err: %s", name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("Test - %s: expected a certificate for another host to be rejected", name)
+		}
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	ts.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	writeServerCA(t, ts, caFile)
+
+	for version, ok := range map[string]bool{"1.2": true, "1.3": false} {
+		cfg := scfg
+		cfg.URL = ts.URL
+		cfg.TLS = engine.TLSConfig{CAFile: caFile, MinVersion: version}
+		ss, _ := engine.NewStorageService(&cfg)
+		msg := engine.ProcessedMessage{test_utils.GenerateMockMessages(1)[0], time.Now().UTC().String()}
+		err := ss.Client.PostMessage(&msg)
+		if ok != (err == nil) {
+			t.Errorf("Test - min version %s: expected success %v, err: %v", version, ok, err)
+		}
+	}
+}
+
+func TestMutualTLSCertificateRotation(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCertificate(t, dir, "client-ca", 1, nil, nil)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+
+	var mu sync.Mutex
+	var serials []int64
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		serials = append(serials, req.TLS.PeerCertificates[0].SerialNumber.Int64())
+		mu.Unlock()
+		// a new connection per request, so every request shows the current certificate
+		w.Header().Set("Connection", "close")
+		writeJSON(w, engine.MessageResponse{Results: test_utils.GenerateMockMessages(1)})
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	writeServerCA(t, ts, caFile)
+	writeCertificate(t, dir, "client", 10, ca, caKey)
+
+	ss, err := engine.NewSourceService(&engine.SourceServiceConfig{
+		URL:               ts.URL,
+		AuthToken:         "test",
+		ClientTimeout:     time.Second,
+		RateLimitDuration: time.Minute,
+		TLS: engine.TLSConfig{
+			CAFile:   caFile,
+			CertFile: filepath.Join(dir, "client.crt"),
+			KeyFile:  filepath.Join(dir, "client.key"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("should not return error with a client certificate, err: %s", err)
+	}
+
+	ss.HandleGetMessages()
+	// the modification time must move for the rotation to be noticed
+	time.Sleep(10 * time.Millisecond)
+	writeCertificate(t, dir, "client", 11, ca, caKey)
+	ss.HandleGetMessages()
+
+	if len(serials) != 2 || serials[0] != 10 || serials[1] != 11 {
+		t.Errorf("expected the rotated client certificate to be presented, got serials %v", serials)
+	}
+}
+
+func TestTLSBadConfigs(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, dir, "client", 1, nil, nil)
+	os.WriteFile(filepath.Join(dir, "empty.crt"), []byte("not a certificate"), 0600)
+
+	tests := map[string]engine.TLSConfig{
+		"unknown version":   {MinVersion: "1.4"},
+		"cert without key":  {CertFile: filepath.Join(dir, "client.crt")},
+		"missing CA file":   {CAFile: filepath.Join(dir, "missing.crt")},
+		"empty CA file":     {CAFile: filepath.Join(dir, "empty.crt")},
+		"mismatched key":    {CertFile: filepath.Join(dir, "client.crt"), KeyFile: filepath.Join(dir, "empty.crt")},
+		"missing cert file": {CertFile: filepath.Join(dir, "missing.crt"), KeyFile: filepath.Join(dir, "client.key")},
+	}
+	for name, tlsCfg := range tests {
+		cfg := pcfg
+		cfg.TLS = tlsCfg
+		if _, err := engine.NewProcessingService(&cfg); err == nil {
+			t.Errorf("Test - %s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package engine
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 32
+	defaultIdleConnTimeout     = (90 * time.Second)
+	defaultKeepAlive           = (30 * time.Second)
+	defaultDialTimeout         = (10 * time.Second)
+	defaultTLSHandshakeTimeout = (10 * time.Second)
+
+	// maxDrainBytes bounds how much of an unread response body is read so
+	// its connection can be reused, larger bodies close the connection instead.
+	maxDrainBytes = 64 << 10
+)
+
+// TransportConfig tunes the connection pool shared by the HTTP clients. Zero
+// values use the defaults above.
+type TransportConfig struct {
+	MaxIdleConns        int           `yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost int           `yaml:"maxIdleConnsPerHost"`
+	MaxConnsPerHost     int           `yaml:"maxConnsPerHost"`
+	IdleConnTimeout     time.Duration `yaml:"idleConnTimeout"`
+	KeepAlive           time.Duration `yaml:"keepAlive"`
+	DialTimeout         time.Duration `yaml:"dialTimeout"`
+	TLSHandshakeTimeout time.Duration `yaml:"tlsHandshakeTimeout"`
+	DisableHTTP2        bool          `yaml:"disableHttp2"`
+}
+
+// TransportStats counts the requests and connections of a Transport.
+type TransportStats struct {
+	Requests    int64 `json:"requests"`
+	InFlight    int64 `json:"inFlight"`
+	ReusedConns int64 `json:"reusedConns"`
+	Dials       int64 `json:"dials"`
+	DialErrors  int64 `json:"dialErrors"`
+	OpenConns   int64 `json:"openConns"`
+	// Pools is the number of connection pools, one per distinct TLS config.
+	Pools int `json:"pools"`
+}
+
+// Transport hands out HTTP clients that share connection pools. Clients
+// with the same TLS settings share one pool.
+type Transport struct {
+	cfg   TransportConfig
+	mu    sync.Mutex
+	pools map[TLSConfig]*http.Transport
+
+	requests    int64
+	inFlight    int64
+	reusedConns int64
+	dials       int64
+	dialErrors  int64
+	openConns   int64
+}
+
+var (
+	defaultTransportOnce sync.Once
+	defaultTransport     *Transport
+)
+
+// DefaultTransport is the Transport of clients that were not given one.
+func DefaultTransport() *Transport {
+	defaultTransportOnce.Do(func() {
+		defaultTransport = NewTransport(&TransportConfig{})
+	})
+	return defaultTransport
+}
+
+func NewTransport(cfg *TransportConfig) *Transport {
+	t := &Transport{
+		cfg:   *cfg,
+		pools: make(map[TLSConfig]*http.Transport),
+	}
+	if t.cfg.MaxIdleConns == 0 {
+		t.cfg.MaxIdleConns = defaultMaxIdleConns
+	}
+	if t.cfg.MaxIdleConnsPerHost == 0 {
+		t.cfg.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if t.cfg.IdleConnTimeout == 0 {
+		t.cfg.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if t.cfg.KeepAlive == 0 {
+		t.cfg.KeepAlive = defaultKeepAlive
+	}
+	if t.cfg.DialTimeout == 0 {
+		t.cfg.DialTimeout = defaultDialTimeout
+	}
+	if t.cfg.TLSHandshakeTimeout == 0 {
+		t.cfg.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+	return t
+}
+
+// Client returns a client with the given timeout sending its requests
+// through the pool for tlsCfg.
+func (t *Transport) Client(timeout time.Duration, tlsCfg *TLSConfig) (*http.Client, error) {
+	pool, err := t.pool(tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Timeout: timeout, Transport: &countingRoundTripper{t: t, base: pool}}, nil
+}
+
+func (t *Transport) pool(tlsCfg *TLSConfig) (*http.Transport, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if pool, ok := t.pools[*tlsCfg]; ok {
+		return pool, nil
+	}
+
+	dialer := &net.Dialer{Timeout: t.cfg.DialTimeout, KeepAlive: t.cfg.KeepAlive}
+	pool := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           t.dialContext(dialer),
+		ForceAttemptHTTP2:     !t.cfg.DisableHTTP2,
+		MaxIdleConns:          t.cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   t.cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       t.cfg.MaxConnsPerHost,
+		IdleConnTimeout:       t.cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   t.cfg.TLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if tlsCfg.isSet() {
+		tlsConfig, err := newTLSClientConfig(tlsCfg)
+		if err != nil {
+			return nil, err
+		}
+		pool.TLSClientConfig = tlsConfig
+		if tlsCfg.CAFile != "" {
+			pool.DialTLSContext = dialTLS(pool, pool.DialContext, t.cfg.TLSHandshakeTimeout)
+		}
+	}
+	t.pools[*tlsCfg] = pool
+	return pool, nil
+}
+
+// Stats returns the request and connection counts of every pool.
+func (t *Transport) Stats() TransportStats {
+	t.mu.Lock()
+	pools := len(t.pools)
+	t.mu.Unlock()
+	return TransportStats{
+		Requests:    atomic.LoadInt64(&t.requests),
+		InFlight:    atomic.LoadInt64(&t.inFlight),
+		ReusedConns: atomic.LoadInt64(&t.reusedConns),
+		Dials:       atomic.LoadInt64(&t.dials),
+		DialErrors:  atomic.LoadInt64(&t.dialErrors),
+		OpenConns:   atomic.LoadInt64(&t.openConns),
+		Pools:       pools,
+	}
+}
+
+// CloseIdleConnections closes the idle connections of every pool.
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, pool := range t.pools {
+		pool.CloseIdleConnections()
+	}
+}
+
+func (t *Transport) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt64(&t.dials, 1)
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			atomic.AddInt64(&t.dialErrors, 1)
+			return nil, err
+		}
+		atomic.AddInt64(&t.openConns, 1)
+		return &countedConn{Conn: conn, t: t}, nil
+	}
+}
+
+// countedConn decrements the open connection count once when closed.
+type countedConn struct {
+	net.Conn
+	t    *Transport
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.t.openConns, -1) })
+	return c.Conn.Close()
+}
+
+type countingRoundTripper struct {
+	t    *Transport
+	base *http.Transport
+}
+
+func (rt *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&rt.t.requests, 1)
+	atomic.AddInt64(&rt.t.inFlight, 1)
+	defer atomic.AddInt64(&rt.t.inFlight, -1)
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&rt.t.reusedConns, 1)
+			}
+		},
+	}
+	return rt.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// newHTTPClient returns a client of transport, or of the DefaultTransport
+// when transport is nil.
+func newHTTPClient(transport *Transport, timeout time.Duration, tlsCfg *TLSConfig) (*http.Client, error) {
+	if transport == nil {
+		transport = DefaultTransport()
+	}
+	return transport.Client(timeout, tlsCfg)
+}
+
+// drainAndClose reads what is left of body, up to maxDrainBytes, and closes
+// it so the connection goes back to the pool.
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, maxDrainBytes))
+	body.Close()
+}
@@ -0,0 +1,125 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+func TestSharedTransportReusesConnections(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// larger than a single read, so only a drained body frees the connection
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(strings.Repeat("x", 8192)))
+	}))
+	defer ts.Close()
+
+	transport := engine.NewTransport(&engine.TransportConfig{})
+	cfg := scfg
+	cfg.URL = ts.URL
+	cfg.Transport = transport
+
+	// two services of one downstream share the pool
+	first, _ := engine.NewStorageService(&cfg)
+	second, _ := engine.NewStorageService(&cfg)
+
+	msg := engine.ProcessedMessage{test_utils.GenerateMockMessages(1)[0], time.Now().UTC().String()}
+	for i := 0; i < 3; i++ {
+		if err := first.Client.PostMessage(&msg); err != nil {
+			t.Fatalf("should not return error, err: %s", err)
+		}
+		if err := second.Client.PostMessage(&msg); err != nil {
+			t.Fatalf("should not return error, err: %s", err)
+		}
+	}
+
+	stats := transport.Stats()
+	if stats.Requests != 6 || stats.InFlight != 0 {
+		t.Errorf("expected 6 finished requests, got %+v", stats)
+	}
+	if stats.Dials != 1 || stats.ReusedConns != 5 || stats.OpenConns != 1 {
+		t.Errorf("expected every request after the first to reuse one connection, got %+v", stats)
+	}
+	if stats.Pools != 1 {
+		t.Errorf("expected clients without TLS settings to share one pool, got %d", stats.Pools)
+	}
+
+	transport.CloseIdleConnections()
+	if stats := transport.Stats(); stats.OpenConns != 0 {
+		t.Errorf("expected closing idle connections to close the pooled one, got %d open", stats.OpenConns)
+	}
+}
+
+func TestSharedTransportHTTP2(t *testing.T) {
+	var protos []string
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		protos = append(protos, req.Proto)
+		writeJSON(w, engine.ProcessedMessage{})
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	writeServerCA(t, ts, caFile)
+
+	for _, disabled := range []bool{false, true} {
+		transport := engine.NewTransport(&engine.TransportConfig{DisableHTTP2: disabled})
+		cfg := pcfg
+		cfg.URL = ts.URL
+		cfg.TLS = engine.TLSConfig{CAFile: caFile}
+		cfg.Transport = transport
+		ps, err := engine.NewProcessingService(&cfg)
+		if err != nil {
+			t.Fatalf("should not return error, err: %s", err)
+		}
+		msg := test_utils.GenerateMockMessages(1)[0]
+		if _, err := ps.Client.PostMessage(&msg); err != nil {
+			t.Fatalf("should not return error, err: %s", err)
+		}
+	}
+
+	if len(protos) != 2 || protos[0] != "HTTP/2.0" || protos[1] != "HTTP/1.1" {
+		t.Errorf("expected HTTP/2 unless disabled, got %v", protos)
+	}
+}
+
+func TestTransportPoolsPerTLSConfig(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	writeServerCA(t, ts, caFile)
+
+	transport := engine.NewTransport(&engine.TransportConfig{})
+	tlsCfg := engine.TLSConfig{CAFile: caFile}
+	for _, c := range []*engine.TLSConfig{{}, &tlsCfg, &tlsCfg, {}} {
+		if _, err := transport.Client(time.Second, c); err != nil {
+			t.Fatalf("should not return error, err: %s", err)
+		}
+	}
+	if pools := transport.Stats().Pools; pools != 2 {
+		t.Errorf("expected a pool per distinct TLS config, got %d", pools)
+	}
+}
+
+func TestAdminTransportStats(t *testing.T) {
+	ce := engine.NewCollectionEngine(test_utils.BuildCollectionEngineConfig(1, 120, 60))
+	admin := engine.NewAdminServer("127.0.0.1:0", ce)
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/transport", nil))
+	var stats engine.TransportStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("expected transport stats, got %d: %s", w.Code, w.Body.String())
+	}
+	if stats.Pools != 1 {
+		t.Errorf("expected the engine's clients to share one pool, got %+v", stats)
+	}
+}
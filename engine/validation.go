@@ -0,0 +1,225 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// ErrQuarantined is wrapped by the errors of payloads sent to quarantine.
+// Stages do not retry them, retrying an invalid payload cannot fix it.
+var ErrQuarantined = errors.New("payload quarantined")
+
+// Schema is a compiled JSON Schema.
+type Schema struct {
+	Path   string
+	schema *jsonschema.Schema
+}
+
+// LoadSchema compiles the JSON Schema file at path.
+func LoadSchema(path string) (*Schema, error) {
+	schema, err := jsonschema.Compile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error loading JSON schema '%s': %s", path, err)
+	}
+	return &Schema{Path: path, schema: schema}, nil
+}
+
+// Validate returns the validation errors of doc, none when it is valid.
+func (s *Schema) Validate(doc []byte) []string {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return []string{fmt.Sprintf("invalid JSON: %s", err)}
+	}
+
+	err := s.schema.Validate(v)
+	if err == nil {
+		return nil
+	}
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return []string{err.Error()}
+	}
+	var errs []string
+	for _, unit := range ve.BasicOutput().Errors {
+		// the causes carry the details, their parents only summarise them
+		if unit.Error == "" || strings.HasPrefix(unit.Error, "doesn't validate with") {
+			continue
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", paramOrDefault(unit.InstanceLocation, "/"), unit.Error))
+	}
+	if len(errs) == 0 {
+		errs = append(errs, ve.Message)
+	}
+	// the order of the causes depends on the schema's map of keywords
+	sort.Strings(errs)
+	return errs
+}
+
+// QuarantineEntry is an invalid payload along with why it was rejected.
+type QuarantineEntry struct {
+	Time   time.Time `json:"time"`
+	Stage  string    `json:"stage"`
+	Source string    `json:"source,omitempty"`
+	ID     string    `json:"id,omitempty"`
+	Errors []string  `json:"errors"`
+	// Document is the rejected payload, as received when it is valid JSON and quoted otherwise.
+	Document json.RawMessage `json:"document"`
+}
+
+// Quarantine is an append-only file of invalid payloads, one JSON entry per
+// line. With no file every entry is logged instead.
+type Quarantine struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	count int64
+}
+
+func NewQuarantine(path string) (*Quarantine, error) {
+	q := &Quarantine{path: path}
+	if path == "" {
+		return q, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening quarantine '%s': %s", path, err)
+	}
+	q.file = f
+	return q, nil
+}
+
+// Put records entry and returns the error handed back to the stage that rejected it.
+// A nil quarantine only logs entry.
+func (q *Quarantine) Put(entry QuarantineEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	if !json.Valid(entry.Document) {
+		entry.Document, _ = json.Marshal(string(entry.Document))
+	}
+	log.Printf("quarantined messageID='%s' from %s: %v", entry.ID, entry.Stage, entry.Errors)
+
+	if q != nil {
+		atomic.AddInt64(&q.count, 1)
+	}
+	if q != nil && q.file != nil {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		q.mu.Lock()
+		_, err = q.file.Write(append(line, '\n'))
+		q.mu.Unlock()
+		if err != nil {
+			log.Printf("error writing to quarantine '%s'. Error: %s", q.path, err)
+		}
+	}
+	return fmt.Errorf("%w: messageID='%s' failed %s validation: %v", ErrQuarantined, entry.ID, entry.Stage, entry.Errors)
+}
+
+// Count is the number of payloads quarantined since the engine started.
+func (q *Quarantine) Count() int64 {
+	if q == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&q.count)
+}
+
+func (q *Quarantine) Close() error {
+	if q.file == nil {
+		return nil
+	}
+	return q.file.Close()
+}
+
+// Validator checks payloads against a schema, quarantining the invalid ones.
+type Validator struct {
+	Stage      string
+	Source     string
+	Schema     *Schema
+	Quarantine *Quarantine
+	// IDField is the path of the ID in the documents checked, "id" when blank.
+	IDField string
+}
+
+// newValidator returns the validator of a stage, nil when it has no schema.
+// Without a quarantine the rejected payloads are only logged.
+func newValidator(stage, source, schemaPath string, quarantine *Quarantine) (*Validator, error) {
+	if schemaPath == "" {
+		return nil, nil
+	}
+	schema, err := LoadSchema(schemaPath)
+	if err != nil {
+		return nil, err
+	}
+	if quarantine == nil {
+		quarantine, _ = NewQuarantine("")
+	}
+	return &Validator{Stage: stage, Source: source, Schema: schema, Quarantine: quarantine}, nil
+}
+
+// check returns nil when doc is valid, and the quarantine error otherwise.
+// A nil validator accepts everything.
+func (v *Validator) check(id string, doc []byte) error {
+	if v == nil || v.Schema == nil {
+		return nil
+	}
+	errs := v.Schema.Validate(doc)
+	if len(errs) == 0 {
+		return nil
+	}
+	return v.reject(id, doc, errs)
+}
+
+func (v *Validator) reject(id string, doc []byte, errs []string) error {
+	return v.Quarantine.Put(QuarantineEntry{Stage: v.Stage, Source: v.Source, ID: id, Errors: errs, Document: doc})
+}
+
+// decodeMessages decodes an array of message documents, quarantining those
+// that are invalid or cannot be decoded.
+func (v *Validator) decodeMessages(results json.RawMessage) ([]Message, error) {
+	var docs []json.RawMessage
+	if err := json.Unmarshal(results, &docs); err != nil {
+		return nil, err
+	}
+	msgs := make([]Message, 0, len(docs))
+	for _, doc := range docs {
+		id := documentID(doc, v.IDField)
+		if err := v.check(id, doc); err != nil {
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal(doc, &msg); err != nil {
+			v.reject(id, doc, []string{err.Error()})
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// documentID returns the text of the ID at path of doc, "id" by default, blank when there is none.
+func documentID(doc json.RawMessage, path string) string {
+	raw, err := lookupField(doc, paramOrDefault(path, "id"))
+	if err != nil || raw == nil {
+		return ""
+	}
+	id, err := cursorString(raw)
+	if err != nil {
+		return ""
+	}
+	return id
+}
@@ -0,0 +1,184 @@
+package engine_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+const messageSchema = `{
+	"type": "object",
+	"required": ["id", "creation_date"],
+	"properties": {
+		"id": {"type": "string", "minLength": 1},
+		"creation_date": {"type": "string", "format": "date-time"},
+		"tags": {"type": "array", "items": {"type": "string"}}
+	}
+}`
+
+func writeSchema(t *testing.T, schema string) string {
+	path := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(path, []byte(schema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readQuarantine(t *testing.T, path string) []engine.QuarantineEntry {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []engine.QuarantineEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry engine.QuarantineEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid quarantine line %s: %s", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := engine.LoadSchema(writeSchema(t, messageSchema))
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	if errs := schema.Validate([]byte(`{"id": "1", "creation_date": "2030-01-01T00:00:00Z", "extra": 1}`)); len(errs) != 0 {
+		t.Errorf("expected a valid document, got %v", errs)
+	}
+	errs := schema.Validate([]byte(`{"id": "", "creation_date": "2030-01-01T00:00:00Z", "tags": ["a", 2]}`))
+	if len(errs) != 2 || !strings.HasPrefix(errs[0], "/id:") || !strings.HasPrefix(errs[1], "/tags/1:") {
+		t.Errorf("expected an error per invalid field, got %v", errs)
+	}
+	if errs := schema.Validate([]byte(`{"id": `)); len(errs) != 1 || !strings.HasPrefix(errs[0], "invalid JSON") {
+		t.Errorf("expected invalid JSON to be reported, got %v", errs)
+	}
+
+	if _, err := engine.LoadSchema(writeSchema(t, `{"type": 5}`)); err == nil {
+		t.Error("expected an invalid schema to return an error")
+	}
+}
+
+func TestSourceValidationQuarantinesInvalidResults(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"results": [
+			{"id": "1", "creation_date": "2030-01-01T00:00:00Z"},
+			{"id": "2"},
+			{"id": "3", "creation_date": "2030-01-03T00:00:00Z", "tags": "not-a-list"},
+			{"id": "4", "creation_date": "2030-01-04T00:00:00Z"}
+		], "cursor": null}`))
+	}))
+	defer ts.Close()
+
+	quarantinePath := filepath.Join(t.TempDir(), "quarantine.log")
+	quarantine, err := engine.NewQuarantine(quarantinePath)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+	defer quarantine.Close()
+
+	ss, err := engine.NewSourceService(&engine.SourceServiceConfig{
+		Name:              "tenant-a",
+		URL:               ts.URL,
+		AuthToken:         "test",
+		ClientTimeout:     time.Second,
+		RateLimitDuration: time.Minute,
+		RequestsLimit:     10,
+		Schema:            writeSchema(t, messageSchema),
+		Quarantine:        quarantine,
+	})
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	msgs := ss.HandleGetMessages()
+	if len(msgs) != 2 || msgs[0].ID != "1" || msgs[1].ID != "4" {
+		t.Fatalf("expected only the valid results to be passed on, got %+v", msgs)
+	}
+
+	entries := readQuarantine(t, quarantinePath)
+	if len(entries) != 2 || quarantine.Count() != 2 {
+		t.Fatalf("expected 2 quarantined results, got %+v", entries)
+	}
+	if entries[0].ID != "2" || entries[0].Stage != "source" || entries[0].Source != "tenant-a" || len(entries[0].Errors) == 0 {
+		t.Errorf("expected the missing creation date to be quarantined with its error, got %+v", entries[0])
+	}
+	if !jsonEqual(t, entries[1].Document, []byte(`{"id": "3", "creation_date": "2030-01-03T00:00:00Z", "tags": "not-a-list"}`)) {
+		t.Errorf("expected the document to be quarantined as received, got %s", entries[1].Document)
+	}
+}
+
+func TestProcessingValidationQuarantinesInvalidResponses(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Write([]byte(`{"id": "", "processing_date": "2030-01-01T00:00:00Z"}`))
+	}))
+	defer ts.Close()
+
+	quarantinePath := filepath.Join(t.TempDir(), "quarantine.log")
+	quarantine, _ := engine.NewQuarantine(quarantinePath)
+	defer quarantine.Close()
+
+	cfg := pcfg
+	cfg.URL = ts.URL
+	cfg.Retries = make(chan *engine.Retry, 1)
+	cfg.Schema = writeSchema(t, messageSchema)
+	cfg.Quarantine = quarantine
+	ps, err := engine.NewProcessingService(&cfg)
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	msg := test_utils.GenerateMockMessages(1)[0]
+	if _, err := ps.Client.PostMessage(&msg); !errors.Is(err, engine.ErrQuarantined) {
+		t.Fatalf("expected the response to be quarantined, got %v", err)
+	}
+
+	ps.ProcessMessage(&msg)
+	if len(cfg.Retries) != 0 || ps.Metrics.Failed() != 0 || ps.Metrics.Quarantined() != 1 {
+		t.Errorf("expected the quarantined message not to be retried, got %d retries, %d failed, %d quarantined", len(cfg.Retries), ps.Metrics.Failed(), ps.Metrics.Quarantined())
+	}
+
+	entries := readQuarantine(t, quarantinePath)
+	if requests != 2 || len(entries) != 2 {
+		t.Fatalf("expected both responses to be quarantined, got %d requests and %+v", requests, entries)
+	}
+	if entries[0].ID != msg.ID || entries[0].Stage != "processing" || len(entries[0].Errors) != 2 {
+		t.Errorf("expected the message ID and both validation errors, got %+v", entries[0])
+	}
+}
+
+func TestValidationBadSchema(t *testing.T) {
+	cfg := pcfg
+	cfg.Schema = filepath.Join(t.TempDir(), "missing.json")
+	if _, err := engine.NewProcessingService(&cfg); err == nil {
+		t.Error("expected a missing schema file to return an error")
+	}
+
+	_, err := engine.NewSourceService(&engine.SourceServiceConfig{
+		URL:               "test",
+		AuthToken:         "test",
+		ClientTimeout:     time.Second,
+		RateLimitDuration: time.Minute,
+		Schema:            writeSchema(t, `{"required": "id"}`),
+	})
+	if err == nil {
+		t.Error("expected an invalid schema to return an error")
+	}
+}
@@ -0,0 +1,407 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	walStageProcessing = "processing"
+	walStageStorage    = "storage"
+	walComplete        = "complete"
+	walDuplicate       = "duplicate"
+
+	walSegmentSuffix      = ".wal"
+	defaultWALSegmentSize = 64 << 20
+)
+
+// WALConfig turns on the write-ahead log of in-flight messages.
+type WALConfig struct {
+	// Path is the directory the segments are written to. Disabled when blank.
+	Path string `yaml:"path"`
+	// SegmentSize is the size in bytes written to a segment, on top of the
+	// pending records it starts with, before the log is compacted into a new
+	// one, 64 MiB by default.
+	SegmentSize int64 `yaml:"segmentSize"`
+	// Sync flushes every write to disk, so the log survives the machine
+	// failing as well as the process.
+	Sync bool `yaml:"sync"`
+}
+
+// walRecord is one line of a segment. A message is pending from its first
+// record until a complete record, or a duplicate record for every copy of it
+// fetched, and replays into the stage of its last one.
+type walRecord struct {
+	Seq    uint64          `json:"seq"`
+	Stage  string          `json:"stage"`
+	Source string          `json:"source,omitempty"`
+	ID     string          `json:"id"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	// Refs is the number of copies of the message fetched, when more than one.
+	Refs int `json:"refs,omitempty"`
+}
+
+func (r *walRecord) key() string {
+	return r.Source + "/" + r.ID
+}
+
+// walEntry is a pending message, its latest record and the number of copies
+// of it fetched that are neither stored nor dropped as duplicates.
+type walEntry struct {
+	record *walRecord
+	refs   int
+}
+
+// WAL is an append-only log of the messages between a source and a
+// successful storage POST, kept in numbered segment files. Pending messages
+// are held in memory too, and compaction writes just them to a new segment
+// and removes the older ones.
+type WAL struct {
+	cfg     WALConfig
+	mu      sync.Mutex
+	file    *os.File
+	segment int
+	size    int64
+	// compacted is the size of the active segment after compaction, the
+	// pending records it starts with.
+	compacted int64
+	seq       uint64
+	pending   map[string]*walEntry
+}
+
+// NewWAL opens the log in cfg.Path, nil when no path is set. The records of
+// existing segments are loaded, then compacted into a new segment.
+func NewWAL(cfg *WALConfig) (*WAL, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Path, 0755); err != nil {
+		return nil, fmt.Errorf("WAL config: error creating directory '%s': %s", cfg.Path, err)
+	}
+	w := &WAL{cfg: *cfg, pending: make(map[string]*walEntry)}
+	if w.cfg.SegmentSize <= 0 {
+		w.cfg.SegmentSize = defaultWALSegmentSize
+	}
+
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		if err := w.load(segment); err != nil {
+			return nil, err
+		}
+		w.segment = segment
+	}
+	if err := w.compact(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// segments returns the numbers of the segment files, oldest first.
+func (w *WAL) segments() ([]int, error) {
+	paths, err := filepath.Glob(filepath.Join(w.cfg.Path, "*"+walSegmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var segments []int
+	for _, path := range paths {
+		var n int
+		if _, err := fmt.Sscanf(filepath.Base(path), "%d"+walSegmentSuffix, &n); err == nil {
+			segments = append(segments, n)
+		}
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+func (w *WAL) segmentPath(n int) string {
+	return filepath.Join(w.cfg.Path, fmt.Sprintf("%08d%s", n, walSegmentSuffix))
+}
+
+func (w *WAL) load(segment int) error {
+	path := w.segmentPath(segment)
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening WAL segment '%s': %s", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	for scanner.Scan() {
+		var r walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// the last line is torn when the process died while writing it
+			log.Printf("skipping unreadable record of WAL segment '%s': %s", path, err)
+			continue
+		}
+		w.apply(&r)
+	}
+	return scanner.Err()
+}
+
+// apply updates the pending messages with r. It must be called with mu held
+// or before the log is shared.
+func (w *WAL) apply(r *walRecord) {
+	if r.Seq > w.seq {
+		w.seq = r.Seq
+	}
+	key := r.key()
+	entry, ok := w.pending[key]
+	switch r.Stage {
+	case walComplete:
+		delete(w.pending, key)
+	case walDuplicate:
+		if ok {
+			entry.refs--
+			if entry.refs <= 0 {
+				delete(w.pending, key)
+			}
+		}
+	case walStageProcessing:
+		refs := r.Refs
+		if refs == 0 {
+			refs = 1
+		}
+		// a copy of a message in flight keeps the state of the first one
+		if ok {
+			entry.refs += refs
+			return
+		}
+		w.pending[key] = &walEntry{record: r, refs: refs}
+	default:
+		if ok {
+			entry.record = r
+			return
+		}
+		w.pending[key] = &walEntry{record: r, refs: 1}
+	}
+}
+
+// write appends records to the active segment, and compacts the log once
+// the segment has grown past SegmentSize. It must be called with mu held.
+func (w *WAL) write(records []*walRecord) error {
+	var buf []byte
+	for _, r := range records {
+		w.seq++
+		r.Seq = w.seq
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	n, err := w.file.Write(buf)
+	w.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("error writing WAL segment '%s': %s", w.file.Name(), err)
+	}
+	if w.cfg.Sync {
+		if err := w.file.Sync(); err != nil {
+			return fmt.Errorf("error syncing WAL segment '%s': %s", w.file.Name(), err)
+		}
+	}
+	for _, r := range records {
+		w.apply(r)
+	}
+
+	if w.size-w.compacted >= w.cfg.SegmentSize {
+		return w.compact()
+	}
+	return nil
+}
+
+// compact writes the pending records to a new segment and removes the
+// segments before it. It must be called with mu held or before the log is
+// shared.
+func (w *WAL) compact() error {
+	records := w.pendingRecords()
+	next := w.segment + 1
+	path := w.segmentPath(next)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating WAL segment '%s': %s", path, err)
+	}
+
+	var size int64
+	bw := bufio.NewWriter(f)
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		n, _ := bw.Write(append(line, '\n'))
+		size += int64(n)
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing WAL segment '%s': %s", path, err)
+	}
+	// the older segments are only removed once the new one is on disk
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("error syncing WAL segment '%s': %s", path, err)
+	}
+
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file, w.segment, w.size, w.compacted = f, next, size, size
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment < next {
+			if err := os.Remove(w.segmentPath(segment)); err != nil {
+				log.Printf("error removing compacted WAL segment '%s': %s", w.segmentPath(segment), err)
+			}
+		}
+	}
+	return nil
+}
+
+// pendingRecords returns the pending records in the order they were written.
+func (w *WAL) pendingRecords() []*walRecord {
+	records := make([]*walRecord, 0, len(w.pending))
+	for _, entry := range w.pending {
+		r := *entry.record
+		r.Refs = 0
+		if entry.refs > 1 {
+			r.Refs = entry.refs
+		}
+		records = append(records, &r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Seq < records[j].Seq })
+	return records
+}
+
+// Append records a fetched batch, pending until processing.
+func (w *WAL) Append(batch []Message) error {
+	if w == nil || len(batch) == 0 {
+		return nil
+	}
+	records := make([]*walRecord, 0, len(batch))
+	for i := range batch {
+		body, err := json.Marshal(&batch[i])
+		if err != nil {
+			return fmt.Errorf("error encoding messageID='%s' for the WAL: %s", batch[i].ID, err)
+		}
+		records = append(records, &walRecord{Stage: walStageProcessing, Source: batch[i].SourceName, ID: batch[i].ID, Body: body})
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.write(records)
+}
+
+// Processed records the processing response of a message, which is then
+// pending until storage.
+func (w *WAL) Processed(processedMsg *ProcessedMessage) error {
+	if w == nil {
+		return nil
+	}
+	body, err := json.Marshal(processedMsg)
+	if err != nil {
+		return fmt.Errorf("error encoding messageID='%s' for the WAL: %s", processedMsg.ID, err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.write([]*walRecord{{Stage: walStageStorage, Source: processedMsg.SourceName, ID: processedMsg.ID, Body: body}})
+}
+
+// Complete records that msg was stored, or deliberately not, so it is not
+// replayed. Copies of it still in flight are complete too.
+func (w *WAL) Complete(msg *Message) error {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r := &walRecord{Stage: walComplete, Source: msg.SourceName, ID: msg.ID}
+	if _, ok := w.pending[r.key()]; !ok {
+		return nil
+	}
+	return w.write([]*walRecord{r})
+}
+
+// Duplicate records that a copy of msg was dropped as a duplicate. msg is
+// complete once every copy fetched is complete or dropped.
+func (w *WAL) Duplicate(msg *Message) error {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r := &walRecord{Stage: walDuplicate, Source: msg.SourceName, ID: msg.ID}
+	if _, ok := w.pending[r.key()]; !ok {
+		return nil
+	}
+	return w.write([]*walRecord{r})
+}
+
+// Pending returns the messages still waiting for processing and the
+// processed messages still waiting for storage, in the order they were logged.
+func (w *WAL) Pending() ([]Message, []*ProcessedMessage, error) {
+	if w == nil {
+		return nil, nil, nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var msgs []Message
+	var processed []*ProcessedMessage
+	for _, r := range w.pendingRecords() {
+		if r.Stage == walStageStorage {
+			var p ProcessedMessage
+			if err := json.Unmarshal(r.Body, &p); err != nil {
+				return nil, nil, fmt.Errorf("error decoding WAL record of messageID='%s': %s", r.ID, err)
+			}
+			processed = append(processed, &p)
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal(r.Body, &msg); err != nil {
+			return nil, nil, fmt.Errorf("error decoding WAL record of messageID='%s': %s", r.ID, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, processed, nil
+}
+
+// Len returns the number of pending messages.
+func (w *WAL) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending)
+}
+
+// Segments returns the number of segment files, one unless a compaction
+// could not remove the older ones.
+func (w *WAL) Segments() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	segments, _ := w.segments()
+	return len(segments)
+}
+
+func (w *WAL) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
@@ -0,0 +1,309 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+func TestWALPendingMessages(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := engine.NewWAL(&engine.WALConfig{Path: dir, Sync: true})
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	msgs := test_utils.GenerateMockMessages(4)
+	for i := range msgs {
+		msgs[i].SourceName = "tenant-a"
+	}
+	wal.Append(msgs)
+	wal.Processed(&engine.ProcessedMessage{msgs[1], "2030-08-24T17:20:00Z"})
+	wal.Complete(&msgs[2])
+	// a copy fetched again and dropped as a duplicate leaves the first in flight
+	wal.Append(msgs[3:])
+	wal.Duplicate(&msgs[3])
+	wal.Close()
+
+	// a record torn by a crash is skipped
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	f, _ := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"seq": 99, "stage": "comp`)
+	f.Close()
+
+	wal, err = engine.NewWAL(&engine.WALConfig{Path: dir})
+	if err != nil {
+		t.Fatalf("should not return error reopening the WAL, err: %s", err)
+	}
+	defer wal.Close()
+	pending, processed, err := wal.Pending()
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+	if len(pending) != 2 || pending[0].ID != msgs[0].ID || pending[1].ID != msgs[3].ID || pending[0].SourceName != "tenant-a" {
+		t.Errorf("expected the first and last messages to be pending processing, got %+v", pending)
+	}
+	if len(processed) != 1 || processed[0].ID != msgs[1].ID || processed[0].ProcessingDate != "2030-08-24T17:20:00Z" {
+		t.Errorf("expected the processed message to be pending storage, got %+v", processed)
+	}
+
+	wal.Duplicate(&msgs[3])
+	if wal.Len() != 2 {
+		t.Errorf("expected a message with every copy dropped to be complete, got %d pending", wal.Len())
+	}
+}
+
+func TestWALCompaction(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := engine.NewWAL(&engine.WALConfig{Path: dir, SegmentSize: 1024})
+	if err != nil {
+		t.Fatalf("should not return error, err: %s", err)
+	}
+
+	msgs := test_utils.GenerateMockMessages(50)
+	for i := range msgs {
+		wal.Append(msgs[i : i+1])
+		if i > 0 {
+			wal.Complete(&msgs[i])
+		}
+	}
+	if wal.Segments() != 1 {
+		t.Errorf("expected compacted segments to be removed, got %d", wal.Segments())
+	}
+	size := int64(0)
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	for _, segment := range segments {
+		info, _ := os.Stat(segment)
+		size += info.Size()
+	}
+	if size > 2048 {
+		t.Errorf("expected completed messages to be compacted away, the log is %d bytes", size)
+	}
+	wal.Close()
+
+	wal, _ = engine.NewWAL(&engine.WALConfig{Path: dir, SegmentSize: 1024})
+	defer wal.Close()
+	pending, _, _ := wal.Pending()
+	if len(pending) != 1 || pending[0].ID != msgs[0].ID {
+		t.Errorf("expected the pending message to survive compaction, got %+v", pending)
+	}
+}
+
+func TestEngineReplaysWAL(t *testing.T) {
+	dir := t.TempDir()
+	msgs := test_utils.GenerateMockMessages(2)
+	for i := range msgs {
+		msgs[i].SourceName = "tenant-a"
+	}
+	wal, _ := engine.NewWAL(&engine.WALConfig{Path: dir})
+	wal.Append(msgs)
+	wal.Processed(&engine.ProcessedMessage{msgs[1], "2030-08-24T17:20:00Z"})
+	wal.Close()
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, engine.MessageResponse{Results: []engine.Message{}})
+	}))
+	defer source.Close()
+
+	var mu sync.Mutex
+	processedIDs := make(map[string]bool)
+	storedIDs := make(map[string]bool)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var pmsg engine.ProcessedMessage
+		json.NewDecoder(req.Body).Decode(&pmsg)
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasPrefix(req.URL.Path, "/storage") {
+			storedIDs[pmsg.ID] = true
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		processedIDs[pmsg.ID] = true
+		json.NewEncoder(w).Encode(&pmsg)
+	}))
+	defer downstream.Close()
+
+	cfg := test_utils.BuildCollectionEngineConfig(1, 120, 5)
+	cfg.ProcessingApi.URL = downstream.URL + "/processing"
+	cfg.StorageApi.URL = downstream.URL + "/storage"
+	cfg.Sources = []engine.SourceConfig{
+		{Name: "tenant-a", URL: source.URL, AuthToken: "a", ClientTimeout: (5 * time.Second), RateLimit: 120, RateLimitDuration: 5},
+	}
+	cfg.WAL = engine.WALConfig{Path: dir}
+
+	ce := engine.NewCollectionEngine(cfg)
+	cancel := make(chan bool)
+	ce.Run(cancel)
+	defer close(cancel)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) && ce.WAL.Len() > 0 {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !processedIDs[msgs[0].ID] || !storedIDs[msgs[0].ID] {
+		t.Errorf("expected the fetched message to be processed and stored, processed: %v, stored: %v", processedIDs, storedIDs)
+	}
+	if processedIDs[msgs[1].ID] || !storedIDs[msgs[1].ID] {
+		t.Errorf("expected the processed message to be stored without processing it again, processed: %v, stored: %v", processedIDs, storedIDs)
+	}
+	if ce.WAL.Len() != 0 {
+		t.Errorf("expected every replayed message to be complete, got %d pending", ce.WAL.Len())
+	}
+}
+
+func TestWALCompletesDeadLetters(t *testing.T) {
+	msgs := test_utils.GenerateMockMessages(2)
+	var served sync.Once
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		results := []engine.Message{}
+		served.Do(func() { results = msgs })
+		writeJSON(w, engine.MessageResponse{Results: results})
+	}))
+	defer source.Close()
+
+	// the first message can never be processed and the second never stored
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var pmsg engine.ProcessedMessage
+		json.NewDecoder(req.Body).Decode(&pmsg)
+		if strings.HasPrefix(req.URL.Path, "/storage") {
+			if pmsg.ID == msgs[1].ID {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		if pmsg.ID == msgs[0].ID {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(&pmsg)
+	}))
+	defer downstream.Close()
+
+	cfg := test_utils.BuildCollectionEngineConfig(1, 120, 5)
+	cfg.ProcessingApi.URL = downstream.URL + "/processing"
+	cfg.StorageApi.URL = downstream.URL + "/storage"
+	cfg.Sources = []engine.SourceConfig{
+		{Name: "tenant-a", URL: source.URL, AuthToken: "a", ClientTimeout: (5 * time.Second), RateLimit: 120, RateLimitDuration: 5},
+	}
+	cfg.WAL = engine.WALConfig{Path: t.TempDir()}
+
+	ce := engine.NewCollectionEngine(cfg)
+	cancel := make(chan bool)
+	ce.Run(cancel)
+	defer close(cancel)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) && (ce.ProcessingService.Metrics.Dropped()+ce.StorageService.Metrics.Dropped() < 2 || ce.WAL.Len() > 0) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if ce.ProcessingService.Metrics.Dropped() != 1 || ce.StorageService.Metrics.Dropped() != 1 {
+		t.Fatalf("expected a message to run out of retries in each service, got %d and %d", ce.ProcessingService.Metrics.Dropped(), ce.StorageService.Metrics.Dropped())
+	}
+	if ce.WAL.Len() != 0 {
+		t.Errorf("expected messages that ran out of retries not to be replayed, got %d pending", ce.WAL.Len())
+	}
+}
+
+func TestEngineReplaysStreamEventsFromWAL(t *testing.T) {
+	dir := t.TempDir()
+	checkpoints := filepath.Join(t.TempDir(), "checkpoints.json")
+	msgs := test_utils.GenerateMockMessages(2)
+
+	var mu sync.Mutex
+	var lastEventIDs []string
+	stream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		lastEventIDs = append(lastEventIDs, req.Header.Get("Last-Event-ID"))
+		mu.Unlock()
+		// events are only sent once, a source resuming after them gets nothing
+		if req.Header.Get("Last-Event-ID") == "" {
+			for i, msg := range msgs {
+				data, _ := json.Marshal(msg)
+				fmt.Fprintf(w, "id: event-%d\ndata: %s\n\n", i, data)
+			}
+		}
+		w.(http.Flusher).Flush()
+		<-req.Context().Done()
+	}))
+	defer stream.Close()
+
+	// the first run receives both events and stops before any is stored
+	wal, _ := engine.NewWAL(&engine.WALConfig{Path: dir})
+	store, _ := engine.NewCheckpointStore(checkpoints)
+	first, _ := engine.NewStreamSource(&engine.StreamSourceConfig{
+		Name: "tenant-s", URL: stream.URL, AuthToken: "a", Format: engine.StreamFormatSSE,
+		RateLimitDuration: time.Minute, RequestsLimit: 10, Checkpoint: store, WAL: wal,
+	})
+	cancel := make(chan bool)
+	go first.Run(cancel)
+	for range msgs {
+		select {
+		case <-first.Messages:
+		case <-time.After(3 * time.Second):
+			t.Fatal("expected the events to be streamed")
+		}
+	}
+	close(cancel)
+	for range first.Messages {
+	}
+	wal.Close()
+
+	var stored sync.Map
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var pmsg engine.ProcessedMessage
+		json.NewDecoder(req.Body).Decode(&pmsg)
+		if strings.HasPrefix(req.URL.Path, "/storage") {
+			stored.Store(pmsg.ID, true)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		json.NewEncoder(w).Encode(&pmsg)
+	}))
+	defer downstream.Close()
+
+	cfg := test_utils.BuildCollectionEngineConfig(1, 120, 5)
+	cfg.ProcessingApi.URL = downstream.URL + "/processing"
+	cfg.StorageApi.URL = downstream.URL + "/storage"
+	cfg.Sources = []engine.SourceConfig{
+		{Name: "tenant-s", URL: stream.URL, AuthToken: "a", ClientTimeout: (5 * time.Second), RateLimit: 120, RateLimitDuration: 5, Mode: engine.SourceModeStream},
+	}
+	cfg.WAL = engine.WALConfig{Path: dir}
+	cfg.CheckpointPath = checkpoints
+
+	ce := engine.NewCollectionEngine(cfg)
+	restart := make(chan bool)
+	ce.Run(restart)
+	defer close(restart)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) && ce.WAL.Len() > 0 {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	for _, msg := range msgs {
+		if _, ok := stored.Load(msg.ID); !ok {
+			t.Errorf("expected messageID='%s' lost in flight to be replayed from the WAL and stored", msg.ID)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lastEventIDs) < 2 || lastEventIDs[len(lastEventIDs)-1] != "event-1" {
+		t.Errorf("expected the restarted stream to resume after 'event-1', got %q", lastEventIDs)
+	}
+}
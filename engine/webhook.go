@@ -0,0 +1,436 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WebhookSignatureHeader = "X-Signature"
+	webhookSignaturePrefix = "sha256="
+	maxWebhookBodyBytes    = 10 << 20
+	spoolRepairChunk       = 64 * 1024
+)
+
+// SignWebhookBody returns the X-Signature header value for body.
+func SignWebhookBody(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return webhookSignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookSource receives messages POSTed by upstreams that push instead of
+// being polled. Accepted batches are appended to the spool before the
+// request is acknowledged and are delivered to Messages in order.
+type WebhookSource struct {
+	Name   string
+	Addr   string
+	Path   string
+	Secret []byte
+	// CloudEvents makes the source unwrap bodies that are CloudEvents, in binary or structured mode.
+	CloudEvents bool
+	Messages    chan []Message
+	Spool       *Spool
+	mu          sync.Mutex
+	queue       chan []Message
+	replay      [][]Message
+	server      *http.Server
+}
+
+type WebhookSourceConfig struct {
+	Name   string
+	Addr   string
+	Path   string
+	Secret string
+	// MaxPending is how many accepted batches may wait for the pipeline before requests are refused with a 503.
+	MaxPending int
+	// SpoolPath is the file accepted batches are written to before they are
+	// acknowledged, so they survive restarts.
+	SpoolPath   string
+	CloudEvents bool
+}
+
+func NewWebhookSource(cfg *WebhookSourceConfig) (*WebhookSource, error) {
+	if cfg.Addr == "" || cfg.Path == "" || cfg.Secret == "" || cfg.SpoolPath == "" {
+		return nil, fmt.Errorf("Webhook source config: Addr, Path, Secret and SpoolPath cannot be blank. Addr: '%v', Path: '%v', SpoolPath: '%v'", cfg.Addr, cfg.Path, cfg.SpoolPath)
+	}
+
+	if cfg.MaxPending == 0 {
+		return nil, fmt.Errorf("Webhook source config: MaxPending cannot be 0. MaxPending: %v", cfg.MaxPending)
+	}
+
+	ws := &WebhookSource{
+		Name:        cfg.Name,
+		Addr:        cfg.Addr,
+		Path:        cfg.Path,
+		Secret:      []byte(cfg.Secret),
+		CloudEvents: cfg.CloudEvents,
+		Messages:    make(chan []Message),
+		queue:       make(chan []Message, cfg.MaxPending),
+	}
+
+	spool, err := OpenSpool(cfg.SpoolPath)
+	if err != nil {
+		return nil, err
+	}
+	ws.Spool = spool
+
+	// read before serving so batches accepted from now on are not replayed twice
+	ws.replay, err = spool.Pending()
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Path, ws)
+	ws.server = &http.Server{Addr: cfg.Addr, Handler: mux}
+	return ws, nil
+}
+
+func (ws *WebhookSource) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// one byte past the limit tells an oversized body from one at the limit
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxWebhookBodyBytes+1))
+	if err != nil {
+		http.Error(w, "error reading body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxWebhookBodyBytes {
+		http.Error(w, fmt.Sprintf("body larger than %d bytes", maxWebhookBodyBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	signature := req.Header.Get(WebhookSignatureHeader)
+	if !hmac.Equal([]byte(signature), []byte(SignWebhookBody(ws.Secret, body))) {
+		log.Printf("webhook source '%s' rejected request with invalid signature from %s", ws.Name, req.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	if ws.CloudEvents {
+		data, binary, err := unwrapBinaryCloudEvent(req.Header, body)
+		if !binary && err == nil {
+			data, err = unwrapCloudEvents(body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = data
+	}
+
+	batch, err := decodeWebhookBody(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i := range batch {
+		batch[i].SourceName = ws.Name
+	}
+
+	if err := ws.enqueue(batch); err != nil {
+		log.Printf("webhook source '%s' refused batch of %d messages: %s", ws.Name, len(batch), err)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// decodeWebhookBody accepts a single message object or an array of them.
+func decodeWebhookBody(body []byte) ([]Message, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil, fmt.Errorf("empty body")
+	}
+
+	var batch []Message
+	if trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &batch); err != nil {
+			return nil, fmt.Errorf("could not unmarshal message batch: %s", err)
+		}
+	} else {
+		var msg Message
+		if err := json.Unmarshal(trimmed, &msg); err != nil {
+			return nil, fmt.Errorf("could not unmarshal message: %s", err)
+		}
+		batch = []Message{msg}
+	}
+
+	for _, msg := range batch {
+		if msg.ID == "" {
+			return nil, fmt.Errorf("every message must have an id")
+		}
+	}
+	if len(batch) == 0 {
+		return nil, fmt.Errorf("empty message batch")
+	}
+	return batch, nil
+}
+
+// enqueue spools batch and queues it for delivery, or returns an error if
+// the pipeline is saturated or the spool cannot be written.
+func (ws *WebhookSource) enqueue(batch []Message) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if len(ws.queue) == cap(ws.queue) {
+		return fmt.Errorf("pipeline saturated, %d batches pending", len(ws.queue))
+	}
+
+	if err := ws.Spool.Append(batch); err != nil {
+		return err
+	}
+
+	ws.queue <- batch
+	return nil
+}
+
+// deliver passes queued batches to Messages, acknowledging each in the
+// spool once the pipeline has taken it.
+func (ws *WebhookSource) deliver(cancel <-chan bool) {
+	if len(ws.replay) > 0 {
+		log.Printf("webhook source '%s' replaying %d spooled batches", ws.Name, len(ws.replay))
+	}
+	for _, batch := range ws.replay {
+		select {
+		case ws.Messages <- batch:
+			ws.ack()
+		case <-cancel:
+			return
+		}
+	}
+	ws.replay = nil
+
+	for {
+		select {
+		case batch := <-ws.queue:
+			select {
+			case ws.Messages <- batch:
+				ws.ack()
+			case <-cancel:
+				return
+			}
+		case <-cancel:
+			return
+		}
+	}
+}
+
+func (ws *WebhookSource) ack() {
+	if err := ws.Spool.Ack(); err != nil {
+		log.Printf("error acknowledging webhook spool entry: %s", err)
+	}
+}
+
+// Run serves the webhook endpoint and delivers accepted batches until cancel receives.
+func (ws *WebhookSource) Run(cancel <-chan bool) {
+	log.Printf("Webhook source '%s' listening on %s%s", ws.Name, ws.Addr, ws.Path)
+	go func() {
+		if err := ws.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("webhook source '%s' stopped serving: %s", ws.Name, err)
+		}
+	}()
+
+	ws.deliver(cancel)
+
+	log.Printf("Webhook source '%s' received cancel signal. Stopping service.", ws.Name)
+	ctx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+	defer stop()
+	ws.server.Shutdown(ctx)
+	close(ws.Messages)
+	ws.Spool.Close()
+}
+
+// Spool is an append-only file of message batches together with the number
+// of batches already delivered, so undelivered batches are replayed after a
+// restart.
+type Spool struct {
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	appended  int
+	delivered int
+}
+
+func OpenSpool(path string) (*Spool, error) {
+	s := &Spool{path: path}
+
+	data, err := os.ReadFile(path + ".offset")
+	if err == nil {
+		s.delivered, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading spool offset '%s.offset': %s", path, err)
+	}
+
+	if err := s.repair(); err != nil {
+		return nil, err
+	}
+	pending, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	s.appended = s.delivered + len(pending)
+
+	s.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening spool '%s': %s", path, err)
+	}
+	return s, nil
+}
+
+// repair truncates the spool after its last complete line. A crash while
+// appending leaves a torn batch, whose request was never acknowledged, and
+// the next append would otherwise be written onto the end of it.
+func (s *Spool) repair() error {
+	f, err := os.OpenFile(s.path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening spool '%s': %s", s.path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading spool '%s': %s", s.path, err)
+	}
+
+	size := info.Size()
+	end := size
+	buf := make([]byte, spoolRepairChunk)
+	for end > 0 {
+		n := int64(len(buf))
+		if n > end {
+			n = end
+		}
+		if _, err := f.ReadAt(buf[:n], end-n); err != nil {
+			return fmt.Errorf("error reading spool '%s': %s", s.path, err)
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = end - n + int64(i) + 1
+			break
+		}
+		end -= n
+	}
+	if end == size {
+		return nil
+	}
+	log.Printf("truncating torn batch of %d bytes at the end of spool '%s'", size-end, s.path)
+	if err := f.Truncate(end); err != nil {
+		return fmt.Errorf("error truncating spool '%s': %s", s.path, err)
+	}
+	return nil
+}
+
+// read returns the spooled batches that have not been delivered.
+func (s *Spool) read() ([][]Message, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening spool '%s': %s", s.path, err)
+	}
+	defer f.Close()
+
+	var pending [][]Message
+	line := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxWebhookBodyBytes*2)
+	for scanner.Scan() {
+		line++
+		if line <= s.delivered {
+			continue
+		}
+		var batch []Message
+		if err := json.Unmarshal(scanner.Bytes(), &batch); err != nil {
+			// cannot happen once repaired, a torn write is only ever the last line
+			break
+		}
+		pending = append(pending, batch)
+	}
+	return pending, scanner.Err()
+}
+
+// Pending returns the batches appended but not yet acknowledged.
+func (s *Spool) Pending() ([][]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read()
+}
+
+// Append writes batch to the spool and syncs it to disk.
+func (s *Spool) Append(batch []Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing to spool '%s': %s", s.path, err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing spool '%s': %s", s.path, err)
+	}
+	s.appended++
+	return nil
+}
+
+// Ack marks the oldest pending batch as delivered. Once every batch is
+// delivered the spool is truncated.
+func (s *Spool) Ack() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.delivered++
+	if s.delivered < s.appended {
+		return s.writeOffset()
+	}
+
+	// reset the offset before truncating, a crash in between replays
+	// delivered batches rather than skipping new ones
+	s.delivered, s.appended = 0, 0
+	if err := s.writeOffset(); err != nil {
+		return err
+	}
+	if err := s.file.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating spool '%s': %s", s.path, err)
+	}
+	return nil
+}
+
+func (s *Spool) writeOffset() error {
+	err := os.WriteFile(s.path+".offset", []byte(strconv.Itoa(s.delivered)), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing spool offset '%s.offset': %s", s.path, err)
+	}
+	return nil
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
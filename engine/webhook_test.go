@@ -0,0 +1,245 @@
+package engine_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+	"github.com/dylanconnolly/collection-engine/test_utils"
+)
+
+var webhookCfg = engine.WebhookSourceConfig{
+	Name:       "pusher",
+	Addr:       "127.0.0.1:0",
+	Path:       "/messages",
+	Secret:     "webhook-secret",
+	MaxPending: 2,
+}
+
+// webhookConfig returns webhookCfg with a spool of its own.
+func webhookConfig(t *testing.T) engine.WebhookSourceConfig {
+	cfg := webhookCfg
+	cfg.SpoolPath = filepath.Join(t.TempDir(), "webhook.spool")
+	return cfg
+}
+
+func webhookRequest(t *testing.T, payload interface{}, secret string) *http.Request {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("error marshalling webhook payload: %s", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/messages", bytes.NewReader(body))
+	req.Header.Set(engine.WebhookSignatureHeader, engine.SignWebhookBody([]byte(secret), body))
+	return req
+}
+
+func TestNewWebhookSource(t *testing.T) {
+	t.Run("should return a new source", func(t *testing.T) {
+		cfg := webhookConfig(t)
+		ws, err := engine.NewWebhookSource(&cfg)
+		if err != nil {
+			t.Errorf("new config should not return error when all fields are set. err: %s", err)
+		}
+		if ws == nil {
+			t.Error("source should not be nil")
+		}
+	})
+
+	t.Run("bad configs", func(t *testing.T) {
+		noSecret := webhookConfig(t)
+		noSecret.Secret = ""
+		noPending := webhookConfig(t)
+		noPending.MaxPending = 0
+		noSpool := webhookConfig(t)
+		noSpool.SpoolPath = ""
+
+		for name, badConfig := range map[string]engine.WebhookSourceConfig{"no secret": noSecret, "no max pending": noPending, "no spool": noSpool} {
+			badConfig := badConfig
+			if _, err := engine.NewWebhookSource(&badConfig); err == nil {
+				t.Errorf("Test - %s: expected an error", name)
+			}
+		}
+	})
+}
+
+func TestWebhookServeHTTP(t *testing.T) {
+	msgs := test_utils.GenerateMockMessages(3)
+
+	t.Run("should accept signed single messages and batches", func(t *testing.T) {
+		cfg := webhookConfig(t)
+		ws, _ := engine.NewWebhookSource(&cfg)
+		cancel := make(chan bool)
+		defer close(cancel)
+		go ws.Run(cancel)
+
+		tests := map[string]struct {
+			payload  interface{}
+			expected int
+		}{
+			"single message": {payload: msgs[0], expected: 1},
+			"batch":          {payload: msgs, expected: 3},
+		}
+
+		for name, test := range tests {
+			w := httptest.NewRecorder()
+			ws.ServeHTTP(w, webhookRequest(t, test.payload, webhookCfg.Secret))
+			if w.Code != http.StatusAccepted {
+				t.Errorf("Test - %s: expected 202, got %d", name, w.Code)
+			}
+
+			select {
+			case batch := <-ws.Messages:
+				if len(batch) != test.expected {
+					t.Errorf("Test - %s: expected batch of %d, got %d", name, test.expected, len(batch))
+				}
+				if batch[0].SourceName != webhookCfg.Name {
+					t.Errorf("Test - %s: expected messages to be tagged with '%s', got '%s'", name, webhookCfg.Name, batch[0].SourceName)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("Test - %s: accepted batch was not delivered", name)
+			}
+		}
+	})
+
+	t.Run("should reject invalid signatures", func(t *testing.T) {
+		cfg := webhookConfig(t)
+		ws, _ := engine.NewWebhookSource(&cfg)
+
+		w := httptest.NewRecorder()
+		ws.ServeHTTP(w, webhookRequest(t, msgs[0], "wrong-secret"))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("should refuse oversized bodies", func(t *testing.T) {
+		cfg := webhookConfig(t)
+		ws, _ := engine.NewWebhookSource(&cfg)
+
+		big := engine.Message{ID: "big", Message: strings.Repeat("a", 10<<20)}
+		w := httptest.NewRecorder()
+		ws.ServeHTTP(w, webhookRequest(t, big, webhookCfg.Secret))
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected 413, got %d", w.Code)
+		}
+	})
+
+	t.Run("should reject messages without an id", func(t *testing.T) {
+		cfg := webhookConfig(t)
+		ws, _ := engine.NewWebhookSource(&cfg)
+
+		w := httptest.NewRecorder()
+		ws.ServeHTTP(w, webhookRequest(t, engine.Message{Title: "no id"}, webhookCfg.Secret))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("should return 503 when the pipeline is saturated", func(t *testing.T) {
+		cfg := webhookConfig(t)
+		ws, _ := engine.NewWebhookSource(&cfg)
+
+		// nothing delivers, so the queue fills after MaxPending batches
+		for i := 0; i < webhookCfg.MaxPending; i++ {
+			w := httptest.NewRecorder()
+			ws.ServeHTTP(w, webhookRequest(t, msgs[i], webhookCfg.Secret))
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("expected 202 while below MaxPending, got %d", w.Code)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		ws.ServeHTTP(w, webhookRequest(t, msgs[2], webhookCfg.Secret))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503, got %d", w.Code)
+		}
+	})
+}
+
+func TestWebhookSpool(t *testing.T) {
+	msgs := test_utils.GenerateMockMessages(2)
+	cfgCopy := webhookConfig(t)
+
+	ws, err := engine.NewWebhookSource(&cfgCopy)
+	if err != nil {
+		t.Fatalf("should not return error opening spool, err: %s", err)
+	}
+	for _, msg := range msgs {
+		w := httptest.NewRecorder()
+		ws.ServeHTTP(w, webhookRequest(t, msg, cfgCopy.Secret))
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d", w.Code)
+		}
+	}
+	// simulate a crash before anything was delivered
+	ws.Spool.Close()
+
+	restarted, err := engine.NewWebhookSource(&cfgCopy)
+	if err != nil {
+		t.Fatalf("should not return error reopening spool, err: %s", err)
+	}
+	cancel := make(chan bool)
+	go restarted.Run(cancel)
+
+	for i, msg := range msgs {
+		select {
+		case batch := <-restarted.Messages:
+			if batch[0].ID != msg.ID {
+				t.Errorf("expected replayed batch %d to be messageID='%s', got '%s'", i, msg.ID, batch[0].ID)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected spooled batch %d to be replayed", i)
+		}
+	}
+	cancel <- true
+
+	pending, _ := engine.OpenSpool(cfgCopy.SpoolPath)
+	defer pending.Close()
+	remaining, _ := pending.Pending()
+	if len(remaining) != 0 {
+		t.Errorf("expected delivered batches to be acknowledged, %d still pending", len(remaining))
+	}
+}
+
+func TestWebhookSpoolTornBatch(t *testing.T) {
+	msgs := test_utils.GenerateMockMessages(2)
+	cfgCopy := webhookConfig(t)
+
+	ws, _ := engine.NewWebhookSource(&cfgCopy)
+	w := httptest.NewRecorder()
+	ws.ServeHTTP(w, webhookRequest(t, msgs[0], cfgCopy.Secret))
+	ws.Spool.Close()
+
+	// simulate a crash halfway through appending the next batch
+	f, _ := os.OpenFile(cfgCopy.SpoolPath, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`[{"id":"torn`)
+	f.Close()
+
+	restarted, err := engine.NewWebhookSource(&cfgCopy)
+	if err != nil {
+		t.Fatalf("should not return error reopening spool, err: %s", err)
+	}
+	w = httptest.NewRecorder()
+	restarted.ServeHTTP(w, webhookRequest(t, msgs[1], cfgCopy.Secret))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", w.Code)
+	}
+	restarted.Spool.Close()
+
+	spool, _ := engine.OpenSpool(cfgCopy.SpoolPath)
+	defer spool.Close()
+	pending, err := spool.Pending()
+	if err != nil {
+		t.Fatalf("should not return error reading spool, err: %s", err)
+	}
+	if len(pending) != 2 || pending[0][0].ID != msgs[0].ID || pending[1][0].ID != msgs[1].ID {
+		t.Errorf("expected both acknowledged batches to survive the torn one, got %v", pending)
+	}
+}
@@ -4,5 +4,11 @@ go 1.20
 
 require (
 	github.com/google/go-cmp v0.5.9
+	github.com/klauspost/compress v1.17.9
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	google.golang.org/protobuf v1.33.0
 	gopkg.in/yaml.v2 v2.4.0
 )
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"net/http"
 	"os"
 	"strconv"
 	"sync"
@@ -12,6 +13,16 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		os.Exit(runBackfillCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		os.Exit(runDecryptCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerifyCommand(os.Args[2:]))
+	}
+
 	var fc FileConfig
 	fc.ReadFromFile("/etc/config/config.yaml")
 	var cfg engine.Config
@@ -30,19 +41,148 @@ func main() {
 }
 
 type FileConfig struct {
-	DefaultClientTimeout    string `yaml:"defaultClientTimeout"`
-	DefaultWorkersCount     string `yaml:"defaultWorkersCount"`
-	SourceURL               string `yaml:"sourceApiBaseUrl"`
-	SourceAuthToken         string `yaml:"sourceApiAuthToken"`
-	SourceTimeout           string `yaml:"sourceClientTimeout"`
-	SourceRateLimit         string `yaml:"sourceApiRateLimit"`
-	SourceRateLimitDuration string `yaml:"sourceApiRateLimitPeriodSecs"`
-	ProcessingURL           string `yaml:"processingApiBaseUrl"`
-	ProcessingTimeout       string `yaml:"processingClientTimeout"`
-	ProcessingWorkersCount  string `yaml:"processingWorkersCount"`
-	StorageURL              string `yaml:"storageApiBaseUrl"`
-	StorageTimeout          string `yaml:"storageClientTimeout"`
-	StorageWorkersCount     string `yaml:"storageWorkersCount"`
+	DefaultClientTimeout    string                   `yaml:"defaultClientTimeout"`
+	DefaultWorkersCount     string                   `yaml:"defaultWorkersCount"`
+	SourceURL               string                   `yaml:"sourceApiBaseUrl"`
+	SourceAuthToken         string                   `yaml:"sourceApiAuthToken"`
+	SourceTimeout           string                   `yaml:"sourceClientTimeout"`
+	SourceRateLimit         string                   `yaml:"sourceApiRateLimit"`
+	SourceRateLimitDuration string                   `yaml:"sourceApiRateLimitPeriodSecs"`
+	SourceMode              string                   `yaml:"sourceApiMode"`
+	SourceStreamFormat      string                   `yaml:"sourceApiStreamFormat"`
+	SourceStreamPath        string                   `yaml:"sourceApiStreamPath"`
+	SourcePageSize          string                   `yaml:"sourceApiPageSize"`
+	SourceMinPollInterval   string                   `yaml:"sourceApiMinPollInterval"`
+	SourceMaxPollInterval   string                   `yaml:"sourceApiMaxPollInterval"`
+	SourcePagination        FilePaginationConfig     `yaml:"sourceApiPagination"`
+	SourcePartitions        string                   `yaml:"sourceApiPartitions"`
+	SourcePartitionParam    string                   `yaml:"sourceApiPartitionParam"`
+	SourceAuth              FileAuthConfig           `yaml:"sourceApiAuth"`
+	SourceTLS               engine.TLSConfig         `yaml:"sourceApiTls"`
+	SourceFields            engine.FieldMapping      `yaml:"sourceApiFields"`
+	SourceCloudEvents       string                   `yaml:"sourceApiCloudEvents"`
+	SourceCodec             string                   `yaml:"sourceApiCodec"`
+	SourceMaxResponseSize   string                   `yaml:"sourceApiMaxResponseSize"`
+	ProcessingURL           string                   `yaml:"processingApiBaseUrl"`
+	ProcessingTimeout       string                   `yaml:"processingClientTimeout"`
+	ProcessingWorkersCount  string                   `yaml:"processingWorkersCount"`
+	ProcessingAuth          FileAuthConfig           `yaml:"processingApiAuth"`
+	ProcessingSigning       engine.SigningConfig     `yaml:"processingApiSigning"`
+	ProcessingTLS           engine.TLSConfig         `yaml:"processingApiTls"`
+	ProcessingCloudEvents   engine.CloudEventsConfig `yaml:"processingApiCloudEvents"`
+	ProcessingCodec         string                   `yaml:"processingApiCodec"`
+	ProcessingCompression   engine.CompressionConfig `yaml:"processingApiCompression"`
+	StorageURL              string                   `yaml:"storageApiBaseUrl"`
+	StorageTimeout          string                   `yaml:"storageClientTimeout"`
+	StorageWorkersCount     string                   `yaml:"storageWorkersCount"`
+	StorageAuth             FileAuthConfig           `yaml:"storageApiAuth"`
+	StorageSigning          engine.SigningConfig     `yaml:"storageApiSigning"`
+	StorageTLS              engine.TLSConfig         `yaml:"storageApiTls"`
+	StorageCloudEvents      engine.CloudEventsConfig `yaml:"storageApiCloudEvents"`
+	StorageCodec            string                   `yaml:"storageApiCodec"`
+	StorageCompression      engine.CompressionConfig `yaml:"storageApiCompression"`
+	DedupEnabled            string                   `yaml:"dedupEnabled"`
+	DedupBackend            string                   `yaml:"dedupBackend"`
+	DedupCapacity           string                   `yaml:"dedupCapacity"`
+	DedupWindow             string                   `yaml:"dedupWindow"`
+	DedupPath               string                   `yaml:"dedupPath"`
+	AckLedgerPath           string                   `yaml:"ackLedgerPath"`
+	AckLedgerWindow         string                   `yaml:"ackLedgerWindow"`
+	SourceSchema            string                   `yaml:"sourceApiSchema"`
+	ProcessingSchema        string                   `yaml:"processingApiSchema"`
+	QuarantinePath          string                   `yaml:"quarantinePath"`
+	Privacy                 engine.PrivacyConfig     `yaml:"privacy"`
+	Integrity               engine.IntegrityConfig   `yaml:"integrity"`
+	Stages                  []FileStageConfig        `yaml:"stages"`
+	Sources                 []FileSourceConfig       `yaml:"sources"`
+	CheckpointPath          string                   `yaml:"checkpointPath"`
+	WAL                     engine.WALConfig         `yaml:"wal"`
+	AckTracking             string                   `yaml:"ackTracking"`
+	Ordering                engine.OrderingConfig    `yaml:"ordering"`
+	WebhookEnabled          string                   `yaml:"webhookEnabled"`
+	WebhookName             string                   `yaml:"webhookName"`
+	WebhookAddr             string                   `yaml:"webhookAddr"`
+	WebhookPath             string                   `yaml:"webhookPath"`
+	WebhookSecret           string                   `yaml:"webhookSecret"`
+	WebhookMaxPending       string                   `yaml:"webhookMaxPending"`
+	WebhookSpoolPath        string                   `yaml:"webhookSpoolPath"`
+	WebhookCloudEvents      string                   `yaml:"webhookCloudEvents"`
+	AdminAddr               string                   `yaml:"adminAddr"`
+	Transport               FileTransportConfig      `yaml:"transport"`
+}
+
+type FileSourceConfig struct {
+	Name              string               `yaml:"name"`
+	URL               string               `yaml:"baseUrl"`
+	AuthToken         string               `yaml:"authToken"`
+	Timeout           string               `yaml:"timeout"`
+	RateLimit         string               `yaml:"rateLimit"`
+	RateLimitDuration string               `yaml:"rateLimitPeriodSecs"`
+	Isolated          string               `yaml:"isolated"`
+	Mode              string               `yaml:"mode"`
+	StreamFormat      string               `yaml:"streamFormat"`
+	StreamPath        string               `yaml:"streamPath"`
+	PageSize          string               `yaml:"pageSize"`
+	MinPollInterval   string               `yaml:"minPollInterval"`
+	MaxPollInterval   string               `yaml:"maxPollInterval"`
+	Pagination        FilePaginationConfig `yaml:"pagination"`
+	Partitions        string               `yaml:"partitions"`
+	PartitionParam    string               `yaml:"partitionParam"`
+	Auth              FileAuthConfig       `yaml:"auth"`
+	TLS               engine.TLSConfig     `yaml:"tls"`
+	Fields            engine.FieldMapping  `yaml:"fields"`
+	Schema            string               `yaml:"schema"`
+	CloudEvents       string               `yaml:"cloudEvents"`
+	Codec             string               `yaml:"codec"`
+	MaxResponseSize   string               `yaml:"maxResponseSize"`
+}
+
+type FilePaginationConfig struct {
+	Strategy     string `yaml:"strategy"`
+	Path         string `yaml:"path"`
+	Param        string `yaml:"param"`
+	Limit        string `yaml:"limit"`
+	LimitParam   string `yaml:"limitParam"`
+	ResultsField string `yaml:"resultsField"`
+	CursorField  string `yaml:"cursorField"`
+}
+
+type FileAuthConfig struct {
+	Type          string   `yaml:"type"`
+	Header        string   `yaml:"header"`
+	Token         string   `yaml:"token"`
+	Username      string   `yaml:"username"`
+	Password      string   `yaml:"password"`
+	TokenURL      string   `yaml:"tokenUrl"`
+	ClientID      string   `yaml:"clientId"`
+	ClientSecret  string   `yaml:"clientSecret"`
+	Scopes        []string `yaml:"scopes"`
+	RefreshBefore string   `yaml:"refreshBefore"`
+}
+
+type FileTransportConfig struct {
+	MaxIdleConns        string `yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost string `yaml:"maxIdleConnsPerHost"`
+	MaxConnsPerHost     string `yaml:"maxConnsPerHost"`
+	IdleConnTimeout     string `yaml:"idleConnTimeout"`
+	KeepAlive           string `yaml:"keepAlive"`
+	DialTimeout         string `yaml:"dialTimeout"`
+	TLSHandshakeTimeout string `yaml:"tlsHandshakeTimeout"`
+	DisableHTTP2        string `yaml:"disableHttp2"`
+}
+
+type FileStageConfig struct {
+	Name           string                   `yaml:"name"`
+	URL            string                   `yaml:"url"`
+	Method         string                   `yaml:"method"`
+	ExpectedStatus string                   `yaml:"expectedStatus"`
+	Timeout        string                   `yaml:"timeout"`
+	Workers        string                   `yaml:"workers"`
+	MaxRetries     string                   `yaml:"maxRetries"`
+	Auth           FileAuthConfig           `yaml:"auth"`
+	Signing        engine.SigningConfig     `yaml:"signing"`
+	TLS            engine.TLSConfig         `yaml:"tls"`
+	CloudEvents    engine.CloudEventsConfig `yaml:"cloudEvents"`
 }
 
 func (f *FileConfig) ReadFromFile(path string) {
@@ -75,8 +215,24 @@ func (f *FileConfig) ConvertToEngineConfig(cfg *engine.Config) {
 
 	cfg.SourceApi.URL = f.SourceURL
 	cfg.SourceApi.AuthToken = f.SourceAuthToken
+	cfg.SourceApi.Mode = f.SourceMode
+	cfg.SourceApi.StreamFormat = f.SourceStreamFormat
+	cfg.SourceApi.StreamPath = f.SourceStreamPath
 	cfg.ProcessingApi.URL = f.ProcessingURL
 	cfg.StorageApi.URL = f.StorageURL
+	f.ProcessingAuth.convert("processingApi", &cfg.ProcessingApi.Auth)
+	f.StorageAuth.convert("storageApi", &cfg.StorageApi.Auth)
+	cfg.ProcessingApi.Signing = f.ProcessingSigning
+	cfg.StorageApi.Signing = f.StorageSigning
+	cfg.ProcessingApi.TLS = f.ProcessingTLS
+	f.Transport.convert(&cfg.Transport)
+	cfg.StorageApi.TLS = f.StorageTLS
+	cfg.ProcessingApi.CloudEvents = f.ProcessingCloudEvents
+	cfg.StorageApi.CloudEvents = f.StorageCloudEvents
+	cfg.ProcessingApi.Codec = f.ProcessingCodec
+	cfg.StorageApi.Codec = f.StorageCodec
+	cfg.ProcessingApi.Compression = f.ProcessingCompression
+	cfg.StorageApi.Compression = f.StorageCompression
 
 	timeout, err := time.ParseDuration(f.SourceTimeout)
 	if err != nil {
@@ -98,6 +254,15 @@ func (f *FileConfig) ConvertToEngineConfig(cfg *engine.Config) {
 		val = 0
 	}
 	cfg.SourceApi.RateLimitDuration = val
+	convertPollConfig("sourceApi", f.SourcePageSize, f.SourceMinPollInterval, f.SourceMaxPollInterval, &cfg.SourceApi)
+	f.SourcePagination.convert("sourceApi", &cfg.SourceApi.Pagination)
+	f.SourceAuth.convert("sourceApi", &cfg.SourceApi.Auth)
+	cfg.SourceApi.TLS = f.SourceTLS
+	cfg.SourceApi.Fields = f.SourceFields
+	cfg.SourceApi.CloudEvents, _ = strconv.ParseBool(f.SourceCloudEvents)
+	cfg.SourceApi.Codec = f.SourceCodec
+	cfg.SourceApi.MaxResponseSize = convertMaxResponseSize("sourceApi", f.SourceMaxResponseSize)
+	convertPartitionConfig("sourceApi", f.SourcePartitions, f.SourcePartitionParam, &cfg.SourceApi)
 
 	timeout, err = time.ParseDuration(f.ProcessingTimeout)
 	if err != nil {
@@ -126,6 +291,300 @@ func (f *FileConfig) ConvertToEngineConfig(cfg *engine.Config) {
 		val = 0
 	}
 	cfg.StorageApi.WorkersCount = val
+
+	enabled, err := strconv.ParseBool(f.DedupEnabled)
+	if err != nil {
+		enabled = false
+	}
+	cfg.Dedup.Enabled = enabled
+	cfg.Dedup.Backend = f.DedupBackend
+	cfg.Dedup.Path = f.DedupPath
+
+	val, err = strconv.Atoi(f.DedupCapacity)
+	if err != nil {
+		log.Print("error converting dedup capacity config value. Setting to default")
+		val = 0
+	}
+	cfg.Dedup.Capacity = val
+
+	timeout, err = time.ParseDuration(f.DedupWindow)
+	if err != nil {
+		log.Printf("error converting Dedup Window config value to time: %s", err)
+		timeout = 0
+	}
+	cfg.Dedup.Window = timeout
+
+	cfg.AckLedgerPath = f.AckLedgerPath
+	if f.AckLedgerWindow != "" {
+		timeout, err = time.ParseDuration(f.AckLedgerWindow)
+		if err != nil {
+			log.Printf("error converting Ack Ledger Window config value to time: %s", err)
+			timeout = 0
+		}
+		cfg.AckLedgerWindow = timeout
+	}
+	cfg.Validation.SourceSchema = f.SourceSchema
+	cfg.Validation.ProcessingSchema = f.ProcessingSchema
+	cfg.Validation.QuarantinePath = f.QuarantinePath
+	cfg.Privacy = f.Privacy
+	cfg.Integrity = f.Integrity
+
+	for _, fs := range f.Stages {
+		stage := engine.StageConfig{
+			Name:   fs.Name,
+			URL:    fs.URL,
+			Method: fs.Method,
+		}
+
+		val, err = strconv.Atoi(fs.ExpectedStatus)
+		if err != nil {
+			log.Printf("error converting expected status for stage '%s' to int: %s", fs.Name, err)
+			val = 0
+		}
+		stage.ExpectedStatus = val
+
+		timeout, err = time.ParseDuration(fs.Timeout)
+		if err != nil {
+			log.Printf("error converting timeout for stage '%s' to time: %s", fs.Name, err)
+			timeout = 0
+		}
+		stage.Timeout = timeout
+
+		val, err = strconv.Atoi(fs.Workers)
+		if err != nil {
+			log.Printf("error converting workers for stage '%s' to int: %s", fs.Name, err)
+			val = 0
+		}
+		stage.Workers = val
+
+		val, err = strconv.Atoi(fs.MaxRetries)
+		if err != nil {
+			log.Printf("error converting max retries for stage '%s' to int: %s", fs.Name, err)
+			val = 0
+		}
+		stage.MaxRetries = val
+		fs.Auth.convert(fs.Name, &stage.Auth)
+		stage.Signing = fs.Signing
+		stage.CloudEvents = fs.CloudEvents
+		stage.TLS = fs.TLS
+
+		cfg.Stages = append(cfg.Stages, stage)
+	}
+
+	cfg.CheckpointPath = f.CheckpointPath
+	cfg.WAL = f.WAL
+	cfg.AckTracking, _ = strconv.ParseBool(f.AckTracking)
+	cfg.Ordering = f.Ordering
+
+	for _, fs := range f.Sources {
+		source := engine.SourceConfig{
+			Name:         fs.Name,
+			URL:          fs.URL,
+			AuthToken:    fs.AuthToken,
+			Mode:         fs.Mode,
+			StreamFormat: fs.StreamFormat,
+			StreamPath:   fs.StreamPath,
+		}
+
+		timeout, err = time.ParseDuration(fs.Timeout)
+		if err != nil {
+			log.Printf("error converting timeout for source '%s' to time: %s", fs.Name, err)
+			timeout = 0
+		}
+		source.ClientTimeout = timeout
+
+		val, err = strconv.Atoi(fs.RateLimit)
+		if err != nil {
+			log.Printf("error converting rate limit for source '%s' to int: %s", fs.Name, err)
+			val = 0
+		}
+		source.RateLimit = val
+
+		val, err = strconv.Atoi(fs.RateLimitDuration)
+		if err != nil {
+			log.Printf("error converting rate limit duration for source '%s' to int: %s", fs.Name, err)
+			val = 0
+		}
+		source.RateLimitDuration = val
+		fs.Auth.convert(fs.Name, &source.Auth)
+		source.TLS = fs.TLS
+		source.Fields = fs.Fields
+		source.Schema = fs.Schema
+		source.CloudEvents, _ = strconv.ParseBool(fs.CloudEvents)
+		source.Codec = fs.Codec
+		source.MaxResponseSize = convertMaxResponseSize(fs.Name, fs.MaxResponseSize)
+
+		isolated, err := strconv.ParseBool(fs.Isolated)
+		if err != nil {
+			isolated = false
+		}
+		source.Isolated = isolated
+		convertPollConfig(fs.Name, fs.PageSize, fs.MinPollInterval, fs.MaxPollInterval, &source)
+		fs.Pagination.convert(fs.Name, &source.Pagination)
+		convertPartitionConfig(fs.Name, fs.Partitions, fs.PartitionParam, &source)
+
+		cfg.Sources = append(cfg.Sources, source)
+	}
+
+	enabled, err = strconv.ParseBool(f.WebhookEnabled)
+	if err != nil {
+		enabled = false
+	}
+	cfg.Webhook.Enabled = enabled
+	cfg.Webhook.Name = f.WebhookName
+	cfg.Webhook.Addr = f.WebhookAddr
+	cfg.Webhook.Path = f.WebhookPath
+	cfg.Webhook.Secret = f.WebhookSecret
+	cfg.Webhook.SpoolPath = f.WebhookSpoolPath
+	cfg.Webhook.CloudEvents, _ = strconv.ParseBool(f.WebhookCloudEvents)
+
+	val, err = strconv.Atoi(f.WebhookMaxPending)
+	if err != nil {
+		log.Print("error converting webhook max pending config value. Setting to default")
+		val = 0
+	}
+	cfg.Webhook.MaxPending = val
+
+	cfg.AdminAddr = f.AdminAddr
+}
+
+// convertMaxResponseSize returns the largest page size of a source, 0 for the
+// engine default when unset.
+func convertMaxResponseSize(name, size string) int {
+	if size == "" {
+		return 0
+	}
+	val, err := strconv.Atoi(size)
+	if err != nil {
+		log.Printf("error converting max response size for source '%s' to int: %s", name, err)
+		return 0
+	}
+	return val
+}
+
+// convertPollConfig sets the optional adaptive polling values of a source,
+// leaving them 0 for the engine defaults when unset.
+func convertPollConfig(name, pageSize, minInterval, maxInterval string, source *engine.SourceConfig) {
+	if pageSize != "" {
+		val, err := strconv.Atoi(pageSize)
+		if err != nil {
+			log.Printf("error converting page size for source '%s' to int: %s", name, err)
+		}
+		source.PageSize = val
+	}
+	if minInterval != "" {
+		interval, err := time.ParseDuration(minInterval)
+		if err != nil {
+			log.Printf("error converting min poll interval for source '%s' to time: %s", name, err)
+		}
+		source.MinPollInterval = interval
+	}
+	if maxInterval != "" {
+		interval, err := time.ParseDuration(maxInterval)
+		if err != nil {
+			log.Printf("error converting max poll interval for source '%s' to time: %s", name, err)
+		}
+		source.MaxPollInterval = interval
+	}
+}
+
+func convertPartitionConfig(name, partitions, param string, source *engine.SourceConfig) {
+	source.PartitionParam = param
+	if partitions != "" {
+		val, err := strconv.Atoi(partitions)
+		if err != nil {
+			log.Printf("error converting partitions for source '%s' to int: %s", name, err)
+		}
+		source.Partitions = val
+	}
+}
+
+func (ft *FileTransportConfig) convert(transport *engine.TransportConfig) {
+	for _, field := range []struct {
+		name  string
+		value string
+		dest  *int
+	}{
+		{"maxIdleConns", ft.MaxIdleConns, &transport.MaxIdleConns},
+		{"maxIdleConnsPerHost", ft.MaxIdleConnsPerHost, &transport.MaxIdleConnsPerHost},
+		{"maxConnsPerHost", ft.MaxConnsPerHost, &transport.MaxConnsPerHost},
+	} {
+		if field.value == "" {
+			continue
+		}
+		val, err := strconv.Atoi(field.value)
+		if err != nil {
+			log.Printf("error converting transport %s to int: %s", field.name, err)
+			val = 0
+		}
+		*field.dest = val
+	}
+
+	for _, field := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"idleConnTimeout", ft.IdleConnTimeout, &transport.IdleConnTimeout},
+		{"keepAlive", ft.KeepAlive, &transport.KeepAlive},
+		{"dialTimeout", ft.DialTimeout, &transport.DialTimeout},
+		{"tlsHandshakeTimeout", ft.TLSHandshakeTimeout, &transport.TLSHandshakeTimeout},
+	} {
+		if field.value == "" {
+			continue
+		}
+		val, err := time.ParseDuration(field.value)
+		if err != nil {
+			log.Printf("error converting transport %s to time: %s", field.name, err)
+			val = 0
+		}
+		*field.dest = val
+	}
+
+	if ft.DisableHTTP2 != "" {
+		disabled, err := strconv.ParseBool(ft.DisableHTTP2)
+		if err != nil {
+			log.Printf("error converting transport disableHttp2 to bool: %s", err)
+		}
+		transport.DisableHTTP2 = disabled
+	}
+}
+
+func (fa *FileAuthConfig) convert(name string, auth *engine.AuthConfig) {
+	auth.Type = fa.Type
+	auth.Header = fa.Header
+	auth.Token = fa.Token
+	auth.Username = fa.Username
+	auth.Password = fa.Password
+	auth.TokenURL = fa.TokenURL
+	auth.ClientID = fa.ClientID
+	auth.ClientSecret = fa.ClientSecret
+	auth.Scopes = fa.Scopes
+
+	if fa.RefreshBefore != "" {
+		refreshBefore, err := time.ParseDuration(fa.RefreshBefore)
+		if err != nil {
+			log.Printf("error converting auth refreshBefore for '%s' to time: %s", name, err)
+			refreshBefore = 0
+		}
+		auth.RefreshBefore = refreshBefore
+	}
+}
+
+func (fp *FilePaginationConfig) convert(name string, pagination *engine.PaginationConfig) {
+	pagination.Strategy = fp.Strategy
+	pagination.Path = fp.Path
+	pagination.Param = fp.Param
+	pagination.LimitParam = fp.LimitParam
+	pagination.ResultsField = fp.ResultsField
+	pagination.CursorField = fp.CursorField
+	if fp.Limit != "" {
+		val, err := strconv.Atoi(fp.Limit)
+		if err != nil {
+			log.Printf("error converting pagination limit for source '%s' to int: %s", name, err)
+		}
+		pagination.Limit = val
+	}
 }
 
 func readConfig(cfg *engine.Config) {
@@ -146,34 +605,137 @@ func validateConfig(cfg *engine.Config) {
 	if cfg.DefaultWorkersCount == 0 {
 		cfg.DefaultWorkersCount = 3
 	}
-	if cfg.SourceApi.URL == "" {
-		log.Fatal("FATAL: Must set Source API base url in helm/config.yaml. Stopping execution.")
+	names := make(map[string]bool)
+	for i := range cfg.Sources {
+		source := &cfg.Sources[i]
+		if source.Name == "" || source.URL == "" || (source.AuthToken == "" && source.Auth.Type == "") {
+			log.Fatalf("FATAL: Must set name, baseUrl and authToken or auth for every source in helm/config.yaml, source %d is missing one. Stopping execution.", i)
+		}
+		if names[source.Name] {
+			log.Fatalf("FATAL: Source names must be unique, '%s' is configured more than once. Stopping execution.", source.Name)
+		}
+		names[source.Name] = true
+		if source.ClientTimeout == 0 {
+			source.ClientTimeout = cfg.DefaultClientTimeout
+		}
+		if source.RateLimitDuration == 0 {
+			source.RateLimitDuration = 1
+		}
+		validateSourceMode(source)
+	}
+	if cfg.Webhook.Enabled {
+		if cfg.Webhook.Secret == "" {
+			log.Fatal("FATAL: Must set webhookSecret in helm/config.yaml when the webhook source is enabled. Stopping execution.")
+		}
+		if cfg.Webhook.SpoolPath == "" {
+			log.Fatal("FATAL: Must set webhookSpoolPath in helm/config.yaml when the webhook source is enabled, batches are spooled before they are acknowledged. Stopping execution.")
+		}
+		if cfg.Webhook.Name == "" {
+			cfg.Webhook.Name = "webhook"
+		}
+		if cfg.Webhook.Addr == "" {
+			cfg.Webhook.Addr = ":8080"
+		}
+		if cfg.Webhook.Path == "" {
+			cfg.Webhook.Path = "/messages"
+		}
+		if cfg.Webhook.MaxPending == 0 {
+			cfg.Webhook.MaxPending = 100
+		}
 	}
-	if cfg.SourceApi.AuthToken == "" {
-		log.Fatal("FATAL: Must set Source API auth token in helm/config.yaml. Stopping execution.")
+	// the single Source API is not used when sources are configured, and is
+	// optional when messages are pushed to the webhook source
+	if len(cfg.Sources) == 0 && !(cfg.Webhook.Enabled && cfg.SourceApi.URL == "") {
+		if cfg.SourceApi.URL == "" {
+			log.Fatal("FATAL: Must set Source API base url in helm/config.yaml. Stopping execution.")
+		}
+		if cfg.SourceApi.AuthToken == "" && cfg.SourceApi.Auth.Type == "" {
+			log.Fatal("FATAL: Must set Source API auth token or auth in helm/config.yaml. Stopping execution.")
+		}
+		if cfg.SourceApi.ClientTimeout == 0 {
+			cfg.SourceApi.ClientTimeout = cfg.DefaultClientTimeout
+		}
+		if cfg.SourceApi.RateLimitDuration == 0 {
+			cfg.SourceApi.RateLimitDuration = 1
+		}
+		validateSourceMode(&cfg.SourceApi)
 	}
-	if cfg.SourceApi.ClientTimeout == 0 {
-		cfg.SourceApi.ClientTimeout = cfg.DefaultClientTimeout
+	for i := range cfg.Stages {
+		stage := &cfg.Stages[i]
+		if stage.Name == "" || stage.URL == "" {
+			log.Fatalf("FATAL: Must set name and url for every stage in helm/config.yaml, stage %d is missing one. Stopping execution.", i)
+		}
+		if stage.Method == "" {
+			stage.Method = http.MethodPost
+		}
+		if stage.ExpectedStatus == 0 {
+			stage.ExpectedStatus = http.StatusOK
+		}
+		if stage.Timeout == 0 {
+			stage.Timeout = cfg.DefaultClientTimeout
+		}
+		if stage.Workers == 0 {
+			stage.Workers = cfg.DefaultWorkersCount
+		}
 	}
-	if cfg.SourceApi.RateLimitDuration == 0 {
-		cfg.SourceApi.RateLimitDuration = 1
+	// the processing and storage APIs are not used when stages are configured
+	if len(cfg.Stages) == 0 {
+		if cfg.ProcessingApi.URL == "" {
+			log.Fatal("FATAL: Must set Processing API base url in helm/config.yaml. Stopping execution.")
+		}
+		if cfg.ProcessingApi.Timeout == 0 {
+			cfg.ProcessingApi.Timeout = cfg.DefaultClientTimeout
+		}
+		if cfg.ProcessingApi.WorkersCount == 0 {
+			cfg.ProcessingApi.WorkersCount = cfg.DefaultWorkersCount
+		}
+		if cfg.StorageApi.URL == "" {
+			log.Fatal("FATAL: Must set Storage API base url in helm/config.yaml. Stopping execution.")
+		}
+		if cfg.StorageApi.Timeout == 0 {
+			cfg.StorageApi.Timeout = cfg.DefaultClientTimeout
+		}
+		if cfg.StorageApi.WorkersCount == 0 {
+			cfg.StorageApi.WorkersCount = cfg.DefaultWorkersCount
+		}
 	}
-	if cfg.ProcessingApi.URL == "" {
-		log.Fatal("FATAL: Must set Processing API base url in helm/config.yaml. Stopping execution.")
+	if cfg.Dedup.Enabled {
+		if cfg.Dedup.Backend == "" {
+			cfg.Dedup.Backend = engine.DedupBackendMemory
+		}
+		if cfg.Dedup.Capacity == 0 {
+			cfg.Dedup.Capacity = 100000
+		}
+		if cfg.Dedup.Window == 0 {
+			cfg.Dedup.Window = time.Hour
+		}
+		if cfg.Dedup.Backend == engine.DedupBackendFile && cfg.Dedup.Path == "" {
+			log.Fatal("FATAL: Must set dedupPath in helm/config.yaml when using the file dedup backend. Stopping execution.")
+		}
+	}
+
+	if cfg.AckLedgerPath != "" && cfg.AckLedgerWindow == 0 {
+		cfg.AckLedgerWindow = 24 * time.Hour
+	}
+}
+
+func validateSourceMode(source *engine.SourceConfig) {
+	if source.Mode == "" {
+		source.Mode = engine.SourceModePoll
 	}
-	if cfg.ProcessingApi.Timeout == 0 {
-		cfg.ProcessingApi.Timeout = cfg.DefaultClientTimeout
+	if source.Mode != engine.SourceModePoll && source.Mode != engine.SourceModeStream {
+		log.Fatalf("FATAL: Source mode must be '%s' or '%s', got '%s'. Stopping execution.", engine.SourceModePoll, engine.SourceModeStream, source.Mode)
 	}
-	if cfg.ProcessingApi.WorkersCount == 0 {
-		cfg.ProcessingApi.WorkersCount = cfg.DefaultWorkersCount
+	if source.Mode != engine.SourceModeStream {
+		return
 	}
-	if cfg.StorageApi.URL == "" {
-		log.Fatal("FATAL: Must set Storage API base url in helm/config.yaml. Stopping execution.")
+	if source.Partitions > 1 {
+		log.Fatalf("FATAL: Stream sources cannot be partitioned, source '%s' sets partitions. Stopping execution.", source.Name)
 	}
-	if cfg.StorageApi.Timeout == 0 {
-		cfg.StorageApi.Timeout = cfg.DefaultClientTimeout
+	if source.StreamFormat == "" {
+		source.StreamFormat = engine.StreamFormatSSE
 	}
-	if cfg.StorageApi.WorkersCount == 0 {
-		cfg.StorageApi.WorkersCount = cfg.DefaultWorkersCount
+	if source.StreamFormat != engine.StreamFormatSSE && source.StreamFormat != engine.StreamFormatNDJSON {
+		log.Fatalf("FATAL: Source stream format must be '%s' or '%s', got '%s'. Stopping execution.", engine.StreamFormatSSE, engine.StreamFormatNDJSON, source.StreamFormat)
 	}
 }
@@ -76,23 +76,9 @@ func BuildCollectionEngineConfig(workers, rateLimit, rateLimitDuration int) *eng
 	cfg := engine.Config{
 		DefaultClientTimeout: duration,
 		DefaultWorkersCount:  3,
-		SourceApi: struct {
-			URL               string        "yaml:\"baseUrl\""
-			AuthToken         string        "yaml:\"authToken\""
-			ClientTimeout     time.Duration "yaml:\"timeout\""
-			RateLimit         int           "yaml:\"rateLimit\""
-			RateLimitDuration int           "yaml:\"rateLimitPeriodSecs\""
-		}{URL: "test", AuthToken: "test", ClientTimeout: duration, RateLimit: rateLimit, RateLimitDuration: rateLimitDuration},
-		ProcessingApi: struct {
-			URL          string        "yaml:\"baseUrl\""
-			Timeout      time.Duration "yaml:\"timeout\""
-			WorkersCount int           "yaml:\"workersCount\""
-		}{URL: "test", Timeout: duration, WorkersCount: workers},
-		StorageApi: struct {
-			URL          string        "yaml:\"baseUrl\""
-			Timeout      time.Duration "yaml:\"timeout\""
-			WorkersCount int           "yaml:\"workersCount\""
-		}{URL: "test", Timeout: duration, WorkersCount: workers},
+		SourceApi:            engine.SourceConfig{URL: "test", AuthToken: "test", ClientTimeout: duration, RateLimit: rateLimit, RateLimitDuration: rateLimitDuration},
+		ProcessingApi:        engine.ApiConfig{URL: "test", Timeout: duration, WorkersCount: workers},
+		StorageApi:           engine.ApiConfig{URL: "test", Timeout: duration, WorkersCount: workers},
 	}
 	return &cfg
 }
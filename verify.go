@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/dylanconnolly/collection-engine/engine"
+)
+
+const verifyUsage = `usage:
+  collection-engine verify [-public-key path] [file ...]
+`
+
+// runVerifyCommand checks the signatures of the stored records read from the
+// files, or stdin, against an Ed25519 public key and prints the result of
+// each. It returns 1 when any record fails, the process exit code.
+func runVerifyCommand(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	keyPath := fs.String("public-key", os.Getenv("COLLECTION_ENGINE_PUBLIC_KEY"), "PEM Ed25519 public key of the storage signing key")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, verifyUsage) }
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *keyPath == "" {
+		fmt.Fprint(os.Stderr, verifyUsage)
+		return 2
+	}
+	key, err := engine.LoadVerifyKey(*keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "ID\tCONTENT HASH\tSTATUS")
+	failed := false
+	check := func(name string, r io.Reader) bool {
+		ok, err := verifyRecords(key, r, w)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading %s: %s\n", name, err)
+			return false
+		}
+		failed = failed || !ok
+		return true
+	}
+	if fs.NArg() == 0 && !check("stdin", os.Stdin) {
+		return 1
+	}
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error opening %s: %s\n", path, err)
+			return 1
+		}
+		read := check(path, f)
+		f.Close()
+		if !read {
+			return 1
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// verifyRecords prints the result of every JSON record of r, one or more in
+// a row or one per line, and reports whether all of them verified.
+func verifyRecords(key ed25519.PublicKey, r io.Reader, w io.Writer) (bool, error) {
+	dec := json.NewDecoder(r)
+	ok := true
+	for {
+		var doc json.RawMessage
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			return ok, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		var record struct {
+			ID          string `json:"id"`
+			ContentHash string `json:"content_hash"`
+		}
+		json.Unmarshal(doc, &record)
+		status := "OK"
+		if err := engine.VerifyRecord(key, doc); err != nil {
+			status = "FAILED: " + err.Error()
+			ok = false
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", record.ID, record.ContentHash, status)
+	}
+}